@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/nicolagi/muscle/config"
+	"github.com/nicolagi/muscle/internal/block"
+	"github.com/nicolagi/muscle/storage"
+	"github.com/nicolagi/muscle/tree"
+	"github.com/pkg/errors"
+)
+
+// doFsck checks the trees of the given revisions, or of the remote base
+// and the roots of all hosts if none are given, reading directly from the
+// permanent store rather than through the cache. With -repair, items
+// missing from the permanent store are copied from the cache. Blocks are
+// read from the remote block store, which differs from the remote store if
+// packing is enabled.
+func doFsck(cfg *config.C, key []byte, cacheStore, remoteStore, remoteBlockStore storage.Store, args []string) error {
+	factory, err := block.NewFactory(nil, remoteBlockStore, key, block.WithOldKeys(cfg.OldEncryptionKeysBytes()...), block.WithLegacyFormats(!cfg.RejectLegacyBlocks), block.WithRefScheme(remoteStore, ""))
+	if err != nil {
+		return err
+	}
+	treeStore, err := tree.NewStore(factory, remoteStore, globalContext.base)
+	if err != nil {
+		return err
+	}
+	var revisions []storage.Pointer
+	for _, arg := range args {
+		p, err := storage.NewPointerFromHex(arg)
+		if err != nil {
+			return err
+		}
+		revisions = append(revisions, p)
+	}
+	if len(revisions) == 0 {
+		if revisions, err = fsckHeads(treeStore); err != nil {
+			return err
+		}
+	}
+	opts := []tree.CheckOption{tree.WithCheckWorkers(fsckContext.workers)}
+	if fsckContext.repair {
+		opts = append(opts, tree.WithRepair(func(k storage.Key) error {
+			v, err := cacheStore.Get(k)
+			if err != nil {
+				return err
+			}
+			return remoteBlockStore.Put(k, v)
+		}))
+	}
+	var problems int
+	for _, revision := range revisions {
+		report, err := treeStore.Check(revision, opts...)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("revision %v: %d nodes, %d blocks, %d items repaired, %d problems\n",
+			revision, report.Nodes, report.Blocks, report.Repaired, len(report.Problems))
+		var last string
+		for _, p := range report.Problems {
+			if p.Path != last {
+				fmt.Printf("%s\n", p.Path)
+				last = p.Path
+			}
+			fmt.Printf("\t%v\n", p.Err)
+		}
+		problems += len(report.Problems)
+	}
+	if problems > 0 {
+		return errors.Errorf("%d problems", problems)
+	}
+	return nil
+}
+
+// fsckHeads returns the remote base and the roots of all hosts, once each.
+func fsckHeads(treeStore *tree.Store) ([]storage.Pointer, error) {
+	var heads []storage.Pointer
+	if pointers, err := treeStore.RemoteRootPointers(); errors.Is(err, storage.ErrNotImplemented) {
+		log.Printf("cannot list host roots, only checking the remote base: %v", err)
+		p, err := treeStore.RemoteBasePointer()
+		if err != nil {
+			return nil, err
+		}
+		heads = append(heads, p)
+	} else if err != nil {
+		return nil, err
+	} else {
+		for _, p := range pointers {
+			heads = append(heads, p)
+		}
+	}
+	var unique []storage.Pointer
+	seen := make(map[string]bool)
+	for _, p := range heads {
+		if !p.IsNull() && !seen[p.Hex()] {
+			seen[p.Hex()] = true
+			unique = append(unique, p)
+		}
+	}
+	return unique, nil
+}
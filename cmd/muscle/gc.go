@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/nicolagi/muscle/storage"
+	"github.com/nicolagi/muscle/tree"
+	"github.com/pkg/errors"
+)
+
+type gcStats struct {
+	mu      sync.Mutex
+	recent  int
+	missing int
+	failed  int
+	deleted int
+	freed   int64
+}
+
+// doGC deletes from the remote store the items that aren't reachable from
+// any root (see liveKeys) within the retention window, and were stored
+// more than a grace period ago, so that items uploaded by a concurrent
+// push survive. Keys of deleted items are written to a journal first; the
+// local cache still has copies of the items it holds, which can be
+// restored by feeding the journal to "muscle upload". If packing is
+// enabled, items are deleted at once in the end, so that the index of each
+// pack is rewritten once, and packs that are mostly garbage are rewritten
+// afterwards.
+func doGC(treeStore *tree.Store, remoteStore storage.Store) error {
+	lister, ok := remoteStore.(storage.Lister)
+	if !ok {
+		return errors.Wrap(storage.ErrNotImplemented, "listing the remote store")
+	}
+	stater, ok := remoteStore.(storage.Stater)
+	if !ok {
+		return errors.Wrap(storage.ErrNotImplemented, "describing items in the remote store")
+	}
+	now := time.Now()
+	var since time.Time
+	if gcContext.retain > 0 {
+		since = now.Add(-gcContext.retain)
+	}
+	live, err := liveKeys(treeStore, since)
+	if err != nil {
+		return err
+	}
+	var candidates []storage.Key
+	if err := lister.List(context.Background(), "", func(item storage.ListItem) error {
+		// Leave alone what isn't an item, e.g., "remote.root.base".
+		if _, err := storage.NewPointerFromHex(string(item.Key)); err != nil {
+			return nil
+		}
+		if _, ok := live[string(item.Key)]; !ok {
+			candidates = append(candidates, item.Key)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	log.Printf("gc: %d live keys, %d candidates for deletion", len(live), len(candidates))
+
+	var journal *os.File
+	if !gcContext.dryRun && len(candidates) > 0 {
+		pathname := filepath.Join(globalContext.base, fmt.Sprintf("gc.journal.%d", now.Unix()))
+		if journal, err = os.OpenFile(pathname, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600); err != nil {
+			return errors.WithStack(err)
+		}
+		defer func() {
+			_ = journal.Close()
+		}()
+	}
+
+	packed, _ := remoteStore.(*storage.Packed)
+	// Items to delete with packed.DeleteMany, and their total size.
+	var doomed []storage.Key
+	var doomedBytes int64
+
+	var stats gcStats
+	pending := make(chan storage.Key, 4096)
+	var workers sync.WaitGroup
+	collect := func(key storage.Key) {
+		info, err := stater.Stat(key)
+		if errors.Is(err, storage.ErrNotFound) {
+			stats.mu.Lock()
+			stats.missing++
+			stats.mu.Unlock()
+			return
+		}
+		if err != nil {
+			log.Printf("gc: %s: %+v", key, err)
+			stats.mu.Lock()
+			stats.failed++
+			stats.mu.Unlock()
+			return
+		}
+		if now.Sub(info.Modified) < gcContext.grace {
+			stats.mu.Lock()
+			stats.recent++
+			stats.mu.Unlock()
+			return
+		}
+		if journal != nil {
+			// The journal entry must be durable before the deletion.
+			stats.mu.Lock()
+			_, err := fmt.Fprintln(journal, key)
+			if err == nil {
+				err = journal.Sync()
+			}
+			if err == nil && packed != nil {
+				doomed = append(doomed, key)
+				doomedBytes += info.Size
+				stats.mu.Unlock()
+				return
+			}
+			stats.mu.Unlock()
+			if err == nil {
+				err = remoteStore.Delete(key)
+			}
+			if err != nil {
+				log.Printf("gc: %s: %+v", key, err)
+				stats.mu.Lock()
+				stats.failed++
+				stats.mu.Unlock()
+				return
+			}
+		}
+		stats.mu.Lock()
+		stats.deleted++
+		stats.freed += info.Size
+		if stats.deleted%1000 == 0 {
+			log.Printf("gc: %d items, %d bytes so far", stats.deleted, stats.freed)
+		}
+		stats.mu.Unlock()
+	}
+	for i := 0; i < 32; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for key := range pending {
+				collect(key)
+			}
+		}()
+	}
+	for _, key := range candidates {
+		pending <- key
+	}
+	close(pending)
+	workers.Wait()
+	if len(doomed) > 0 {
+		if err := packed.DeleteMany(doomed); err != nil {
+			log.Printf("gc: deleting %d items: %+v", len(doomed), err)
+			stats.failed += len(doomed)
+		} else {
+			stats.deleted += len(doomed)
+			stats.freed += doomedBytes
+		}
+	}
+
+	verb := "deleted"
+	if gcContext.dryRun {
+		verb = "would delete"
+	}
+	fmt.Printf("%s %d items, %d bytes; kept %d items stored less than %v ago; %d items vanished, %d failures\n",
+		verb, stats.deleted, stats.freed, stats.recent, gcContext.grace, stats.missing, stats.failed)
+	if journal != nil {
+		fmt.Printf("to undo, while the items are still cached: muscle upload < %s\n", journal.Name())
+	}
+	if packed != nil && !gcContext.dryRun {
+		rs, err := packed.Repack(0.5)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("repacked %d of %d packs, deleted %d packs, %d bytes\n", rs.Rewritten, rs.Packs, rs.Deleted, rs.Freed)
+	}
+	if stats.failed > 0 {
+		return errors.Errorf("%d failures", stats.failed)
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/nicolagi/muscle/config"
+	"github.com/nicolagi/muscle/internal/kdf"
+	"github.com/pkg/errors"
+)
+
+// readPassphrase reads a line from the given file descriptor or, if it is
+// zero, from the terminal with echo disabled, after printing the prompt.
+// If confirm is true, the passphrase is asked for twice, when reading from
+// the terminal.
+func readPassphrase(fd int, prompt string, confirm bool) ([]byte, error) {
+	if fd != 0 {
+		f := os.NewFile(uintptr(fd), "passphrase-fd")
+		defer func() {
+			_ = f.Close()
+		}()
+		line, err := bufio.NewReader(f).ReadString('\n')
+		if err != nil && line == "" {
+			return nil, errors.Wrapf(err, "reading passphrase from file descriptor %d", fd)
+		}
+		return []byte(strings.TrimRight(line, "\r\n")), nil
+	}
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return nil, errors.Wrap(err, "no terminal to read passphrase from, use -passphrase-fd")
+	}
+	defer func() {
+		_ = tty.Close()
+	}()
+	stty := func(arg string) error {
+		cmd := exec.Command("stty", arg)
+		cmd.Stdin = tty
+		return cmd.Run()
+	}
+	if err := stty("-echo"); err != nil {
+		return nil, errors.Wrap(err, "disabling terminal echo")
+	}
+	defer func() {
+		_ = stty("echo")
+	}()
+	r := bufio.NewReader(tty)
+	read := func(prompt string) (string, error) {
+		_, _ = fmt.Fprint(tty, prompt)
+		line, err := r.ReadString('\n')
+		_, _ = fmt.Fprintln(tty)
+		return strings.TrimRight(line, "\r\n"), err
+	}
+	passphrase, err := read(prompt)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if confirm {
+		again, err := read("Repeat passphrase: ")
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if again != passphrase {
+			return nil, errors.New("passphrases do not match")
+		}
+	}
+	if passphrase == "" {
+		return nil, errors.New("empty passphrase")
+	}
+	return []byte(passphrase), nil
+}
+
+// doKeyExport prints the key wrapped with a passphrase.
+func doKeyExport(key []byte) error {
+	passphrase, err := readPassphrase(keyContext.passphraseFD, "Passphrase to protect the exported key: ", true)
+	if err != nil {
+		return err
+	}
+	wrapped, err := kdf.Wrap(key, passphrase)
+	if err != nil {
+		return err
+	}
+	fmt.Println(wrapped)
+	return nil
+}
+
+// doKeyImport reads a key wrapped by doKeyExport from standard input and
+// stores it in the configuration or, if requested, prints it.
+func doKeyImport(cfg *config.C) error {
+	wrapped, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && wrapped == "" {
+		return errors.Wrap(err, "reading wrapped key from standard input")
+	}
+	passphrase, err := readPassphrase(keyContext.passphraseFD, "Passphrase protecting the imported key: ", false)
+	if err != nil {
+		return err
+	}
+	key, err := kdf.Unwrap(wrapped, passphrase)
+	if err != nil {
+		return err
+	}
+	if keyContext.print {
+		fmt.Printf("%x\n", key)
+		return nil
+	}
+	if current := cfg.EncryptionKeyBytes(); len(current) > 0 && !bytes.Equal(current, key) {
+		log.Printf("key import: keeping the current encryption key among the old ones")
+	}
+	return config.RotateEncryptionKey(globalContext.base, key)
+}
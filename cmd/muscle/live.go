@@ -0,0 +1,76 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/nicolagi/muscle/storage"
+	"github.com/nicolagi/muscle/tree"
+	"github.com/pkg/errors"
+)
+
+// liveKeys returns the keys of all revisions, nodes and blocks reachable
+// from the remote root pointers (the base and the host roots), the local
+// base and the local root. From each of those revisions, it follows the
+// parents back to the first revision taken before the given time, which is
+// excluded, or to the first revision if the time is zero. Unlike
+// tree.Store.History, it fails if a revision can't be loaded, so that the
+// result can be trusted for deciding what to delete.
+func liveKeys(treeStore *tree.Store, since time.Time) (map[string]struct{}, error) {
+	var heads []storage.Pointer
+	if pointers, err := treeStore.RemoteRootPointers(); errors.Is(err, storage.ErrNotImplemented) {
+		log.Printf("cannot list host roots, only considering the remote base: %v", err)
+		p, err := treeStore.RemoteBasePointer()
+		if err != nil {
+			return nil, err
+		}
+		heads = append(heads, p)
+	} else if err != nil {
+		return nil, err
+	} else {
+		for _, p := range pointers {
+			heads = append(heads, p)
+		}
+	}
+	if p, err := treeStore.LocalBasePointer(); err != nil {
+		return nil, err
+	} else {
+		heads = append(heads, p)
+	}
+	keys := make(map[string]struct{})
+	seen := make(map[string]bool)
+	for _, head := range heads {
+		for key := head; !key.IsNull() && !seen[key.Hex()]; {
+			r, err := treeStore.LoadRevisionByKey(key)
+			if err != nil {
+				return nil, errors.Wrapf(err, "loading revision %v", key)
+			}
+			if !key.Equals(head) && r.Time().Before(since) {
+				break
+			}
+			seen[key.Hex()] = true
+			t, err := tree.NewTree(treeStore, tree.WithRevision(key))
+			if err != nil {
+				return nil, err
+			}
+			if _, err := t.ReachableKeys(keys); err != nil {
+				return nil, err
+			}
+			key = r.Parent()
+		}
+	}
+	rootKey, err := treeStore.LocalRootKey()
+	if err != nil {
+		return nil, err
+	}
+	if !rootKey.IsNull() {
+		t, err := tree.NewTree(treeStore, tree.WithRoot(rootKey))
+		if err != nil {
+			return nil, err
+		}
+		if _, err := t.ReachableKeys(keys); err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
+}
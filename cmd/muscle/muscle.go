@@ -2,6 +2,7 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"flag"
 	"fmt"
 	"io/ioutil"
@@ -16,6 +17,7 @@ import (
 	"github.com/lionkov/go9p/p/clnt"
 	"github.com/nicolagi/muscle/config"
 	"github.com/nicolagi/muscle/internal/block"
+	"github.com/nicolagi/muscle/internal/kdf"
 	"github.com/nicolagi/muscle/storage"
 	"github.com/nicolagi/muscle/tree"
 	"github.com/pkg/errors"
@@ -48,6 +50,26 @@ var (
 		maxSize int
 	}
 
+	fsckContext struct {
+		repair  bool
+		workers int
+	}
+
+	gcContext struct {
+		dryRun bool
+		retain time.Duration
+		grace  time.Duration
+	}
+
+	waitSyncedContext struct {
+		timeout time.Duration
+	}
+
+	keyContext struct {
+		passphraseFD int
+		print        bool
+	}
+
 	historyContext struct {
 		prefix string
 		count  int
@@ -78,7 +100,7 @@ func exitUsage(msg string) {
 
 Commands:
 
-	clean: remove unneeded items from the persistent store - use with caution
+	clean: remove unneeded items from the persistent store - use with caution, or better, use gc
 
 		At some point you might want to trim your history to reduce your S3 bill. This is a dangerous way to achieve
 		that and I haven't done it in ages. I say it's dangerous because it involves deleting stuff, and that's never
@@ -102,6 +124,8 @@ Commands:
 		- Compare with ls -lR of main musclefs (which whould also use cache files that might have been erroneuously
 		removed from the remote).
 
+	compression: report the size of the local tree's file data, before and after compression and encryption
+
 * control
 
 Reads commands line by line from standard input and sends them to
@@ -110,11 +134,83 @@ output. An example usage is "muco pull | muco" where "muco" is
 defined as "fn muco { muscle control $* ; }".
 
 	diff: compare local tree to the remote tree
+
+* fsck
+
+The “fsck” command checks that the given revisions, or the remote
+base and the roots of all hosts if none are given, are intact in
+the permanent store: the revision and every node can be read and
+decoded, every block exists and matches its hash, file sizes agree
+with their blocks, and no directory has two children with the same
+name. It reads from the permanent store directly, bypassing the
+cache, checking up to -j nodes concurrently, and prints the problems
+found by path. With -repair, it copies the items missing from the
+permanent store from the cache, if it has them, which is also what
+the “upload” command does, given the keys.
+
+* gc
+
+The “gc” command deletes from the permanent store the items that
+are not reachable from the remote base, the roots of all hosts,
+the local base or the local tree, keeping the history of each of
+those back to the retention window (-retain). Items stored within
+the grace period (-grace) are never deleted, so a concurrent push
+from another host is safe. With -n, it only reports the number of
+items and bytes it would delete. The keys of deleted items are
+written to a journal file in the base directory before deletion;
+items are not deleted from the cache, so a mistake can be undone,
+as long as the cache still holds the items, by feeding the journal
+to the “upload” command. If small items are packed (see pack-size
+in the configuration), it then rewrites the packs that are mostly
+made of deleted items, and deletes those made only of them.
+
 	history: shows the history of the tree
 	init: initializes configuration given the base directory
+
+* key
+
+The “key export” command prints the encryption key, wrapped with a
+passphrase read from the terminal, on a single line. The “key
+import” command reads such a line from standard input and stores
+the unwrapped key in the configuration, keeping any previous key
+among the old encryption keys. With -print, it prints the key as
+64 hex digits instead, e.g., to store it in a password manager to
+use with the encryption-key-command configuration setting. Use
+-passphrase-fd to read the passphrase from a file descriptor.
+
 	list: list all keys in remote store
 	reachable: reads a list of line-separated revision keys from standard input and lists all keys reachable from them to standard output
 
+* rekey
+
+The “rekey” command generates a new encryption key, re-encrypts
+all items reachable from the remote base, the roots of all hosts
+and the local tree under the new key, and finally switches the
+configuration to the new key. The previous key is kept among the
+old encryption keys, so that anything left over can still be read.
+Stop musclefs on all hosts before running it, and copy the new
+configuration to the other hosts afterwards. If interrupted, run
+it again to resume: progress is kept in the rekey.journal file in
+the base directory.
+
+* scrub
+
+The “scrub” command reads all items in the permanent store, if
+its type is “erasure”, and re-creates the shards that are missing
+or corrupt from the others, reporting the items that can't be
+reconstructed. If the type is “mirror”, it copies the items that
+are missing from some mirrors from the others, which musclefs
+also does periodically.
+
+* sync-status
+
+The “sync-status” command asks musclefs how many items are yet to
+be copied from the cache to the permanent store, how long the
+oldest of those has been waiting, how many were copied or found
+missing from the cache since musclefs started, the current upload
+throughput, whether uploads are running, and whether the permanent
+store is reachable. (It's the same as “muscle control status”.)
+
 * upload
 
 The “upload” command reads a list of 64-digit hexadecimal keys
@@ -128,6 +224,15 @@ a logging 9P proxy such as https://github.com/nicolagi/pine to see
 error messages in Linux).
 
 	version: show version information
+
+* wait-synced
+
+The “wait-synced” command waits until musclefs has copied all items
+from the cache to the permanent store, e.g., before shutting down a
+laptop, reporting progress every so often. With -timeout, it gives
+up, with a non-zero exit status, after the given duration. Note
+that a snapshot (“push”) must have completed for new data to be in
+the queue in the first place.
 `, os.Args[0])
 	os.Exit(2)
 }
@@ -144,6 +249,15 @@ func main() {
 	diffFlags.StringVar(&diffContext.prefix, "prefix", "", "omit diffs outside of `path`, e.g., project/name")
 	diffFlags.IntVar(&diffContext.maxSize, "S", 256*1024, "do not diff nodes larger than `count` bytes")
 
+	fsckFlags := newFlagSet("fsck")
+	fsckFlags.BoolVar(&fsckContext.repair, "repair", false, "copy items missing from the permanent store from the cache")
+	fsckFlags.IntVar(&fsckContext.workers, "j", 16, "check up to `count` nodes concurrently")
+
+	gcFlags := newFlagSet("gc")
+	gcFlags.BoolVar(&gcContext.dryRun, "n", false, "only report what would be deleted")
+	gcFlags.DurationVar(&gcContext.retain, "retain", 30*24*time.Hour, "keep revisions taken within this `duration`, or all revisions if zero")
+	gcFlags.DurationVar(&gcContext.grace, "grace", 24*time.Hour, "do not delete items stored within this `duration`")
+
 	// For all commands that don't take flags.
 	emptyFlags := newFlagSet("empty")
 
@@ -159,6 +273,13 @@ func main() {
 	historyFlags.BoolVar(&historyContext.verbose, "v", false, "include metadata changes (requires -d)")
 	historyFlags.IntVar(&historyContext.maxSize, "S", 256*1024, "do not diff nodes larger than `count` bytes")
 
+	waitSyncedFlags := newFlagSet("wait-synced")
+	waitSyncedFlags.DurationVar(&waitSyncedContext.timeout, "timeout", 0, "give up after `duration`, if positive")
+
+	keyFlags := newFlagSet("key")
+	keyFlags.IntVar(&keyContext.passphraseFD, "passphrase-fd", 0, "read the passphrase from file descriptor `fd` instead of the terminal")
+	keyFlags.BoolVar(&keyContext.print, "print", false, "print the imported key instead of storing it in the configuration (import only)")
+
 	// TODO does update encoding work?
 
 	if len(os.Args) < 2 {
@@ -179,6 +300,11 @@ func main() {
 			cleanFlags.Usage()
 			os.Exit(2)
 		}
+	case "compression":
+		_ = emptyFlags.Parse(os.Args[2:])
+		if narg := emptyFlags.NArg(); narg != 0 {
+			exitUsage(fmt.Sprintf("compression: no args expected, got %d", narg))
+		}
 	case "control":
 		_ = emptyFlags.Parse(os.Args[2:])
 	case "diff":
@@ -186,6 +312,13 @@ func main() {
 		if narg := diffFlags.NArg(); narg != 0 {
 			exitUsage(fmt.Sprintf("diff: no args expected, got %d\n", narg))
 		}
+	case "fsck":
+		_ = fsckFlags.Parse(os.Args[2:])
+	case "gc":
+		_ = gcFlags.Parse(os.Args[2:])
+		if narg := gcFlags.NArg(); narg != 0 {
+			exitUsage(fmt.Sprintf("gc: no args expected, got %d", narg))
+		}
 	case "history":
 		_ = historyFlags.Parse(os.Args[2:])
 		if narg := historyFlags.NArg(); narg != 0 {
@@ -196,6 +329,14 @@ func main() {
 		if narg := emptyFlags.NArg(); narg != 0 {
 			exitUsage(fmt.Sprintf("init: no args expected, got %d", narg))
 		}
+	case "key":
+		if len(os.Args) < 3 || (os.Args[2] != "export" && os.Args[2] != "import") {
+			exitUsage("key: export or import expected")
+		}
+		_ = keyFlags.Parse(os.Args[3:])
+		if narg := keyFlags.NArg(); narg != 0 {
+			exitUsage(fmt.Sprintf("key: no args expected after %s, got %d", os.Args[2], narg))
+		}
 	case "list":
 		_ = emptyFlags.Parse(os.Args[2:])
 		if narg := emptyFlags.NArg(); narg != 0 {
@@ -211,6 +352,21 @@ func main() {
 		if narg := emptyFlags.NArg(); narg != 0 {
 			exitUsage(fmt.Sprintf("reachable: no args expected, got %d", narg))
 		}
+	case "rekey":
+		_ = emptyFlags.Parse(os.Args[2:])
+		if narg := emptyFlags.NArg(); narg != 0 {
+			exitUsage(fmt.Sprintf("rekey: no args expected, got %d", narg))
+		}
+	case "scrub":
+		_ = emptyFlags.Parse(os.Args[2:])
+		if narg := emptyFlags.NArg(); narg != 0 {
+			exitUsage(fmt.Sprintf("scrub: no args expected, got %d", narg))
+		}
+	case "sync-status":
+		_ = emptyFlags.Parse(os.Args[2:])
+		if narg := emptyFlags.NArg(); narg != 0 {
+			exitUsage(fmt.Sprintf("sync-status: no args expected, got %d", narg))
+		}
 	case "umount":
 		_ = emptyFlags.Parse(os.Args[2:])
 		if narg := emptyFlags.NArg(); narg != 0 {
@@ -221,6 +377,11 @@ func main() {
 		if narg := emptyFlags.NArg(); narg != 0 {
 			exitUsage(fmt.Sprintf("upload: no args expected, got %d", narg))
 		}
+	case "wait-synced":
+		_ = waitSyncedFlags.Parse(os.Args[2:])
+		if narg := waitSyncedFlags.NArg(); narg != 0 {
+			exitUsage(fmt.Sprintf("wait-synced: no args expected, got %d", narg))
+		}
 	case "version":
 		_ = emptyFlags.Parse(os.Args[2:])
 		if narg := emptyFlags.NArg(); narg != 0 {
@@ -267,6 +428,14 @@ func main() {
 		os.Exit(0)
 	}
 
+	// Importing a key must work with a configuration lacking one.
+	if os.Args[1] == "key" && os.Args[2] == "import" {
+		if err := doKeyImport(cfg); err != nil {
+			log.Fatalf("key import: %+v", err)
+		}
+		return
+	}
+
 	if os.Args[1] == "control" {
 		if err := doControl(cfg, os.Args[2:]); err != nil {
 			log.Printf("control: %+v", err)
@@ -276,6 +445,20 @@ func main() {
 		}
 	}
 
+	// These only talk to musclefs, like control.
+	switch os.Args[1] {
+	case "sync-status":
+		if err := doSyncStatus(cfg); err != nil {
+			log.Fatalf("sync-status: %+v", err)
+		}
+		os.Exit(0)
+	case "wait-synced":
+		if err := doWaitSynced(cfg, waitSyncedContext.timeout); err != nil {
+			log.Fatalf("wait-synced: %+v", err)
+		}
+		os.Exit(0)
+	}
+
 	stagingStore := storage.NewDiskStore(cfg.StagingDirectoryPath())
 	cacheStore := storage.NewDiskStore(cfg.CacheDirectoryPath())
 	remoteStore, err := storage.NewStore(cfg)
@@ -286,11 +469,24 @@ func main() {
 	if err != nil {
 		log.Fatalf("Could not create temporary file for bugs propagation log: %v", err)
 	}
-	paired, err := storage.NewPaired(cacheStore, remoteStore, f.Name())
+	key, err := kdf.EncryptionKey(cfg, remoteStore)
+	if err != nil {
+		log.Fatalf("Could not get encryption key: %v", err)
+	}
+	codec, err := block.NewFactory(nil, nil, key, block.WithCompression(cfg.Compression), block.WithOldKeys(cfg.OldEncryptionKeysBytes()...), block.WithLegacyFormats(!cfg.RejectLegacyBlocks))
+	if err != nil {
+		log.Fatalf("Could not build block factory: %v", err)
+	}
+	// Blocks go to packs, if enabled; pointers and other metadata don't.
+	remoteBlockStore, err := storage.NewPackedStore(cfg, remoteStore, codec)
+	if err != nil {
+		log.Fatalf("Could not load pack indexes: %v", err)
+	}
+	paired, err := storage.NewPaired(cacheStore, remoteBlockStore, f.Name())
 	if err != nil {
 		log.Fatalf("Could not start new paired store with log %q: %v", f.Name(), err)
 	}
-	blockFactory, err := block.NewFactory(stagingStore, paired, cfg.EncryptionKeyBytes())
+	blockFactory, err := block.NewFactory(stagingStore, paired, key, block.WithCompression(cfg.Compression), block.WithOldKeys(cfg.OldEncryptionKeysBytes()...), block.WithLegacyFormats(!cfg.RejectLegacyBlocks), block.WithRefScheme(remoteStore, cfg.BlockRefs))
 	if err != nil {
 		log.Fatalf("Could not build block factory: %v", err)
 	}
@@ -351,7 +547,7 @@ func main() {
 			// TODO log a warning
 			// TODO rethink output
 			_ = cacheStore.Delete(key.Key()) // Best effort
-			err := remoteStore.Delete(key.Key())
+			err := remoteBlockStore.Delete(key.Key())
 			if err != nil {
 				fmt.Print("O")
 				logrus.Error(err.Error())
@@ -364,6 +560,17 @@ func main() {
 			}
 		}
 
+	case "compression":
+		size, stored, err := localTree.StorageSize()
+		if err != nil {
+			log.Fatalf("Could not compute storage size: %+v", err)
+		}
+		ratio := 1.0
+		if stored > 0 {
+			ratio = float64(size) / float64(stored)
+		}
+		fmt.Printf("%d bytes stored as %d bytes, compression ratio %.2f\n", size, stored, ratio)
+
 	case "diff":
 		cmdlog := logrus.WithFields(logrus.Fields{})
 		remoteRevisionKey, err := treeStore.RemoteBasePointer()
@@ -385,6 +592,16 @@ func main() {
 			cmdlog.WithField("cause", err).Fatal("Could not diff against remote tree")
 		}
 
+	case "fsck":
+		if err := doFsck(cfg, key, cacheStore, remoteStore, remoteBlockStore, fsckFlags.Args()); err != nil {
+			log.Fatalf("fsck: %+v", err)
+		}
+
+	case "gc":
+		if err := doGC(treeStore, remoteBlockStore); err != nil {
+			log.Fatalf("gc: %+v", err)
+		}
+
 	case "history":
 		pointer, err := treeStore.RemoteBasePointer()
 		if err != nil {
@@ -423,22 +640,26 @@ func main() {
 			}
 		}
 
+	case "key":
+		if err := doKeyExport(key); err != nil {
+			log.Fatalf("key export: %+v", err)
+		}
+
 	case "list":
 		// TODO how does this work with clean and reachable?
 		// TODO note about encryption and that it's probably bad
-		store, ok := remoteStore.(storage.Lister)
+		store, ok := remoteBlockStore.(storage.Lister)
 		if !ok {
 			log.Fatal("Store does not implement github.com/nicolagi/muscle/storage.Lister.")
 		}
-		keys, err := store.List()
-		if err != nil {
-			log.Fatalf("Could not list keys in store: %v", err)
-		}
-		for key := range keys {
+		if err := store.List(context.Background(), "", func(item storage.ListItem) error {
 			// Do not print keys that are not hash pointers, e.g., "remote.root.myhost", "extraneous-key", ...
-			if _, err := storage.NewPointerFromHex(key); err == nil {
-				fmt.Println(key)
+			if _, err := storage.NewPointerFromHex(string(item.Key)); err == nil {
+				fmt.Println(item.Key)
 			}
+			return nil
+		}); err != nil {
+			log.Fatalf("Could not list keys in store: %v", err)
 		}
 
 	case "reachable":
@@ -467,8 +688,18 @@ func main() {
 			fmt.Println(k)
 		}
 
+	case "rekey":
+		if err := doRekey(cfg, key, stagingStore, cacheStore, remoteStore, remoteBlockStore); err != nil {
+			log.Fatalf("rekey: %+v", err)
+		}
+
+	case "scrub":
+		if err := doScrub(remoteStore); err != nil {
+			log.Fatalf("scrub: %+v", err)
+		}
+
 	case "upload":
-		doUpload(cacheStore, remoteStore)
+		doUpload(cacheStore, remoteBlockStore)
 
 	case "version":
 		fmt.Println(version)
@@ -478,22 +709,49 @@ func main() {
 	}
 }
 
-func doControl(c *config.C, args []string) error {
+// openControl connects to musclefs and opens its control file. The
+// returned function closes the file and the connection.
+func openControl(c *config.C) (ctl *clnt.File, closer func(), err error) {
 	user := p.OsUsers.Uid2User(os.Getuid())
 	fs, err := clnt.Mount(c.ListenNet, c.ListenAddr, "", 8192, user)
 	if err != nil {
-		return errors.Wrapf(err, "connecting to %s", c.ListenAddr)
+		return nil, nil, errors.Wrapf(err, "connecting to %s", c.ListenAddr)
 	}
-	defer fs.Unmount()
-	ctl, err := fs.FOpen("ctl", p.ORDWR)
+	ctl, err = fs.FOpen("ctl", p.ORDWR)
 	if err != nil {
-		return errors.Wrap(err, "opening control file")
+		fs.Unmount()
+		return nil, nil, errors.Wrap(err, "opening control file")
 	}
-	defer func() {
+	return ctl, func() {
 		if err := ctl.Close(); err != nil {
 			log.Printf("warning: closing control file: %v", err)
 		}
-	}()
+		fs.Unmount()
+	}, nil
+}
+
+// control sends a command to musclefs via its control file and returns
+// the response.
+func control(ctl *clnt.File, command []byte) ([]byte, error) {
+	if _, err := ctl.Write(command); err != nil {
+		return nil, errors.Wrapf(err, "writing command %q", command)
+	}
+	if _, err := ctl.Seek(0, 0); err != nil {
+		return nil, errors.Wrapf(err, "seeking to beginning of control file")
+	}
+	response, err := ioutil.ReadAll(ctl)
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading response for command %q", command)
+	}
+	return response, nil
+}
+
+func doControl(c *config.C, args []string) error {
+	ctl, closer, err := openControl(c)
+	if err != nil {
+		return err
+	}
+	defer closer()
 
 	var s *bufio.Scanner
 	if len(args) > 0 {
@@ -502,14 +760,8 @@ func doControl(c *config.C, args []string) error {
 		s = bufio.NewScanner(os.Stdin)
 	}
 	for s.Scan() {
-		if _, err := ctl.Write(s.Bytes()); err != nil {
-			return errors.Wrapf(err, "writing command %q", s.Bytes())
-		}
-		if _, err := ctl.Seek(0, 0); err != nil {
-			return errors.Wrapf(err, "seeking to beginning of control file")
-		}
-		if response, err := ioutil.ReadAll(ctl); err != nil {
-			return errors.Wrapf(err, "reading response for command %q", s.Bytes())
+		if response, err := control(ctl, s.Bytes()); err != nil {
+			return err
 		} else if _, err := os.Stdout.Write(response); err != nil {
 			return errors.Wrapf(err, "writing response to standard output for command %q", s.Bytes())
 		}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nicolagi/muscle/config"
+	"github.com/nicolagi/muscle/internal/block"
+	"github.com/nicolagi/muscle/storage"
+	"github.com/nicolagi/muscle/tree"
+	"github.com/pkg/errors"
+)
+
+// The rekey journal holds the new encryption key on the first line, and
+// the keys of the items that have been re-encrypted with it on the
+// following lines, so that an interrupted rekey can be resumed. It is
+// removed once the configuration has been switched to the new key.
+type rekeyJournal struct {
+	key  []byte
+	done map[string]bool
+
+	mu   sync.Mutex
+	file *os.File
+}
+
+func openRekeyJournal(pathname string) (*rekeyJournal, error) {
+	f, err := os.OpenFile(pathname, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	j := &rekeyJournal{done: make(map[string]bool), file: f}
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := s.Text()
+		if j.key == nil {
+			if j.key, err = hex.DecodeString(strings.TrimPrefix(line, "key ")); err != nil {
+				_ = f.Close()
+				return nil, errors.Wrapf(err, "%q: malformed key line", pathname)
+			}
+			continue
+		}
+		j.done[line] = true
+	}
+	if err := s.Err(); err != nil {
+		_ = f.Close()
+		return nil, errors.Wrapf(err, "scanning %q", pathname)
+	}
+	if j.key == nil {
+		j.key = make([]byte, 32)
+		if _, err := rand.Read(j.key); err != nil {
+			_ = f.Close()
+			return nil, errors.Wrap(err, "generating new key")
+		}
+		if _, err := fmt.Fprintf(f, "key %x\n", j.key); err != nil {
+			_ = f.Close()
+			return nil, errors.WithStack(err)
+		}
+		if err := f.Sync(); err != nil {
+			_ = f.Close()
+			return nil, errors.WithStack(err)
+		}
+	}
+	return j, nil
+}
+
+func (j *rekeyJournal) markDone(key string) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	_, err := fmt.Fprintln(j.file, key)
+	return err
+}
+
+func (j *rekeyJournal) close() error {
+	return j.file.Close()
+}
+
+// doRekey re-encrypts all reachable items under a new key and then
+// switches the configuration to the new key, keeping the current key among
+// the old keys. Blocks are read from and written to the remote block store
+// (see doFsck), the ref scheme to the remote store.
+func doRekey(cfg *config.C, key []byte, stagingStore, cacheStore, remoteStore, remoteBlockStore storage.Store) error {
+	if cfg.KeyDerivation != "" || cfg.EncryptionKeyCommand != "" || cfg.EncryptionKeyFD != 0 {
+		return errors.New("the encryption key must be stored in the configuration file")
+	}
+	journal, err := openRekeyJournal(filepath.Join(globalContext.base, "rekey.journal"))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = journal.close()
+	}()
+	newFactory, err := block.NewFactory(nil, nil, journal.key, block.WithCompression(cfg.Compression))
+	if err != nil {
+		return err
+	}
+
+	// Reading must work for items re-encrypted in a previous run, too.
+	paired, err := storage.NewPaired(cacheStore, remoteBlockStore, "")
+	if err != nil {
+		return err
+	}
+	oldKeys := append(append([][]byte(nil), cfg.OldEncryptionKeysBytes()...), journal.key)
+	readFactory, err := block.NewFactory(stagingStore, paired, key, block.WithOldKeys(oldKeys...), block.WithRefScheme(remoteStore, ""))
+	if err != nil {
+		return err
+	}
+	treeStore, err := tree.NewStore(readFactory, remoteStore, globalContext.base)
+	if err != nil {
+		return err
+	}
+
+	keys, err := liveKeys(treeStore, time.Time{})
+	if err != nil {
+		return err
+	}
+	log.Printf("rekey: %d reachable keys, %d re-encrypted already", len(keys), len(journal.done))
+
+	var completed, missing, failed uint32
+	pending := make(chan string, 4096)
+	var workers sync.WaitGroup
+	rekey := func(keyHex string) error {
+		p, err := storage.NewPointerFromHex(keyHex)
+		if err != nil {
+			return err
+		}
+		ref, err := block.NewRef(p.Bytes())
+		if err != nil {
+			return err
+		}
+		stored, err := readFactory.Recrypt(ref, newFactory)
+		if err != nil {
+			return err
+		}
+		if _, ok := ref.(block.IndexRef); ok {
+			return stagingStore.Put(ref.Key(), stored)
+		}
+		if err := remoteBlockStore.Put(ref.Key(), stored); err != nil {
+			return err
+		}
+		return cacheStore.Put(ref.Key(), stored)
+	}
+	for i := 0; i < 64; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for keyHex := range pending {
+				if err := rekey(keyHex); errors.Is(err, storage.ErrNotFound) {
+					log.Printf("rekey: %s: %v", keyHex, err)
+					atomic.AddUint32(&missing, 1)
+					continue
+				} else if err != nil {
+					log.Printf("rekey: %s: %+v", keyHex, err)
+					atomic.AddUint32(&failed, 1)
+					continue
+				}
+				if err := journal.markDone(keyHex); err != nil {
+					log.Printf("rekey: %s: could not update journal: %v", keyHex, err)
+				}
+				if n := atomic.AddUint32(&completed, 1); n%100 == 0 {
+					log.Printf("rekey: re-encrypted %d keys", n)
+				}
+			}
+		}()
+	}
+	for keyHex := range keys {
+		if _, err := storage.NewPointerFromHex(keyHex); err != nil {
+			// Not an item, e.g., the null revision of a tree loaded from a root.
+			continue
+		}
+		if !journal.done[keyHex] {
+			pending <- keyHex
+		}
+	}
+	close(pending)
+	workers.Wait()
+	log.Printf("rekey: re-encrypted %d keys, %d missing, %d failed", completed, missing, failed)
+	if failed > 0 {
+		return errors.Errorf("%d keys could not be re-encrypted, run rekey again to retry", failed)
+	}
+	if err := readFactory.RecryptRefScheme(remoteStore, newFactory); err != nil {
+		return err
+	}
+	if err := config.RotateEncryptionKey(globalContext.base, journal.key); err != nil {
+		return err
+	}
+	_ = journal.close()
+	if err := os.Remove(journal.file.Name()); err != nil {
+		return err
+	}
+	if !cfg.RejectLegacyBlocks && missing == 0 {
+		log.Printf("rekey: all blocks are authenticated now; consider setting reject-legacy-blocks in every host's configuration")
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/nicolagi/muscle/storage"
+	"github.com/pkg/errors"
+)
+
+// doScrub re-creates the shards of erasure-coded items, or the copies of
+// mirrored items, that are missing from some of the permanent stores.
+func doScrub(remoteStore storage.Store) error {
+	switch s := remoteStore.(type) {
+	case *storage.Erasure:
+		stats, err := s.Scrub()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("scrubbed %d items, re-created %d shards, %d failures, %d items lost\n",
+			stats.Keys, stats.Rewritten, stats.Failed, len(stats.Lost))
+		for _, key := range stats.Lost {
+			fmt.Printf("lost %s\n", key)
+		}
+		if stats.Failed > 0 || len(stats.Lost) > 0 {
+			return errors.Errorf("%d failures, %d items lost", stats.Failed, len(stats.Lost))
+		}
+	case *storage.Mirror:
+		stats, err := s.Repair()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("scrubbed %d items, copied %d items to mirrors, %d failures\n",
+			stats.Keys, stats.Copied, stats.Failed)
+		if stats.Failed > 0 {
+			return errors.Errorf("%d failures", stats.Failed)
+		}
+	default:
+		return errors.Errorf("%T: nothing to scrub, the storage type is neither erasure nor mirror", remoteStore)
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lionkov/go9p/p/clnt"
+	"github.com/nicolagi/muscle/config"
+	"github.com/pkg/errors"
+)
+
+// syncStatus parses the response of the "status" control command, lines
+// of names and values, e.g., "pending 3".
+func syncStatus(ctl *clnt.File) (map[string]string, error) {
+	response, err := control(ctl, []byte("status"))
+	if err != nil {
+		return nil, err
+	}
+	status := make(map[string]string)
+	s := bufio.NewScanner(bytes.NewReader(response))
+	for s.Scan() {
+		if fields := strings.SplitN(s.Text(), " ", 2); len(fields) == 2 {
+			status[fields[0]] = fields[1]
+		}
+	}
+	if _, ok := status["pending"]; !ok {
+		return nil, errors.Errorf("unexpected status response: %q", response)
+	}
+	return status, nil
+}
+
+func doSyncStatus(c *config.C) error {
+	ctl, closer, err := openControl(c)
+	if err != nil {
+		return err
+	}
+	defer closer()
+	response, err := control(ctl, []byte("status"))
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(response)
+	return errors.WithStack(err)
+}
+
+// doWaitSynced polls musclefs until no items are pending propagation to
+// the permanent store, or the timeout, if positive, expires.
+func doWaitSynced(c *config.C, timeout time.Duration) error {
+	const (
+		pollInterval   = time.Second
+		reportInterval = 10 * time.Second
+	)
+	ctl, closer, err := openControl(c)
+	if err != nil {
+		return err
+	}
+	defer closer()
+	start := time.Now()
+	var lastReport time.Time
+	for {
+		status, err := syncStatus(ctl)
+		if err != nil {
+			return err
+		}
+		pending, err := strconv.Atoi(status["pending"])
+		if err != nil {
+			return errors.Wrapf(err, "parsing pending count %q", status["pending"])
+		}
+		if pending == 0 {
+			if status["missing"] != "0" {
+				log.Printf("wait-synced: warning: %s items were missing from the cache", status["missing"])
+			}
+			fmt.Println("synced")
+			return nil
+		}
+		if timeout > 0 && time.Since(start) > timeout {
+			return errors.Errorf("%d items still pending after %v", pending, timeout)
+		}
+		if time.Since(lastReport) >= reportInterval {
+			log.Printf("wait-synced: %d items pending, oldest for %s, uploading at %s",
+				pending, status["oldest-pending"], status["throughput"])
+			lastReport = time.Now()
+		}
+		time.Sleep(pollInterval)
+	}
+}
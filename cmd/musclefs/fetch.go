@@ -0,0 +1,86 @@
+package main
+
+import (
+	"github.com/nicolagi/muscle/storage"
+	"github.com/nicolagi/muscle/tree"
+	"github.com/pkg/errors"
+	"golang.org/x/sync/errgroup"
+)
+
+// Maximum number of items fetched concurrently by a request.
+const fetchConcurrency = 32
+
+// fetch copies the items with the given keys from the remote store to the
+// disk cache, unless already there, with ops.mu released, so that other
+// requests aren't blocked meanwhile. If it released ops.mu, the tree may
+// have changed, e.g., the nodes not referenced may have been unloaded.
+// Call with ops.mu held.
+func (ops *ops) fetch(keys []storage.Key) error {
+	var missing []storage.Key
+	for _, k := range keys {
+		if !ops.paired.Cached(k) {
+			missing = append(missing, k)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	ops.mu.Unlock()
+	defer ops.mu.Lock()
+	semc := make(chan struct{}, fetchConcurrency)
+	var g errgroup.Group
+	for _, k := range missing {
+		k := k
+		g.Go(func() error {
+			semc <- struct{}{}
+			defer func() { <-semc }()
+			return errors.Wrapf(ops.paired.Prefetch(k), "fetching %v", k)
+		})
+	}
+	return g.Wait()
+}
+
+// walk is like ops.tree.Walk, but fetches the nodes to load beforehand, with
+// ops.mu released. The node walked from must be referenced, so that it stays
+// loaded. So are the nodes walked to, until the walk is over, so that the
+// walk goes on from the last one, rather than from the start, which other
+// requests shrinking the tree could make happen over and over, and so that
+// the nodes returned are still in the tree. If a node to walk from is
+// removed meanwhile, walk fails with Eunlinked. Call with ops.mu held.
+func (ops *ops) walk(node *tree.Node, names ...string) (nodes []*tree.Node, err error) {
+	var walked []*tree.Node
+	defer func() {
+		for _, n := range walked {
+			n.Unref("walk")
+		}
+	}()
+	n := node
+	for _, name := range names {
+		if err := ops.fetch(n.ChildKeys()); err != nil {
+			return nil, err
+		}
+		if n.Unlinked() {
+			return nil, Eunlinked
+		}
+		next, err := ops.tree.Walk(n, name)
+		for _, m := range next {
+			m.Ref("walk")
+		}
+		walked = append(walked, next...)
+		nodes = append(nodes, next...)
+		if err != nil {
+			return nodes, err
+		}
+		n = next[0]
+	}
+	return nodes, nil
+}
+
+// grow is like ops.tree.Grow, but fetches the nodes to load beforehand, with
+// ops.mu released. The node must be referenced. Call with ops.mu held.
+func (ops *ops) grow(node *tree.Node) error {
+	if err := ops.fetch(node.ChildKeys()); err != nil {
+		return err
+	}
+	return ops.tree.Grow(node)
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nicolagi/muscle/internal/block"
+	"github.com/nicolagi/muscle/storage"
+	"github.com/nicolagi/muscle/tree"
+	"golang.org/x/sync/errgroup"
+)
+
+// gatedStore makes gets wait while the gate is closed, and take the given
+// delay otherwise. It counts the gets in flight.
+type gatedStore struct {
+	storage.Store
+
+	mu       sync.Mutex
+	gate     chan struct{}
+	waiting  chan storage.Key
+	delay    time.Duration
+	inFlight int32
+}
+
+func (s *gatedStore) Get(k storage.Key) (storage.Value, error) {
+	atomic.AddInt32(&s.inFlight, 1)
+	defer atomic.AddInt32(&s.inFlight, -1)
+	s.mu.Lock()
+	gate, delay := s.gate, s.delay
+	s.mu.Unlock()
+	if gate != nil {
+		s.waiting <- k
+		<-gate
+	}
+	time.Sleep(delay)
+	return s.Store.Get(k)
+}
+
+func (s *gatedStore) close() {
+	s.mu.Lock()
+	s.gate = make(chan struct{})
+	s.waiting = make(chan storage.Key, 100)
+	s.mu.Unlock()
+}
+
+func (s *gatedStore) open() {
+	s.mu.Lock()
+	close(s.gate)
+	s.gate = nil
+	s.mu.Unlock()
+}
+
+func TestFetchReleasesLock(t *testing.T) {
+	key := make([]byte, 16)
+	rand.Read(key)
+	remote := &gatedStore{Store: &storage.InMemory{}}
+
+	// Fixture tree, in the remote store only.
+	bf, err := block.NewFactory(&storage.InMemory{}, remote.Store, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fixtureStore, err := tree.NewStore(bf, &storage.InMemory{}, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fixture, err := tree.NewTree(fixtureStore, tree.WithMutable(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, fixtureRoot := fixture.Root()
+	const dirs = 4
+	for i := 0; i < dirs; i++ {
+		dir, err := fixture.Add(fixtureRoot, fmt.Sprint(i), 0700|tree.DMDIR)
+		if err != nil {
+			t.Fatal(err)
+		}
+		file, err := fixture.Add(dir, "file", 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := file.WriteAt([]byte(fmt.Sprintf("content of %d", i)), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fixture.Seal(); err != nil {
+		t.Fatal(err)
+	}
+
+	cache, err := storage.NewCache(t.TempDir(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	paired, err := storage.NewPaired(cache, remote, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bf, err = block.NewFactory(&storage.InMemory{}, paired, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Unload all nodes not in use whenever shrinking.
+	treeStore, err := tree.NewStore(bf, &storage.InMemory{}, t.TempDir(), tree.WithMemoryBudget(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tt, err := tree.NewTree(treeStore, tree.WithRoot(fixtureRoot.Pointer()), tree.WithMutable(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ops := &ops{
+		treeStore: treeStore,
+		paired:    paired,
+		tree:      tt,
+	}
+	root := tt.Attach()
+	root.Ref("test")
+
+	// read walks to a file and reads it, as a client would.
+	read := func(dir string) (string, error) {
+		ops.mu.Lock()
+		defer ops.mu.Unlock()
+		nodes, err := ops.walk(root, dir, "file")
+		if err != nil {
+			return "", err
+		}
+		if len(nodes) != 2 {
+			return "", fmt.Errorf("walked %d nodes", len(nodes))
+		}
+		node := nodes[1]
+		node.Ref("test")
+		defer node.Unref("test")
+		p := make([]byte, 64)
+		if err := ops.fetch(node.ReadKeys(0, len(p))); err != nil {
+			return "", err
+		}
+		n, err := node.ReadAt(p, 0)
+		return string(p[:n]), err
+	}
+
+	t.Run("lock released while fetching", func(t *testing.T) {
+		remote.close()
+		type result struct {
+			content string
+			err     error
+		}
+		done := make(chan result)
+		go func() {
+			content, err := read("0")
+			done <- result{content, err}
+		}()
+		<-remote.waiting
+		locked := make(chan struct{})
+		go func() {
+			ops.mu.Lock()
+			close(locked)
+		}()
+		select {
+		case <-locked:
+		case <-time.After(time.Second):
+			t.Fatal("lock held while fetching")
+		}
+		// Meanwhile, the tree can change, e.g., be shrunk.
+		treeStore.Shrink()
+		ops.mu.Unlock()
+		remote.open()
+		if r := <-done; r.err != nil {
+			t.Fatal(r.err)
+		} else if r.content != "content of 0" {
+			t.Errorf("got %q", r.content)
+		}
+	})
+
+	t.Run("concurrent readers", func(t *testing.T) {
+		// Items are evicted from the disk cache as others are read, so
+		// that reads keep fetching them.
+		var keys []storage.Key
+		if err := remote.Store.(storage.Lister).List(context.Background(), "", func(item storage.ListItem) error {
+			keys = append(keys, item.Key)
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		remote.mu.Lock()
+		remote.delay = time.Millisecond
+		remote.mu.Unlock()
+		// Times the tree was shrunk while fetching.
+		var overlaps int32
+		var g errgroup.Group
+		for i := 0; i < 16; i++ {
+			i := i
+			g.Go(func() error {
+				for j := 0; j < 20; j++ {
+					dir := fmt.Sprint((i + j) % dirs)
+					got, err := read(dir)
+					if err != nil {
+						return err
+					}
+					if want := "content of " + dir; got != want {
+						return fmt.Errorf("got %q, want %q", got, want)
+					}
+					ops.mu.Lock()
+					if atomic.LoadInt32(&remote.inFlight) > 0 {
+						atomic.AddInt32(&overlaps, 1)
+					}
+					treeStore.Shrink()
+					err = cache.Delete(keys[(i*20+j)%len(keys)])
+					ops.mu.Unlock()
+					if err != nil && !errors.Is(err, storage.ErrNotFound) {
+						return err
+					}
+				}
+				return nil
+			})
+		}
+		if err := g.Wait(); err != nil {
+			t.Fatal(err)
+		}
+		if overlaps == 0 {
+			t.Error("never shrunk while fetching")
+		}
+	})
+
+	t.Run("unlinked while fetching", func(t *testing.T) {
+		// Only the children of the directory are left to fetch.
+		ops.mu.Lock()
+		treeStore.Shrink()
+		if err := ops.fetch(root.ChildKeys()); err != nil {
+			t.Fatal(err)
+		}
+		nodes, err := ops.tree.Walk(root, "1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, k := range nodes[0].ChildKeys() {
+			if err := cache.Delete(k); err != nil && !errors.Is(err, storage.ErrNotFound) {
+				t.Fatal(err)
+			}
+		}
+		ops.mu.Unlock()
+		remote.close()
+		done := make(chan error)
+		go func() {
+			_, err := read("1")
+			done <- err
+		}()
+		<-remote.waiting
+		ops.mu.Lock()
+		nodes, err = ops.tree.Walk(root, "1")
+		if err == nil {
+			err = ops.tree.RemoveForMerge(nodes[0])
+		}
+		ops.mu.Unlock()
+		remote.open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := <-done; !errors.Is(err, Eunlinked) {
+			t.Errorf("got %v, want %v", err, Eunlinked)
+		}
+	})
+}
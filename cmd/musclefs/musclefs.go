@@ -17,6 +17,7 @@ import (
 	"github.com/lionkov/go9p/p/srv"
 	"github.com/nicolagi/muscle/config"
 	"github.com/nicolagi/muscle/internal/block"
+	"github.com/nicolagi/muscle/internal/kdf"
 	"github.com/nicolagi/muscle/internal/p9util"
 	"github.com/nicolagi/muscle/netutil"
 	"github.com/nicolagi/muscle/storage"
@@ -74,6 +75,7 @@ type fsNode struct {
 
 	dirb p9util.DirBuffer
 	lock *nodeLock // Only meaningful for DMEXCL files.
+	ra   *readahead
 }
 
 func (node *fsNode) prepareForReads() {
@@ -87,8 +89,14 @@ func (node *fsNode) prepareForReads() {
 
 type ops struct {
 	treeStore *tree.Store
-
-	// Serializes access to the tree.
+	cache     *storage.Cache
+	paired    *storage.Paired
+	breaker   *storage.Breaker
+	pins      *pinner
+
+	// Serializes access to the tree. Requests release it while fetching
+	// from the remote store (see fetch), so that one waiting for the
+	// remote store doesn't block the others.
 	mu   sync.Mutex
 	tree *tree.Tree
 
@@ -115,6 +123,9 @@ func (ops *ops) FidDestroy(fid *srv.Fid) {
 		unlockNode(node.lock)
 		node.lock = nil
 	}
+	if node.ra != nil {
+		node.ra.stop()
+	}
 }
 
 func (ops *ops) Attach(r *srv.Req) {
@@ -146,7 +157,8 @@ func (ops *ops) Walk(r *srv.Req) {
 		}
 		if len(r.Tc.Wname) == 0 {
 			node.Ref("clone")
-			r.Newfid.Aux = node
+			// A new fsNode, for per-fid state such as read-ahead.
+			r.Newfid.Aux = &fsNode{Node: node.Node}
 			r.RespondRwalk(nil)
 			return
 		}
@@ -156,7 +168,11 @@ func (ops *ops) Walk(r *srv.Req) {
 			return
 		}
 		// TODO test scenario: nwqids != 0 but < nwname
-		nodes, err := ops.tree.Walk(node.Node, r.Tc.Wname...)
+		nodes, err := ops.walk(node.Node, r.Tc.Wname...)
+		if node.Unlinked() || errors.Is(err, Eunlinked) {
+			r.RespondError(Eunlinked)
+			return
+		}
 		if errors.Is(err, tree.ErrNotExist) {
 			if len(nodes) == 0 {
 				r.RespondError(srv.Enoent)
@@ -212,10 +228,14 @@ func (ops *ops) Open(r *srv.Req) {
 		}
 		switch {
 		case node.IsDir():
-			if err := ops.tree.Grow(node.Node); err != nil {
+			if err := ops.grow(node.Node); err != nil {
 				r.RespondError(err)
 				return
 			}
+			if node.Unlinked() {
+				r.RespondError(Eunlinked)
+				return
+			}
 			node.prepareForReads()
 		default:
 			if r.Tc.Mode&p.OTRUNC != 0 {
@@ -290,8 +310,18 @@ func (ops *ops) Read(r *srv.Req) {
 		var err error
 		if node.IsDir() {
 			count, err = node.dirb.Read(r.Rc.Data[:r.Tc.Count], int(r.Tc.Offset))
-		} else {
+		} else if err = ops.fetch(node.ReadKeys(int64(r.Tc.Offset), int(r.Tc.Count))); err == nil {
+			if node.Unlinked() {
+				r.RespondError(Eunlinked)
+				return
+			}
 			count, err = node.ReadAt(r.Rc.Data[:r.Tc.Count], int64(r.Tc.Offset))
+			if err == nil && ops.cfg.ReadAhead() > 0 {
+				if node.ra == nil {
+					node.ra = newReadahead(ops.paired.Prefetch, ops.cfg.ReadAhead())
+				}
+				node.ra.observe(node.Node, int64(r.Tc.Offset), count)
+			}
 		}
 		if err != nil {
 			log.WithFields(log.Fields{
@@ -328,6 +358,12 @@ func runCommand(ops *ops, cmd string) error {
 		ops.c.D.Length = uint64(len(ops.c.contents))
 	}()
 
+	switch cmd {
+	case "pull", "graft", "unlink", "push":
+		// These change the local tree, possibly under pinned paths.
+		defer ops.syncPins()
+	}
+
 	switch cmd {
 	case "diff":
 		return doDiff(outputBuffer, ops.tree, ops.treeStore, args)
@@ -335,6 +371,46 @@ func runCommand(ops *ops, cmd string) error {
 		if err := setLevel(args[0]); err != nil {
 			return err
 		}
+	case "cache":
+		_, _ = fmt.Fprintln(outputBuffer, ops.cache.Stats())
+		_, _ = fmt.Fprintln(outputBuffer, ops.treeStore.MemoryStats())
+	case "status":
+		_, _ = fmt.Fprint(outputBuffer, ops.paired.Stats())
+		_, _ = fmt.Fprint(outputBuffer, ops.breaker.Status())
+	case "pause":
+		ops.paired.Pause()
+		_, _ = fmt.Fprintln(outputBuffer, "propagation paused")
+	case "resume":
+		ops.paired.Resume()
+		_, _ = fmt.Fprintln(outputBuffer, "propagation resumed")
+	case "pin":
+		if len(args) != 1 {
+			return errors.New("usage: pin PATH")
+		}
+		pp := cleanPinPath(args[0])
+		_, root := ops.tree.Root()
+		elems := pinPathElements(pp)
+		if nodes, err := ops.tree.Walk(root, elems...); err != nil {
+			return output(errors.Wrapf(err, "could not walk the local tree along %v", elems))
+		} else if len(nodes) != len(elems) {
+			return output(errors.Errorf("walked %d path elements, required %d", len(nodes), len(elems)))
+		}
+		if err := ops.pins.add(pp); err != nil {
+			return output(err)
+		}
+		ops.syncPins()
+		_, _ = fmt.Fprintf(outputBuffer, "pinned /%s, syncing in the background\n", pp)
+	case "unpin":
+		if len(args) != 1 {
+			return errors.New("usage: unpin PATH")
+		}
+		pp := cleanPinPath(args[0])
+		if err := ops.pins.remove(pp); err != nil {
+			return output(err)
+		}
+		_, _ = fmt.Fprintf(outputBuffer, "unpinned /%s\n", pp)
+	case "pins":
+		ops.pins.report(outputBuffer)
 	case "lsof":
 		paths := ops.tree.ListNodesInUse()
 		sort.Strings(paths)
@@ -485,12 +561,22 @@ func runCommand(ops *ops, cmd string) error {
 		if err := ops.treeStore.StoreRevision(revision); err != nil {
 			return output(err)
 		}
-		ops.tree.SetRevision(revision)
 		_, _ = fmt.Fprintf(outputBuffer, "push: revision created: %s\n", revision.ShortString())
 
-		if err := ops.treeStore.SetRemoteBasePointer(revision.Key()); err != nil {
+		if err := ops.treeStore.UpdateRemoteBasePointer(remotebase, revision.Key()); errors.Is(err, storage.ErrConflict) {
+			return output(errors.Errorf("remote moved, pull again: %v", err))
+		} else if errors.Is(err, storage.ErrNotImplemented) {
+			// The remote store can't update the pointer conditionally; the
+			// check at the start is the best we can do.
+			_, _ = fmt.Fprintf(outputBuffer, "push: %v, updating remote base pointer unconditionally\n", err)
+			if err := ops.treeStore.SetRemoteBasePointer(revision.Key()); err != nil {
+				return output(err)
+			}
+		} else if err != nil {
 			return output(err)
 		}
+		// Only now is the revision the remote base, and the parent of the next.
+		ops.tree.SetRevision(revision)
 		_, _ = fmt.Fprintf(outputBuffer, "push: updated remote base pointer: %v\n", revision.Key())
 		if err := ops.treeStore.SetLocalBasePointer(revision.Key()); err != nil {
 			return output(err)
@@ -522,6 +608,15 @@ func (ops *ops) Write(r *srv.Req) {
 			r.RespondError(Eunlinked)
 			return
 		}
+		// Blocks written in part are loaded first.
+		if err := ops.fetch(node.ReadKeys(int64(r.Tc.Offset), len(r.Tc.Data))); err != nil {
+			r.RespondError(err)
+			return
+		}
+		if node.Unlinked() {
+			r.RespondError(Eunlinked)
+			return
+		}
 		if err := node.WriteAt(r.Tc.Data, int64(r.Tc.Offset)); err != nil {
 			r.RespondError(err)
 			return
@@ -702,9 +797,38 @@ func main() {
 		log.Fatalf("Could not create remote store: %v", err)
 	}
 
+	if m, ok := remoteBasicStore.(*storage.Mirror); ok && cfg.MirrorRepairPeriod() > 0 {
+		go m.RepairPeriodically(cfg.MirrorRepairPeriod())
+	}
+	// Fail fast rather than freeze while the remote store is unreachable.
+	remoteStore := storage.NewBreaker(remoteBasicStore, storage.WithBreakerTimeout(cfg.RemoteTimeout()))
+
 	stagingStore := storage.NewDiskStore(cfg.StagingDirectoryPath())
-	cacheStore := storage.NewDiskStore(cfg.CacheDirectoryPath())
-	pairedStore, err := storage.NewPaired(cacheStore, remoteBasicStore, cfg.PropagationLogFilePath())
+	cacheStore, err := storage.NewCache(cfg.CacheDirectoryPath(), cfg.CacheMaxBytes)
+	if err != nil {
+		log.Fatalf("Could not open cache: %v", err)
+	}
+	key, err := kdf.EncryptionKey(cfg, remoteStore)
+	if err != nil {
+		log.Fatalf("Could not get encryption key: %v", err)
+	}
+	codec, err := block.NewFactory(nil, nil, key, block.WithCompression(cfg.Compression), block.WithOldKeys(cfg.OldEncryptionKeysBytes()...), block.WithLegacyFormats(!cfg.RejectLegacyBlocks))
+	if err != nil {
+		log.Fatalf("Could not build block factory: %v", err)
+	}
+	remoteBlockStore, err := storage.NewPackedStore(cfg, remoteStore, codec)
+	if err != nil {
+		log.Fatalf("Could not load pack indexes: %v", err)
+	}
+	workers := cfg.PropagationWorkers
+	if workers == 0 && cfg.PackSize > 0 {
+		workers = 256
+	}
+	pairedOpts := []storage.PairedOption{storage.WithPropagationWorkers(workers), storage.WithOfflineWait(remoteStore.WaitOnline)}
+	if len(cfg.UploadWindows) > 0 {
+		pairedOpts = append(pairedOpts, storage.WithPropagationSchedule(cfg.UploadAllowed))
+	}
+	pairedStore, err := storage.NewPaired(cacheStore, storage.NewLimitedStore(cfg, remoteBlockStore), cfg.PropagationLogFilePath(), pairedOpts...)
 	if err != nil {
 		log.Fatalf("Could not start new paired store with log %q: %v", cfg.PropagationLogFilePath(), err)
 	}
@@ -719,11 +843,11 @@ func main() {
 	// propagation immediately.
 	pairedStore.EnsureBackgroundPuts()
 
-	blockFactory, err := block.NewFactory(stagingStore, pairedStore, cfg.EncryptionKeyBytes())
+	blockFactory, err := block.NewFactory(stagingStore, pairedStore, key, block.WithCompression(cfg.Compression), block.WithOldKeys(cfg.OldEncryptionKeysBytes()...), block.WithLegacyFormats(!cfg.RejectLegacyBlocks), block.WithRefScheme(remoteStore, cfg.BlockRefs))
 	if err != nil {
 		log.Fatalf("Could not build block factory: %v", err)
 	}
-	treeStore, err := tree.NewStore(blockFactory, remoteBasicStore, *base)
+	treeStore, err := tree.NewStore(blockFactory, remoteStore, *base, tree.WithMemoryBudget(cfg.MemoryCacheBytes))
 	if err != nil {
 		log.Fatalf("Could not load tree: %v", err)
 	}
@@ -731,17 +855,25 @@ func main() {
 	if err != nil {
 		log.Fatalf("Could not load tree: %v", err)
 	}
-	tt, err := tree.NewTree(treeStore, tree.WithRoot(rootKey), tree.WithMutable(cfg.BlockSize))
+	tt, err := tree.NewTree(treeStore, tree.WithRoot(rootKey), tree.WithMutable(cfg.BlockSize), tree.WithChunking(cfg.Chunking))
 	if err != nil {
 		log.Fatalf("Could not load tree: %v", err)
 	}
 
 	ops := &ops{
 		treeStore: treeStore,
+		cache:     cacheStore,
+		paired:    pairedStore,
+		breaker:   remoteStore,
 		tree:      tt,
 		c:         new(ctl),
 		cfg:       cfg,
 	}
+	ops.pins, err = newPinner(cfg.PinsFilePath(), treeStore)
+	if err != nil {
+		log.Fatalf("Could not load pins from %q: %v", cfg.PinsFilePath(), err)
+	}
+	cacheStore.Protect(ops.pins.isPinned)
 
 	_, root := tt.Root()
 	now := time.Now()
@@ -786,6 +918,18 @@ func main() {
 		}
 	}()
 
+	go ops.syncPinsPeriodically()
+
+	// Unload nodes not in use, between requests, if they take too much memory.
+	go func() {
+		for {
+			time.Sleep(10 * time.Second)
+			ops.mu.Lock()
+			ops.treeStore.Shrink()
+			ops.mu.Unlock()
+		}
+	}()
+
 	// Now just wait for a signal to do the clean-up.
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, syscall.SIGTERM, syscall.SIGINT)
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -19,6 +20,7 @@ import (
 	"github.com/nicolagi/muscle/tree"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/sync/errgroup"
 )
 
 /* TODO To read to get test cases from:
@@ -284,11 +286,160 @@ func Test(t *testing.T) {
 	})
 }
 
+// Many clients write, read back, and list files concurrently, and flush
+// the tree meanwhile. The server runs with the race detector (see
+// startServer), which also checks request handling for data races.
+func TestConcurrentClients(t *testing.T) {
+	testAddress, _, tearDown := startServer(t)
+	defer tearDown(t)
+	const (
+		clients = 16
+		files   = 8
+		rounds  = 10
+	)
+	var g errgroup.Group
+	for i := 0; i < clients; i++ {
+		dir := fmt.Sprintf("client%d", i)
+		g.Go(func() error {
+			client, err := mount(testAddress)
+			if err != nil {
+				return err
+			}
+			defer client.Unmount()
+			return stress(client, dir, files, rounds)
+		})
+	}
+	if err := g.Wait(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// stress creates files in a directory of its own, then rewrites them and
+// reads them back the given number of rounds.
+func stress(c *clnt.Clnt, dir string, files, rounds int) error {
+	walk := func(names ...string) (*clnt.Fid, error) {
+		fid := c.FidAlloc()
+		if qids, err := c.Walk(c.Root, fid, names); err != nil {
+			return nil, err
+		} else if len(qids) != len(names) {
+			return nil, fmt.Errorf("walking %v: got %d qids", names, len(qids))
+		}
+		return fid, nil
+	}
+	// readAll reads a file or a directory, opened for reading.
+	readAll := func(fid *clnt.Fid) ([]byte, error) {
+		var all []byte
+		for {
+			b, err := c.Read(fid, uint64(len(all)), 8192)
+			if err != nil || len(b) == 0 {
+				return all, err
+			}
+			all = append(all, b...)
+		}
+	}
+	contents := func(i, round int) []byte {
+		return []byte(fmt.Sprintf("%s/%d, round %d\n", dir, i, round))
+	}
+	fid, err := walk()
+	if err != nil {
+		return err
+	}
+	if err := c.Create(fid, dir, 0700|p.DMDIR, p.OREAD, ""); err != nil {
+		return err
+	}
+	if err := c.Clunk(fid); err != nil {
+		return err
+	}
+	for round := 0; round < rounds; round++ {
+		for i := 0; i < files; i++ {
+			name := fmt.Sprint(i)
+			if round == 0 {
+				if fid, err = walk(dir); err == nil {
+					err = c.Create(fid, name, 0600, p.OWRITE, "")
+				}
+			} else if fid, err = walk(dir, name); err == nil {
+				err = c.Open(fid, p.OWRITE|p.OTRUNC)
+			}
+			if err != nil {
+				return fmt.Errorf("%s/%s: %v", dir, name, err)
+			}
+			if _, err := c.Write(fid, contents(i, round), 0); err != nil {
+				return fmt.Errorf("%s/%s: %v", dir, name, err)
+			}
+			if err := c.Clunk(fid); err != nil {
+				return err
+			}
+		}
+		for i := 0; i < files; i++ {
+			name := fmt.Sprint(i)
+			if fid, err = walk(dir, name); err == nil {
+				err = c.Open(fid, p.OREAD)
+			}
+			if err != nil {
+				return fmt.Errorf("%s/%s: %v", dir, name, err)
+			}
+			got, err := readAll(fid)
+			if err != nil {
+				return fmt.Errorf("%s/%s: %v", dir, name, err)
+			}
+			if want := contents(i, round); !bytes.Equal(got, want) {
+				return fmt.Errorf("%s/%s: got %q, want %q", dir, name, got, want)
+			}
+			if err := c.Clunk(fid); err != nil {
+				return err
+			}
+		}
+		for _, names := range [][]string{nil, {dir}} {
+			if fid, err = walk(names...); err == nil {
+				err = c.Open(fid, p.OREAD)
+			}
+			if err == nil {
+				_, err = readAll(fid)
+			}
+			if err != nil {
+				return fmt.Errorf("listing %v: %v", names, err)
+			}
+			if err := c.Clunk(fid); err != nil {
+				return err
+			}
+		}
+		if fid, err = walk("ctl"); err == nil {
+			if err = c.Open(fid, p.OWRITE); err == nil {
+				_, err = c.Write(fid, []byte("flush"), 0)
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("flushing: %v", err)
+		}
+		if err := c.Clunk(fid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // The returned client is associated with an ephemeral musclefs process.
 // The tree factory is configured to write to the same storage as the musclefs process,
 // therefore it can be used to build fixture data that the musclefs process can use, e.g.,
 // for the graft command.
 func setUp(t *testing.T) (client *clnt.Clnt, store *tree.Store, tearDown func(*testing.T)) {
+	testAddress, store, tearDown := startServer(t)
+	client, err := mount(testAddress)
+	require.Nil(t, err)
+
+	// Create tmp dir, expected by newer tests.
+	r := require.New(t)
+	newfid := client.FidAlloc()
+	_, err = client.Walk(client.Root, newfid, []string{})
+	r.NoError(err)
+	r.NoError(client.Create(newfid, "tmp", 0777|p.DMDIR, p.OREAD, ""))
+	r.NoError(client.Clunk(newfid))
+	return client, store, tearDown
+}
+
+// startServer starts an ephemeral musclefs process, returning its address,
+// for tests that mount it themselves; see setUp.
+func startServer(t *testing.T) (testAddress string, store *tree.Store, tearDown func(*testing.T)) {
 	// dir will store what is usually in $HOME/lib/musclefs.
 	dir, err := ioutil.TempDir("", "musclefs")
 	if err != nil {
@@ -308,7 +459,7 @@ func setUp(t *testing.T) (client *clnt.Clnt, store *tree.Store, tearDown func(*t
 	// by the ephemeral musclefs.
 	sharedKey := c.EncryptionKeyBytes()
 	// TODO: Assumes TCP.
-	testAddress := c.ListenAddr
+	testAddress = c.ListenAddr
 
 	// Start process asynchronously, creating a process group id, so we can later
 	// kill this process and all its children.
@@ -325,18 +476,6 @@ func setUp(t *testing.T) (client *clnt.Clnt, store *tree.Store, tearDown func(*t
 		t.Fatalf("Initialization timed out: %v", err)
 	}
 
-	user := p.OsUsers.Uid2User(os.Geteuid())
-	client, err = clnt.Mount("tcp", testAddress, user.Name(), 8192, user)
-	require.Nil(t, err)
-
-	// Create tmp dir, expected by newer tests.
-	r := require.New(t)
-	newfid := client.FidAlloc()
-	_, err = client.Walk(client.Root, newfid, []string{})
-	r.NoError(err)
-	r.NoError(client.Create(newfid, "tmp", 0777|p.DMDIR, p.OREAD, ""))
-	r.NoError(client.Clunk(newfid))
-
 	// dir is the based dir for musclefs.
 	// Let's get another nested temporary directory for the donor.
 	nestedBase := path.Join(dir, "donor")
@@ -357,7 +496,7 @@ func setUp(t *testing.T) (client *clnt.Clnt, store *tree.Store, tearDown func(*t
 
 	// TODO: Should do the cleean up only if the test is successful, leave other wise
 	// process and temporary files around for debugging.
-	return client, store, func(t *testing.T) {
+	return testAddress, store, func(t *testing.T) {
 		// Can't use command.Process.Kill() because that would kill go run, not its child.
 		//ng        9368  9353  0 18:52 ?        00:00:00 go run -race . -base ./config.test
 		//ng        9477  9368  0 18:52 ?        00:00:00 /tmp/go-build420765022/b001/exe/musclefs -base ./config.test
@@ -373,6 +512,11 @@ func setUp(t *testing.T) (client *clnt.Clnt, store *tree.Store, tearDown func(*t
 	}
 }
 
+func mount(addr string) (*clnt.Clnt, error) {
+	user := p.OsUsers.Uid2User(os.Geteuid())
+	return clnt.Mount("tcp", addr, user.Name(), 8192, user)
+}
+
 type mustHelpers struct {
 	t *testing.T
 	c *clnt.Clnt
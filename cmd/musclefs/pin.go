@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nicolagi/muscle/storage"
+	"github.com/nicolagi/muscle/tree"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// How often pinned subtrees are synced, besides after commands that change
+// the local tree, to retry those that failed.
+const pinSyncInterval = time.Hour
+
+// pinner keeps the nodes and blocks of pinned subtrees of the local tree in
+// the disk cache, so that they are available while the remote store isn't,
+// and protects them from eviction. Pinned paths persist in a file, one per
+// line, relative to the root.
+type pinner struct {
+	file  string
+	store *tree.Store
+
+	mu   sync.Mutex
+	pins map[string]*pin
+}
+
+type pin struct {
+	// Subtree last synced, or being synced.
+	root    storage.Pointer
+	syncing bool
+	// Subtree to sync next, if it changed while syncing.
+	next storage.Pointer
+	// Keys of the items of the subtree last synced, and of those loaded
+	// so far by the sync in progress. Both are protected from eviction.
+	keys    map[storage.Key]bool
+	loading map[storage.Key]bool
+	stats   tree.PrefetchStats
+	synced  time.Time
+	err     error
+}
+
+func newPinner(file string, store *tree.Store) (*pinner, error) {
+	p := &pinner{
+		file:  file,
+		store: store,
+		pins:  make(map[string]*pin),
+	}
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return p, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := scanner.Text(); line != "" {
+			p.pins[cleanPinPath(line)] = &pin{}
+		}
+	}
+	return p, scanner.Err()
+}
+
+// cleanPinPath turns a path into the form used for pins, relative to the
+// root, with the empty string meaning the root.
+func cleanPinPath(p string) string {
+	return strings.TrimPrefix(path.Clean("/"+p), "/")
+}
+
+// pinPathElements splits a pin path for tree.Tree.Walk.
+func pinPathElements(p string) []string {
+	if p == "" {
+		return nil
+	}
+	return strings.Split(p, "/")
+}
+
+// save writes the pinned paths to the file. Call with p.mu held.
+func (p *pinner) save() error {
+	var b strings.Builder
+	for _, pp := range p.sortedPaths() {
+		b.WriteString(pp)
+		b.WriteByte('\n')
+	}
+	if err := ioutil.WriteFile(p.file+".tmp", []byte(b.String()), 0600); err != nil {
+		return err
+	}
+	return os.Rename(p.file+".tmp", p.file)
+}
+
+// sortedPaths returns the pinned paths. Call with p.mu held.
+func (p *pinner) sortedPaths() []string {
+	paths := make([]string, 0, len(p.pins))
+	for pp := range p.pins {
+		paths = append(paths, pp)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func (p *pinner) paths() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.sortedPaths()
+}
+
+func (p *pinner) add(pp string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.pins[pp]; ok {
+		return nil
+	}
+	p.pins[pp] = &pin{}
+	if err := p.save(); err != nil {
+		delete(p.pins, pp)
+		return errors.Wrapf(err, "could not save pins to %q", p.file)
+	}
+	return nil
+}
+
+// remove unpins a path; its items become evictable right away.
+func (p *pinner) remove(pp string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	old, ok := p.pins[pp]
+	if !ok {
+		return errors.Errorf("%q is not pinned", "/"+pp)
+	}
+	delete(p.pins, pp)
+	if err := p.save(); err != nil {
+		p.pins[pp] = old
+		return errors.Wrapf(err, "could not save pins to %q", p.file)
+	}
+	return nil
+}
+
+// isPinned tells whether an item must stay in the cache (see
+// storage.Cache.Protect).
+func (p *pinner) isPinned(k storage.Key) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, pin := range p.pins {
+		if pin.keys[k] || pin.loading[k] {
+			return true
+		}
+	}
+	return false
+}
+
+// sync starts loading, in the background, the subtrees of pinned paths
+// that changed since they were last synced or that failed to sync. The
+// roots map pinned paths to the current pointers of their subtrees;
+// pinned paths missing from it are reported as such.
+func (p *pinner) sync(roots map[string]storage.Pointer) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for pp, pin := range p.pins {
+		root, ok := roots[pp]
+		switch {
+		case !ok:
+			if !pin.syncing {
+				pin.err = errors.Errorf("%q: %v", "/"+pp, tree.ErrNotExist)
+			}
+		case pin.syncing:
+			if !root.Equals(pin.root) {
+				pin.next = root
+			}
+		case root.Equals(pin.root) && pin.err == nil:
+		default:
+			pin.root = root
+			pin.syncing = true
+			pin.loading = make(map[storage.Key]bool)
+			go p.run(pp, pin)
+		}
+	}
+}
+
+// run syncs a pin until its subtree stops changing.
+func (p *pinner) run(pp string, pin *pin) {
+	p.mu.Lock()
+	root := pin.root
+	p.mu.Unlock()
+	for {
+		stats, err := p.store.Prefetch(root, func(k storage.Key, stats tree.PrefetchStats) {
+			p.mu.Lock()
+			pin.loading[k] = true
+			pin.stats = stats
+			p.mu.Unlock()
+		})
+		if err != nil {
+			log.WithFields(log.Fields{
+				"path":   "/" + pp,
+				"errors": stats.Errors,
+				"cause":  err,
+			}).Warning("Could not sync pinned subtree")
+		}
+		p.mu.Lock()
+		if err != nil {
+			// Don't give up protecting items just because they
+			// couldn't be loaded this time.
+			for k := range pin.keys {
+				pin.loading[k] = true
+			}
+		}
+		pin.keys, pin.loading = pin.loading, nil
+		pin.stats, pin.err, pin.synced = stats, err, time.Now()
+		if pin.next.IsNull() {
+			pin.syncing = false
+			p.mu.Unlock()
+			return
+		}
+		root, pin.root, pin.next = pin.next, pin.next, storage.Null
+		pin.loading = make(map[storage.Key]bool)
+		p.mu.Unlock()
+	}
+}
+
+// report writes a line per pinned path on the progress of its sync.
+func (p *pinner) report(w io.Writer) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, pp := range p.sortedPaths() {
+		pin := p.pins[pp]
+		state := "not synced"
+		switch {
+		case pin.syncing:
+			state = "syncing"
+		case !pin.synced.IsZero():
+			state = fmt.Sprintf("synced %v ago", time.Since(pin.synced).Round(time.Second))
+		}
+		_, _ = fmt.Fprintf(w, "/%s %s, %d nodes, %d blocks, %d bytes", pp, state, pin.stats.Nodes, pin.stats.Blocks, pin.stats.Bytes)
+		if pin.err != nil {
+			_, _ = fmt.Fprintf(w, ", %d errors: %v", pin.stats.Errors, pin.err)
+		}
+		_, _ = fmt.Fprintln(w)
+	}
+}
+
+// syncPins flushes the local tree, so that all nodes have current
+// pointers, and syncs the pinned subtrees. Call with ops.mu held.
+func (ops *ops) syncPins() {
+	if err := ops.tree.Flush(); err != nil {
+		log.WithField("cause", err).Warning("Could not flush to sync pinned subtrees")
+		return
+	}
+	_, root := ops.tree.Root()
+	roots := make(map[string]storage.Pointer)
+	for _, pp := range ops.pins.paths() {
+		elems := pinPathElements(pp)
+		nodes, err := ops.walk(root, elems...)
+		if err != nil || len(nodes) != len(elems) {
+			continue
+		}
+		node := root
+		if len(nodes) > 0 {
+			node = nodes[len(nodes)-1]
+		}
+		roots[pp] = node.Pointer()
+	}
+	ops.pins.sync(roots)
+}
+
+// syncPinsPeriodically syncs pinned subtrees forever.
+func (ops *ops) syncPinsPeriodically() {
+	for {
+		ops.mu.Lock()
+		ops.syncPins()
+		ops.mu.Unlock()
+		time.Sleep(pinSyncInterval)
+	}
+}
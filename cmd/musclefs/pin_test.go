@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nicolagi/muscle/internal/block"
+	"github.com/nicolagi/muscle/storage"
+	"github.com/nicolagi/muscle/tree"
+)
+
+func TestPinner(t *testing.T) {
+	key := make([]byte, 16)
+	rand.Read(key)
+	bf, err := block.NewFactory(&storage.InMemory{}, &storage.InMemory{}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	treeStore, err := tree.NewStore(bf, &storage.InMemory{}, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tt, err := tree.NewTree(treeStore, tree.WithMutable(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, root := tt.Root()
+	dir, err := tt.Add(root, "a", 0700|tree.DMDIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := tt.Add(dir, "file", 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := file.WriteAt([]byte("hello, world"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := tt.Seal(); err != nil {
+		t.Fatal(err)
+	}
+	pinsFile := path.Join(t.TempDir(), "pins")
+	p, err := newPinner(pinsFile, treeStore)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("persisted", func(t *testing.T) {
+		if err := p.add(cleanPinPath("/a/")); err != nil {
+			t.Fatal(err)
+		}
+		if err := p.add(cleanPinPath("b")); err != nil {
+			t.Fatal(err)
+		}
+		if err := p.remove("b"); err != nil {
+			t.Fatal(err)
+		}
+		if err := p.remove("b"); err == nil {
+			t.Error("got nil, want an error unpinning twice")
+		}
+		other, err := newPinner(pinsFile, treeStore)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := other.paths(); len(got) != 1 || got[0] != "a" {
+			t.Errorf("got %q, want [a]", got)
+		}
+	})
+
+	t.Run("synced and protected", func(t *testing.T) {
+		p.sync(map[string]storage.Pointer{"a": dir.Pointer()})
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			p.mu.Lock()
+			syncing := p.pins["a"].syncing
+			p.mu.Unlock()
+			if !syncing {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("still syncing")
+			}
+			time.Sleep(time.Millisecond)
+		}
+		var report bytes.Buffer
+		p.report(&report)
+		if got := report.String(); !strings.HasPrefix(got, "/a synced") || !strings.Contains(got, "2 nodes, 3 blocks, 12 bytes") {
+			t.Errorf("got report %q", got)
+		}
+		pinned := dir.Pointer().Key()
+		if !p.isPinned(pinned) || p.isPinned(root.Pointer().Key()) {
+			t.Error("got wrong protection before unpinning")
+		}
+		if err := p.remove("a"); err != nil {
+			t.Fatal(err)
+		}
+		if p.isPinned(pinned) {
+			t.Error("got protection after unpinning")
+		}
+	})
+
+	t.Run("missing path", func(t *testing.T) {
+		if err := p.add("gone"); err != nil {
+			t.Fatal(err)
+		}
+		p.sync(nil)
+		var report bytes.Buffer
+		p.report(&report)
+		if got := report.String(); !strings.Contains(got, "/gone not synced") || !strings.Contains(got, "does not exist") {
+			t.Errorf("got report %q", got)
+		}
+	})
+}
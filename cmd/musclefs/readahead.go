@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+
+	"github.com/nicolagi/muscle/storage"
+	"github.com/nicolagi/muscle/tree"
+	log "github.com/sirupsen/logrus"
+)
+
+// How many consecutive reads, each starting where the previous one ended,
+// make a fid be read sequentially.
+const sequentialReads = 2
+
+// readahead detects when a fid is read sequentially, and then prefetches
+// the blocks following those read, concurrently, so that later reads find
+// them in the disk cache rather than waiting for each to be downloaded in
+// turn. Its methods other than the workers' are called with ops.mu held.
+type readahead struct {
+	fetch func(storage.Key) error
+	// Number of blocks to prefetch past the one being read, and of
+	// concurrent fetches.
+	blocks int
+
+	// Where the next read would start if sequential, and how many
+	// sequential reads there have been.
+	next   int64
+	streak int
+
+	// Blocks already queued, so that they're fetched once.
+	queued map[storage.Key]bool
+	keys   chan storage.Key
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func newReadahead(fetch func(storage.Key) error, blocks int) *readahead {
+	return &readahead{
+		fetch:  fetch,
+		blocks: blocks,
+		queued: make(map[storage.Key]bool),
+	}
+}
+
+// observe records a read of n bytes at the given offset of the node,
+// prefetching the following blocks if reads are sequential.
+func (ra *readahead) observe(node *tree.Node, off int64, n int) {
+	if off == ra.next {
+		ra.streak++
+	} else {
+		ra.streak = 1
+	}
+	ra.next = off + int64(n)
+	if n == 0 || ra.streak < sequentialReads {
+		return
+	}
+	if ra.keys == nil {
+		ra.start()
+	}
+	for _, k := range node.BlockKeys(ra.next, ra.blocks+1) {
+		if ra.queued[k] {
+			continue
+		}
+		select {
+		case ra.keys <- k:
+			ra.queued[k] = true
+		default:
+			// Workers are behind, try again with the next read.
+			return
+		}
+	}
+}
+
+func (ra *readahead) start() {
+	ra.keys = make(chan storage.Key, ra.blocks+1)
+	ra.ctx, ra.cancel = context.WithCancel(context.Background())
+	for i := 0; i < ra.blocks; i++ {
+		go ra.work()
+	}
+}
+
+func (ra *readahead) work() {
+	for {
+		select {
+		case <-ra.ctx.Done():
+			return
+		case k := <-ra.keys:
+			if ra.ctx.Err() != nil {
+				return
+			}
+			if err := ra.fetch(k); err != nil {
+				log.WithFields(log.Fields{
+					"key":   k,
+					"cause": err,
+				}).Debug("Could not prefetch block")
+			}
+		}
+	}
+}
+
+// stop cancels the prefetches not yet started, e.g., when the fid is
+// clunked.
+func (ra *readahead) stop() {
+	if ra.cancel != nil {
+		ra.cancel()
+	}
+}
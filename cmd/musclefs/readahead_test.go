@@ -0,0 +1,100 @@
+package main
+
+import (
+	"math/rand"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/nicolagi/muscle/internal/block"
+	"github.com/nicolagi/muscle/storage"
+	"github.com/nicolagi/muscle/tree"
+)
+
+func TestReadahead(t *testing.T) {
+	key := make([]byte, 16)
+	rand.Read(key)
+	bf, err := block.NewFactory(&storage.InMemory{}, &storage.InMemory{}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	treeStore, err := tree.NewStore(bf, &storage.InMemory{}, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tt, err := tree.NewTree(treeStore, tree.WithMutable(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, root := tt.Root()
+	file, err := tt.Add(root, "file", 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := make([]byte, 40)
+	rand.Read(content)
+	if err := file.WriteAt(content, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := tt.Seal(); err != nil {
+		t.Fatal(err)
+	}
+	fetched := make(chan storage.Key, 10)
+	ra := newReadahead(func(k storage.Key) error {
+		fetched <- k
+		return nil
+	}, 2)
+	defer ra.stop()
+	expect := func(t *testing.T, want []storage.Key) {
+		t.Helper()
+		var got []storage.Key
+		timeout := time.After(time.Second)
+		for len(got) < len(want) {
+			select {
+			case k := <-fetched:
+				got = append(got, k)
+			case <-timeout:
+				t.Fatalf("got %d prefetches, want %d", len(got), len(want))
+			}
+		}
+		select {
+		case k := <-fetched:
+			t.Fatalf("got unexpected prefetch of %q", k)
+		case <-time.After(10 * time.Millisecond):
+		}
+		sort.Slice(got, func(i, j int) bool { return got[i] < got[j] })
+		sort.Slice(want, func(i, j int) bool { return want[i] < want[j] })
+		for i := range want {
+			if got[i] != want[i] {
+				t.Fatalf("got %q, want %q", got, want)
+			}
+		}
+	}
+
+	t.Run("first read", func(t *testing.T) {
+		ra.observe(file, 0, 4)
+		expect(t, nil)
+	})
+	t.Run("sequential read", func(t *testing.T) {
+		ra.observe(file, 4, 4)
+		expect(t, file.BlockKeys(8, 3))
+	})
+	t.Run("blocks fetched once", func(t *testing.T) {
+		ra.observe(file, 8, 4)
+		expect(t, file.BlockKeys(20, 1))
+	})
+	t.Run("random read", func(t *testing.T) {
+		ra.observe(file, 32, 4)
+		expect(t, nil)
+	})
+	t.Run("stopped", func(t *testing.T) {
+		ra.stop()
+		ra.observe(file, 36, 4)
+		ra.observe(file, 0, 4)
+		ra.observe(file, 4, 4)
+		time.Sleep(10 * time.Millisecond)
+		if len(fetched) != 0 {
+			t.Errorf("got %d prefetches after stopping", len(fetched))
+		}
+	})
+}
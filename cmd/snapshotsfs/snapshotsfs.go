@@ -10,6 +10,7 @@ import (
 	"github.com/lionkov/go9p/p/srv"
 	"github.com/nicolagi/muscle/config"
 	"github.com/nicolagi/muscle/internal/block"
+	"github.com/nicolagi/muscle/internal/kdf"
 	"github.com/nicolagi/muscle/internal/p9util"
 	"github.com/nicolagi/muscle/netutil"
 	"github.com/nicolagi/muscle/storage"
@@ -335,22 +336,36 @@ func main() {
 	}
 	log.SetLevel(ll)
 
-	remoteStore, err := storage.NewStore(cfg)
+	remoteBasicStore, err := storage.NewStore(cfg)
 	if err != nil {
 		log.Fatalf("Could not create remote store: %v", err)
 	}
+	// Fail fast rather than freeze while the remote store is unreachable.
+	remoteStore := storage.NewBreaker(remoteBasicStore, storage.WithBreakerTimeout(cfg.RemoteTimeout()))
 
 	stagingStore := storage.NullStore{}
 	cacheStore := storage.NewDiskStore(cfg.CacheDirectoryPath())
-	pairedStore, err := storage.NewPaired(cacheStore, remoteStore, "")
+	key, err := kdf.EncryptionKey(cfg, remoteStore)
+	if err != nil {
+		log.Fatalf("Could not get encryption key: %v", err)
+	}
+	codec, err := block.NewFactory(nil, nil, key, block.WithOldKeys(cfg.OldEncryptionKeysBytes()...), block.WithLegacyFormats(!cfg.RejectLegacyBlocks))
+	if err != nil {
+		log.Fatalf("Could not build block factory: %v", err)
+	}
+	remoteBlockStore, err := storage.NewPackedStore(cfg, remoteStore, codec)
+	if err != nil {
+		log.Fatalf("Could not load pack indexes: %v", err)
+	}
+	pairedStore, err := storage.NewPaired(cacheStore, storage.NewLimitedStore(cfg, remoteBlockStore), "")
 	if err != nil {
 		log.Fatalf("Could not start new paired store: %v", err)
 	}
-	blockFactory, err := block.NewFactory(stagingStore, pairedStore, cfg.EncryptionKeyBytes())
+	blockFactory, err := block.NewFactory(stagingStore, pairedStore, key, block.WithOldKeys(cfg.OldEncryptionKeysBytes()...), block.WithLegacyFormats(!cfg.RejectLegacyBlocks), block.WithRefScheme(remoteStore, ""))
 	if err != nil {
 		log.Fatalf("Could not build block factory: %v", err)
 	}
-	treestore, err := tree.NewStore(blockFactory, remoteStore, *base)
+	treestore, err := tree.NewStore(blockFactory, remoteStore, *base, tree.WithMemoryBudget(cfg.MemoryCacheBytes))
 	if err != nil {
 		log.Fatalf("Could not load tree: %v", err)
 	}
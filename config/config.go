@@ -9,6 +9,7 @@ import (
 	"io/ioutil"
 	mathrand "math/rand"
 	"os"
+	"os/exec"
 	"path"
 	"path/filepath"
 	"regexp"
@@ -44,6 +45,13 @@ type C struct {
 	// variable at the time the nodes were created).
 	BlockSize uint32 `json:"block-size,omitempty"`
 
+	// Chunking is how the content of new files is split into blocks:
+	// "fixed" (the default) for blocks of exactly BlockSize bytes, or
+	// "fastcdc" for content-defined blocks of at most BlockSize bytes,
+	// which deduplicate better when bytes are inserted or removed in
+	// large files. Like the block size, it is recorded in each node.
+	Chunking string `json:"chunking,omitempty"`
+
 	// Listen on localhost or a local-only network, e.g., one for
 	// containers hosted on your computer.  There is no
 	// authentication nor TLS so the file server must not be exposed on a
@@ -60,18 +68,137 @@ type C struct {
 	// data.
 	EncryptionKey string `json:"encryption-key,omitempty"`
 
+	// Instead of being stored in this file, the encryption key can be
+	// read from the standard output of a command, run with "sh -c", e.g.,
+	// one querying a password manager or an agent, or from a file
+	// descriptor, 3 or greater, inherited from the parent process.
+	EncryptionKeyCommand string `json:"encryption-key-command,omitempty"`
+	EncryptionKeyFD      int    `json:"encryption-key-fd,omitempty"`
+
+	// KeyDerivation is empty if the command or file descriptor above
+	// produce the 64 hex digits of the key, or "scrypt" if they produce a
+	// passphrase, from which the key is derived with a salt stored in the
+	// repository (see the kdf package).
+	KeyDerivation string `json:"key-derivation,omitempty"`
+
+	// Keys that were in use before the last key rotations (see "muscle
+	// rekey"), most recent first. They are only used to decrypt blocks
+	// that haven't been re-encrypted, e.g., in other hosts' caches.
+	OldEncryptionKeys []string `json:"old-encryption-keys,omitempty"`
+
+	// BlockRefs is how blocks are named in the repository: "sha256" (the
+	// default) for hashes of their values, or "hmac-sha256" for keyed
+	// hashes, which don't reveal whether the repository contains a known
+	// value. The scheme is recorded in the repository the first time
+	// "hmac-sha256" is requested, after which all hosts follow it.
+	BlockRefs string `json:"block-refs,omitempty"`
+
+	// Compression applied to blocks before encryption, "none" (the
+	// default) or "deflate". Blocks that don't shrink are stored
+	// uncompressed. Changing this only affects blocks stored afterwards.
+	Compression string `json:"compression,omitempty"`
+
+	// RejectLegacyBlocks makes blocks stored without authentication,
+	// before authenticated encryption was introduced, unreadable. Set it
+	// once "muscle rekey" has stored all blocks again, so that tampering
+	// with the format of a block can't pass for a legacy block.
+	RejectLegacyBlocks bool `json:"reject-legacy-blocks,omitempty"`
+
 	// Path to cache. Defaults to $HOME/lib/muscle/cache.
 	CacheDirectory string `json:"cache-directory,omitempty"`
 
-	// Permanent storage type - can be "s3" or "null" at present.
+	// CacheMaxBytes bounds the size of the cache, if positive. Once
+	// exceeded, musclefs evicts the least recently used items, except
+	// those that are yet to be copied to the permanent storage.
+	CacheMaxBytes int64 `json:"cache-max-bytes,omitempty"`
+
+	// MemoryCacheBytes bounds the memory taken by the nodes and the
+	// decrypted file blocks that musclefs and snapshotsfs keep loaded,
+	// 256 MiB if zero. The least recently used are dropped first, except
+	// for changes not yet written to the staging area and nodes in use.
+	MemoryCacheBytes int64 `json:"memory-cache-bytes,omitempty"`
+
+	// ReadAheadBlocks is how many blocks musclefs prefetches, and how
+	// many concurrently, past those of a file being read sequentially;
+	// 8 if zero, none if negative.
+	ReadAheadBlocks int `json:"read-ahead-blocks,omitempty"`
+
+	// PropagationWorkers is how many items musclefs copies concurrently
+	// from the cache to the permanent storage; 64 if zero, or 256 if
+	// packing (see PackSize), so that packs fill up.
+	PropagationWorkers int `json:"propagation-workers,omitempty"`
+
+	// PackSize, if positive, is the target size of the pack objects
+	// into which small items are aggregated in the permanent storage,
+	// e.g., 8388608, to save on requests and per-object overhead (see
+	// storage.Packed). Packing needs storage that supports listing.
+	// Items already stored remain readable if this is changed.
+	PackSize int64 `json:"pack-size,omitempty"`
+
+	// UploadBytesPerSecond and DownloadBytesPerSecond, if positive,
+	// limit how fast musclefs copies items to and from the permanent
+	// storage, e.g., on a slow or metered connection.
+	UploadBytesPerSecond   int64 `json:"upload-bytes-per-second,omitempty"`
+	DownloadBytesPerSecond int64 `json:"download-bytes-per-second,omitempty"`
+
+	// UploadWindows, if any, are the times of day, in local time, during
+	// which musclefs copies file data to the permanent storage, each
+	// given as "HH:MM-HH:MM", e.g., "22:00-07:00" for nights. Nodes and
+	// revisions are copied at any time, so that pushes aren't delayed.
+	UploadWindows []string `json:"upload-windows,omitempty"`
+
+	// How long a read from the permanent storage can take, e.g., "2m",
+	// before musclefs deems the storage unreachable, and fails fast until
+	// it responds again. The default, 30s, may be too short on a slow
+	// connection with large blocks.
+	RemoteReadTimeout string `json:"remote-read-timeout,omitempty"`
+
+	// Permanent storage type - can be "s3", "disk", "mirror", "erasure" or "null" at present.
 	Storage string `json:"storage,omitempty"`
 
+	// These only make sense if the storage type is "mirror". Items are
+	// replicated to each of the mirrors, configured like the permanent
+	// storage, e.g., {"storage": "s3", "s3-bucket": ...} or {"storage":
+	// "disk", "disk-store-dir": ...}. Writes must succeed on at least
+	// MirrorWriteQuorum mirrors (all of them if zero). Every
+	// MirrorRepairInterval (default one hour, "0s" to disable) musclefs
+	// copies items missing from some mirrors from the others.
+	Mirrors              []*C   `json:"mirrors,omitempty"`
+	MirrorWriteQuorum    int    `json:"mirror-write-quorum,omitempty"`
+	MirrorRepairInterval string `json:"mirror-repair-interval,omitempty"`
+
+	// These only make sense if the storage type is "erasure". Each item
+	// is split into ErasureDataShards data shards, plus as many parity
+	// shards as the remaining stores, each written to one of the
+	// ErasureShards stores, configured like the mirrors above. Any
+	// ErasureDataShards shards suffice to read the item. Lost shards are
+	// re-created by "muscle scrub".
+	ErasureShards     []*C `json:"erasure-shards,omitempty"`
+	ErasureDataShards int  `json:"erasure-data-shards,omitempty"`
+
 	// These only make sense if the storage type is "s3".  The AWS
 	// profile is used for credentials.
 	S3Profile string `json:"s3-profile,omitempty"`
 	S3Region  string `json:"s3-region,omitempty"`
 	S3Bucket  string `json:"s3-bucket,omitempty"`
 
+	// For S3-compatible services, e.g., MinIO, Ceph or Garage: the
+	// endpoint URL, e.g., https://minio.example.com:9000, and whether
+	// the bucket is addressed in the path rather than the host name.
+	// Static credentials, if set, take precedence over the profile.
+	S3Endpoint        string `json:"s3-endpoint,omitempty"`
+	S3PathStyle       bool   `json:"s3-path-style,omitempty"`
+	S3AccessKeyID     string `json:"s3-access-key-id,omitempty"`
+	S3SecretAccessKey string `json:"s3-secret-access-key,omitempty"`
+
+	// TLS options for the S3 endpoint: a PEM file with the certificate
+	// authorities to trust, e.g., for a self-signed certificate, instead
+	// of the system ones (or the ones in the AWS_CA_BUNDLE environment
+	// variable, which the CA file overrides), or (dangerously) no
+	// verification at all.
+	S3CAFile             string `json:"s3-ca-file,omitempty"`
+	S3InsecureSkipVerify bool   `json:"s3-insecure-skip-verify,omitempty"`
+
 	// These only make sense if the storage type is "disk".
 	// If the path is relative, it will be assumed relative to the base dir.
 	DiskStoreDir string `json:"disk-store-dir,omitempty"`
@@ -80,8 +207,127 @@ type C struct {
 	// Other directories and files are derived from this.
 	base string
 
-	// Computed from the corresponding string at load time.
-	encryptionKey []byte
+	// Computed from the corresponding strings at load time.
+	encryptionKey     []byte
+	oldEncryptionKeys [][]byte
+
+	// Read at load time, if KeyDerivation is set.
+	passphrase []byte
+
+	// Parsed from MirrorRepairInterval at load time.
+	mirrorRepairInterval time.Duration
+
+	// Parsed from RemoteReadTimeout at load time.
+	remoteReadTimeout time.Duration
+
+	// Parsed from UploadWindows at load time.
+	uploadWindows []timeWindow
+}
+
+// A timeWindow is a time of day range, as offsets since midnight; it wraps
+// around midnight if the end precedes the start, and spans the whole day
+// if they're equal.
+type timeWindow struct {
+	start, end time.Duration
+}
+
+func (w timeWindow) contains(t time.Time) bool {
+	h, m, s := t.Clock()
+	d := time.Duration(h)*time.Hour + time.Duration(m)*time.Minute + time.Duration(s)*time.Second
+	if w.start <= w.end {
+		return w.start == w.end || w.start <= d && d < w.end
+	}
+	return d >= w.start || d < w.end
+}
+
+// ScryptKeyDerivation is the only supported value for C.KeyDerivation.
+const ScryptKeyDerivation = "scrypt"
+
+func (c *C) resolveDiskStoreDirs(base string) {
+	if c.DiskStoreDir != "" && !filepath.IsAbs(c.DiskStoreDir) {
+		c.DiskStoreDir = filepath.Clean(filepath.Join(base, c.DiskStoreDir))
+	}
+	for _, m := range c.Mirrors {
+		m.resolveDiskStoreDirs(base)
+	}
+	for _, e := range c.ErasureShards {
+		e.resolveDiskStoreDirs(base)
+	}
+}
+
+func (c *C) parseMirrorRepairInterval() (err error) {
+	c.mirrorRepairInterval = time.Hour
+	if c.MirrorRepairInterval != "" {
+		c.mirrorRepairInterval, err = time.ParseDuration(c.MirrorRepairInterval)
+		if err != nil {
+			return fmt.Errorf("mirror repair interval: %w", err)
+		}
+	}
+	return nil
+}
+
+func (c *C) parseRemoteReadTimeout() (err error) {
+	if c.RemoteReadTimeout != "" {
+		c.remoteReadTimeout, err = time.ParseDuration(c.RemoteReadTimeout)
+		if err != nil {
+			return fmt.Errorf("remote read timeout: %w", err)
+		}
+	}
+	return nil
+}
+
+func (c *C) parseUploadWindows() error {
+	for _, spec := range c.UploadWindows {
+		var h1, m1, h2, m2 int
+		n, _ := fmt.Sscanf(spec, "%d:%d-%d:%d", &h1, &m1, &h2, &m2)
+		w := timeWindow{
+			start: time.Duration(h1)*time.Hour + time.Duration(m1)*time.Minute,
+			end:   time.Duration(h2)*time.Hour + time.Duration(m2)*time.Minute,
+		}
+		if n != 4 || m1 < 0 || m1 > 59 || m2 < 0 || m2 > 59 || w.start < 0 || w.start > 24*time.Hour || w.end < 0 || w.end > 24*time.Hour {
+			return fmt.Errorf("upload window %q: want HH:MM-HH:MM", spec)
+		}
+		c.uploadWindows = append(c.uploadWindows, w)
+	}
+	return nil
+}
+
+// UploadAllowed tells whether file data can be copied to the permanent
+// storage at the given time (see UploadWindows).
+func (c *C) UploadAllowed(t time.Time) bool {
+	if len(c.uploadWindows) == 0 {
+		return true
+	}
+	for _, w := range c.uploadWindows {
+		if w.contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// MirrorRepairPeriod returns how often mirrors should be repaired, or zero
+// if they shouldn't.
+func (c *C) MirrorRepairPeriod() time.Duration {
+	return c.mirrorRepairInterval
+}
+
+// RemoteTimeout returns how long a read from the permanent storage can
+// take, or zero for the default (see RemoteReadTimeout).
+func (c *C) RemoteTimeout() time.Duration {
+	return c.remoteReadTimeout
+}
+
+// ReadAhead returns how many blocks to prefetch past those of a file
+// being read sequentially (see ReadAheadBlocks).
+func (c *C) ReadAhead() int {
+	switch {
+	case c.ReadAheadBlocks == 0:
+		return 8
+	case c.ReadAheadBlocks < 0:
+		return 0
+	}
+	return c.ReadAheadBlocks
 }
 
 // Load loads the configuration from the file called "config" in the provided base
@@ -106,12 +352,28 @@ func Load(base string) (*C, error) {
 	if err == nil {
 		c.base = base
 	}
-	c.encryptionKey, err = hex.DecodeString(c.EncryptionKey)
-	if err != nil {
-		err = fmt.Errorf("%q: %w", c.EncryptionKey, err)
+	if err == nil {
+		err = c.loadEncryptionKey()
 	}
-	if c.DiskStoreDir != "" && !filepath.IsAbs(c.DiskStoreDir) {
-		c.DiskStoreDir = filepath.Clean(filepath.Join(c.base, c.DiskStoreDir))
+	for _, s := range c.OldEncryptionKeys {
+		if err != nil {
+			break
+		}
+		var key []byte
+		if key, err = hex.DecodeString(s); err != nil {
+			err = fmt.Errorf("%q: %w", s, err)
+		}
+		c.oldEncryptionKeys = append(c.oldEncryptionKeys, key)
+	}
+	c.resolveDiskStoreDirs(base)
+	if err == nil {
+		err = c.parseMirrorRepairInterval()
+	}
+	if err == nil {
+		err = c.parseRemoteReadTimeout()
+	}
+	if err == nil {
+		err = c.parseUploadWindows()
 	}
 	if c.BlockSize == 0 {
 		c.BlockSize = defaultBlockSize
@@ -131,6 +393,63 @@ func Load(base string) (*C, error) {
 	return c, err
 }
 
+func (c *C) loadEncryptionKey() error {
+	external := c.EncryptionKeyCommand != "" || c.EncryptionKeyFD != 0
+	switch {
+	case c.EncryptionKey != "" && external:
+		return errors.New("encryption-key excludes encryption-key-command and encryption-key-fd")
+	case c.EncryptionKeyCommand != "" && c.EncryptionKeyFD != 0:
+		return errors.New("encryption-key-command and encryption-key-fd exclude each other")
+	case c.EncryptionKeyFD < 0 || c.EncryptionKeyFD > 0 && c.EncryptionKeyFD < 3:
+		return fmt.Errorf("encryption-key-fd is %d, want 3 or greater", c.EncryptionKeyFD)
+	case c.KeyDerivation != "" && c.KeyDerivation != ScryptKeyDerivation:
+		return fmt.Errorf("key-derivation is %q, want %q or nothing", c.KeyDerivation, ScryptKeyDerivation)
+	case c.KeyDerivation != "" && !external:
+		return errors.New("key-derivation requires encryption-key-command or encryption-key-fd")
+	}
+	secret := []byte(c.EncryptionKey)
+	if external {
+		var err error
+		if secret, err = c.readSecret(); err != nil {
+			return err
+		}
+		secret = []byte(strings.TrimRight(string(secret), "\r\n"))
+	}
+	if c.KeyDerivation != "" {
+		c.passphrase = secret
+		return nil
+	}
+	var err error
+	if c.encryptionKey, err = hex.DecodeString(strings.TrimSpace(string(secret))); err != nil {
+		if external {
+			return fmt.Errorf("encryption key: %w", err)
+		}
+		return fmt.Errorf("%q: %w", c.EncryptionKey, err)
+	}
+	return nil
+}
+
+func (c *C) readSecret() ([]byte, error) {
+	if c.EncryptionKeyCommand != "" {
+		cmd := exec.Command("sh", "-c", c.EncryptionKeyCommand)
+		cmd.Stderr = os.Stderr
+		b, err := cmd.Output()
+		if err != nil {
+			return nil, fmt.Errorf("%q: %w", c.EncryptionKeyCommand, err)
+		}
+		return b, nil
+	}
+	f := os.NewFile(uintptr(c.EncryptionKeyFD), "encryption-key-fd")
+	defer func() {
+		_ = f.Close()
+	}()
+	b, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, fmt.Errorf("reading from file descriptor %d: %w", c.EncryptionKeyFD, err)
+	}
+	return b, nil
+}
+
 func load(r io.Reader) (c *C, err error) {
 	err = json.NewDecoder(r).Decode(&c)
 	return
@@ -151,14 +470,69 @@ func (c *C) PropagationLogFilePath() string {
 	return path.Join(c.base, "propagation.log")
 }
 
+// PinsFilePath is where musclefs lists the paths whose content must stay
+// in the local cache, one per line.
+func (c *C) PinsFilePath() string {
+	return path.Join(c.base, "pins")
+}
+
 func (c *C) StagingDirectoryPath() string {
 	return path.Join(c.base, "staging")
 }
 
+// EncryptionKeyBytes returns the encryption key, unless it is to be derived
+// from a passphrase, in which case it returns nil. Use kdf.EncryptionKey to
+// cover both cases.
 func (c *C) EncryptionKeyBytes() []byte {
 	return c.encryptionKey
 }
 
+// Passphrase returns the passphrase to derive the encryption key from, if
+// KeyDerivation is set.
+func (c *C) Passphrase() []byte {
+	return c.passphrase
+}
+
+// OldEncryptionKeysBytes returns the keys previously used for encryption,
+// most recent first.
+func (c *C) OldEncryptionKeysBytes() [][]byte {
+	return c.oldEncryptionKeys
+}
+
+// RotateEncryptionKey replaces the encryption key in the configuration file
+// in the given base directory, and prepends the replaced key to the old
+// encryption keys. Other settings are preserved as they are in the file.
+// It fails if the configuration gets the key from elsewhere.
+func RotateEncryptionKey(base string, key []byte) error {
+	filename := path.Join(base, "config")
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	c, err := load(f)
+	_ = f.Close()
+	if err != nil {
+		return fmt.Errorf("%q: %w", filename, err)
+	}
+	if c.KeyDerivation != "" || c.EncryptionKeyCommand != "" || c.EncryptionKeyFD != 0 {
+		return fmt.Errorf("%q: the encryption key is not stored in the file", filename)
+	}
+	if newKey := hex.EncodeToString(key); newKey != c.EncryptionKey {
+		if c.EncryptionKey != "" {
+			c.OldEncryptionKeys = append([]string{c.EncryptionKey}, c.OldEncryptionKeys...)
+		}
+		c.EncryptionKey = newKey
+	}
+	b, err := json.MarshalIndent(c, "", "	")
+	if err != nil {
+		return fmt.Errorf("could not marshal configuration: %w", err)
+	}
+	if err := ioutil.WriteFile(filename+".new", b, 0600); err != nil {
+		return fmt.Errorf("could not write configuration to %q: %w", filename+".new", err)
+	}
+	return os.Rename(filename+".new", filename)
+}
+
 // See https://www.kernel.org/doc/Documentation/filesystems/9p.txt.
 func linuxMountCommand(net string, addr string, mountpoint string) (string, error) {
 	uid, gid := os.Getuid(), os.Getgid()
@@ -40,9 +40,17 @@ type Block struct {
 	ref   Ref
 	value []byte
 
-	cipher     blockCipher
+	// Size of the value as stored, after compression and encryption;
+	// only known in clean state.
+	storedSize int
+
+	codec      *valueCodec
+	refKey     []byte
 	index      storage.Store
 	repository storage.Store
+
+	// Whether to seal with PutPriority, if the repository supports it.
+	priority bool
 }
 
 // TODO: panic if block is dirty.
@@ -50,6 +58,12 @@ func (block *Block) Ref() Ref {
 	return block.ref
 }
 
+// Primed tells whether the value has to be loaded from storage before the
+// block can be read.
+func (block *Block) Primed() bool {
+	return block.state == primed
+}
+
 func (block *Block) Size() (n int, err error) {
 	if err := block.ensureReadable(); err != nil {
 		return 0, fmt.Errorf("block.Block.Size: %w", err)
@@ -67,6 +81,23 @@ func (block *Block) Read(p []byte, off int) (n int, err error) {
 	return copy(p, block.value[off:]), nil
 }
 
+// StoredSize returns the size of the block value as stored, that is, after
+// compression and encryption. For a block that hasn't been stored yet, it
+// is the size the value would take if stored now.
+func (block *Block) StoredSize() (n int, err error) {
+	if err := block.ensureReadable(); err != nil {
+		return 0, fmt.Errorf("block.Block.StoredSize: %w", err)
+	}
+	if block.state == clean {
+		return block.storedSize, nil
+	}
+	ciphertext, err := block.codec.encode(block.value)
+	if err != nil {
+		return 0, fmt.Errorf("block.Block.StoredSize: %w", err)
+	}
+	return len(ciphertext), nil
+}
+
 // ReadAll returns a copy of the content of the block.
 func (block *Block) ReadAll() ([]byte, error) {
 	if err := block.ensureReadable(); err != nil {
@@ -86,8 +117,12 @@ func (block *Block) Truncate(size int) error {
 	if err := block.ensureWritable(); err != nil {
 		return fmt.Errorf("block.Block.Truncate: %w", err)
 	}
-	if size <= len(block.value) {
+	if size == len(block.value) {
+		return nil
+	}
+	if size < len(block.value) {
 		block.value = block.value[:size]
+		block.state = dirty
 		return nil
 	}
 	block.value = append(block.value, make([]byte, size-len(block.value))...)
@@ -136,7 +171,7 @@ func (block *Block) Flush() (flushed bool, err error) {
 // Pre-condition: the block is dirty and backed by the index.
 // Post-condition: the block is clean and backed by the index, or an error is returned.
 func (block *Block) flush() error {
-	ciphertext, err := block.cipher.encrypt(block.value)
+	ciphertext, err := block.codec.encode(block.value)
 	if err != nil {
 		return fmt.Errorf("block.Block.flush: %w", err)
 	}
@@ -144,10 +179,18 @@ func (block *Block) flush() error {
 	if err != nil {
 		return fmt.Errorf("block.Block.flush: %w", err)
 	}
+	block.storedSize = len(ciphertext)
 	block.state = clean
 	return nil
 }
 
+// Prioritize requests that, when sealed, the block be written to the
+// repository ahead of other blocks, if the repository is a
+// storage.PriorityPutter, e.g., because the block holds metadata.
+func (block *Block) Prioritize() {
+	block.priority = true
+}
+
 // Seal ensures a read-only version of the block is written to the repository.
 func (block *Block) Seal() (sealed bool, err error) {
 	if block.location == repository && (block.state == primed || block.state == clean) {
@@ -165,25 +208,30 @@ func (block *Block) Seal() (sealed bool, err error) {
 // Pre-condition: block state is clean or dirty, backed by index.
 // Post-condition: block state is clean, backed by repository.
 func (block *Block) seal() error {
-	ref := RefOf(block.value)
-	ciphertext, err := block.cipher.encrypt(block.value)
+	ref := refOf(block.refKey, block.value)
+	ciphertext, err := block.codec.encode(block.value)
 	if err != nil {
 		return fmt.Errorf("block.Block.seal: %w", err)
 	}
-	if err := block.repository.Put(ref.Key(), ciphertext); err != nil {
+	put := block.repository.Put
+	if pp, ok := block.repository.(storage.PriorityPutter); ok && block.priority {
+		put = pp.PutPriority
+	}
+	if err := put(ref.Key(), ciphertext); err != nil {
 		return fmt.Errorf("block.Block.seal: %w", err)
 	}
 	if err := block.index.Delete(block.ref.Key()); err != nil && !errors.Is(err, storage.ErrNotFound) {
 		log.Printf("block.Block.seal: left garbage behind: %v", err)
 	}
 	block.ref = ref
+	block.storedSize = len(ciphertext)
 	block.state = clean
 	block.location = repository
 	return nil
 }
 
 // Forget nils out the block's value byte slice if possible, so memory can be reclaimed.
-// Unused at the moment, tree.Node.Trim nils out the whole slice of blocks.
+// Note that tree.Node.Trim nils out the whole slice of blocks instead.
 func (block *Block) Forget() (forgotten bool) {
 	if block.state != clean {
 		return false
@@ -218,6 +266,9 @@ func (block *Block) Discard() {
 // the root key file, which is not the same as the mounted file system root
 // unless it has just been flushed. Always flush before merge.)
 func (block *Block) SameValue(other *Block) (same bool, err error) {
+	if block.location == repository && other.location == repository && block.ref == other.ref {
+		return true, nil
+	}
 	var hash1, hash2 RepositoryRef
 	hash1, err = block.valueHash()
 	if err != nil {
@@ -230,12 +281,18 @@ func (block *Block) SameValue(other *Block) (same bool, err error) {
 	return hash1 == hash2, nil
 }
 
+// valueHash returns the plain hash of the value. That's the ref of a block in
+// a repository with plain refs. With keyed refs, the value has to be loaded,
+// as the ref of a block stored before switching to keyed refs is plain, and
+// a keyed ref and a plain one to the same value must compare as equal.
 func (block *Block) valueHash() (ref RepositoryRef, err error) {
 	if block.location == repository {
 		if block.state == dirty {
 			panic("block.Block.valueHash: dirty block backed by repository")
 		}
-		return block.ref.(RepositoryRef), nil
+		if block.refKey == nil {
+			return block.ref.(RepositoryRef), nil
+		}
 	}
 	if err := block.ensureReadable(); err != nil {
 		return ref, fmt.Errorf("block.Block.valueHash: %w", err)
@@ -253,26 +310,68 @@ func (block *Block) ensureReadable() error {
 // Pre-condition: block is primed.
 // Post-condition: block is clean.
 func (block *Block) load() (err error) {
-	var ciphertext []byte
+	var store storage.Store
 	switch block.location {
 	case index:
-		ciphertext, err = block.index.Get(block.ref.Key())
+		store = block.index
 	case repository:
-		ciphertext, err = block.repository.Get(block.ref.Key())
+		store = block.repository
 	default:
 		panic("block.Block.load: unknown location")
 	}
+	ciphertext, err := store.Get(block.ref.Key())
 	if err != nil {
 		return err
 	}
-	if l, min := len(ciphertext), block.cipher.BlockSize(); l < min {
-		return errors.Errorf("%v is %d bytes long; it's expected to be at least %d bytes long", block.ref.Key(), l, min)
+	value, err := block.decode(ciphertext)
+	if r, ok := store.(storage.Refetcher); ok && err != nil && block.location == repository {
+		// The copy might have been corrupted in the local cache, e.g.,
+		// partially written before a power loss. Drop it and try the
+		// original, which is only cached once known to be good.
+		log.Printf("block.Block.load: %v; fetching again", err)
+		first := err
+		if ciphertext, err = r.Refetch(block.ref.Key()); err != nil {
+			// The cached copy is known to be bad, whether or not the
+			// original can be fetched: report it as such.
+			return fmt.Errorf("block.Block.load: %w; fetching again: %v", first, err)
+		}
+		if value, err = block.decode(ciphertext); err != nil {
+			return err
+		}
+		if err := r.Recache(block.ref.Key(), ciphertext); err != nil {
+			log.Printf("block.Block.load: could not cache %v again: %v", block.ref.Key(), err)
+		}
 	}
-	block.value = block.cipher.decrypt(ciphertext)
+	if err != nil {
+		return err
+	}
+	block.value = value
+	block.storedSize = len(ciphertext)
 	block.state = clean
 	return nil
 }
 
+// decode decrypts and decompresses stored data. For blocks in the
+// repository, it also verifies the hash of the value matches the ref. Both
+// plain and keyed refs are accepted, as a repository switched to keyed refs
+// still contains blocks with plain refs.
+func (block *Block) decode(ciphertext []byte) ([]byte, error) {
+	var check func([]byte) error
+	if ref, ok := block.ref.(RepositoryRef); ok {
+		check = func(value []byte) error {
+			if got := RefOf(value); got != ref && (block.refKey == nil || refOf(block.refKey, value) != ref) {
+				return fmt.Errorf("value hash is %v: %w", got, ErrIntegrity)
+			}
+			return nil
+		}
+	}
+	value, err := block.codec.decode(ciphertext, check)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%v", block.ref.Key())
+	}
+	return value, nil
+}
+
 func (block *Block) ensureWritable() error {
 	if err := block.ensureReadable(); err != nil {
 		return fmt.Errorf("block.Block.ensureWritable: %w", err)
@@ -2,6 +2,7 @@ package block
 
 import (
 	"bytes"
+	"errors"
 	"math/rand"
 	"strings"
 	"testing"
@@ -190,4 +191,151 @@ func TestCorruptedBlockHandling(t *testing.T) {
 			t.Errorf("got %v, want %v", got, want)
 		}
 	})
+	t.Run("tampered block", func(t *testing.T) {
+		block, err := factory.New(nil, 8192)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := block.Write([]byte("some content"), 0); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := block.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		stored, err := index.Get(block.Ref().Key())
+		if err != nil {
+			t.Fatal(err)
+		}
+		stored[len(stored)-1] ^= 0x80
+		if err := index.Put(block.Ref().Key(), stored); err != nil {
+			t.Fatal(err)
+		}
+		block, err = factory.New(block.Ref(), 8192)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 1)
+		if _, err := block.Read(buf, 0); !errors.Is(err, ErrAuthentication) {
+			t.Errorf("got %v, want %v", err, ErrAuthentication)
+		}
+	})
+}
+
+func TestRepositoryBlockVerification(t *testing.T) {
+	key := make([]byte, 16)
+	rand.Read(key)
+	cipher, err := newBlockCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	codec := &valueCodec{cipher: cipher}
+	encode := func(value string) storage.Value {
+		stored, err := codec.encode([]byte(value))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return stored
+	}
+	setup := func(t *testing.T, cached, original storage.Value) (*Block, *storage.InMemory) {
+		t.Helper()
+		fast, slow := &storage.InMemory{}, &storage.InMemory{}
+		ref := RefOf([]byte("the value"))
+		if cached != nil {
+			_ = fast.Put(ref.Key(), cached)
+		}
+		if original != nil {
+			_ = slow.Put(ref.Key(), original)
+		}
+		paired, err := storage.NewPaired(fast, slow, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		factory, err := NewFactory(nil, paired, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := factory.New(ref, 8192)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b, fast
+	}
+	t.Run("corrupted cached copy is replaced", func(t *testing.T) {
+		good := encode("the value")
+		b, fast := setup(t, good[:len(good)/2], good)
+		value, err := b.ReadAll()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := string(value), "the value"; got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+		if cached, _ := fast.Get(b.Ref().Key()); !bytes.Equal(cached, good) {
+			t.Error("cached copy was not replaced")
+		}
+	})
+	t.Run("mismatching cached copy is replaced", func(t *testing.T) {
+		b, _ := setup(t, encode("another value"), encode("the value"))
+		if _, err := b.ReadAll(); err != nil {
+			t.Fatal(err)
+		}
+	})
+	t.Run("both copies are bad", func(t *testing.T) {
+		b, fast := setup(t, encode("another value"), encode("yet another value"))
+		if _, err := b.ReadAll(); !errors.Is(err, ErrIntegrity) {
+			t.Errorf("got %v, want %v", err, ErrIntegrity)
+		}
+		if _, err := fast.Get(b.Ref().Key()); !errors.Is(err, storage.ErrNotFound) {
+			t.Errorf("bad original cached: got %v, want %v", err, storage.ErrNotFound)
+		}
+	})
+	t.Run("original is missing", func(t *testing.T) {
+		b, fast := setup(t, encode("another value"), nil)
+		if _, err := b.ReadAll(); !errors.Is(err, ErrIntegrity) {
+			t.Errorf("got %v, want %v", err, ErrIntegrity)
+		}
+		if _, err := fast.Get(b.Ref().Key()); !errors.Is(err, storage.ErrNotFound) {
+			t.Errorf("bad cached copy kept: got %v, want %v", err, storage.ErrNotFound)
+		}
+	})
+}
+
+type priorityRecorder struct {
+	storage.InMemory
+	priority []storage.Key
+}
+
+func (r *priorityRecorder) PutPriority(k storage.Key, v storage.Value) error {
+	r.priority = append(r.priority, k)
+	return r.Put(k, v)
+}
+
+func TestBlockPriority(t *testing.T) {
+	repository := &priorityRecorder{}
+	factory, err := NewFactory(&storage.InMemory{}, repository, make([]byte, 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	seal := func(t *testing.T, value string, priority bool) Ref {
+		t.Helper()
+		b, err := factory.New(nil, 8192)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if priority {
+			b.Prioritize()
+		}
+		if _, _, err := b.Write([]byte(value), 0); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := b.Seal(); err != nil {
+			t.Fatal(err)
+		}
+		return b.Ref()
+	}
+	seal(t, "data", false)
+	ref := seal(t, "metadata", true)
+	if len(repository.priority) != 1 || repository.priority[0] != ref.Key() {
+		t.Errorf("got %v, want only %v", repository.priority, ref.Key())
+	}
 }
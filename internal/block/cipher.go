@@ -9,11 +9,18 @@ import (
 
 type blockCipher struct {
 	cipher.Block
+
+	// Authenticated encryption (AES-GCM) with the same key.
+	aead cipher.AEAD
 }
 
 func newBlockCipher(key []byte) (blockCipher, error) {
 	block, err := aes.NewCipher(key)
-	return blockCipher{block}, err
+	if err != nil {
+		return blockCipher{}, err
+	}
+	aead, err := cipher.NewGCM(block)
+	return blockCipher{Block: block, aead: aead}, err
 }
 
 func (c *blockCipher) encrypt(cleartext []byte) (ciphertext []byte, err error) {
@@ -38,3 +45,30 @@ func (c *blockCipher) xor(in, iv []byte) (out []byte) {
 	ctr.XORKeyStream(out, in)
 	return
 }
+
+// seal appends a random nonce and the authenticated encryption of the
+// cleartext and additional data to dst.
+func (c *blockCipher) seal(dst, cleartext, additional []byte) ([]byte, error) {
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("could not read random bytes for nonce: %v", err)
+	}
+	dst = append(dst, nonce...)
+	return c.aead.Seal(dst, nonce, cleartext, additional), nil
+}
+
+// open is the inverse of seal. It returns ErrAuthentication if the
+// ciphertext or the additional data were tampered with.
+func (c *blockCipher) open(ciphertext, additional []byte) (cleartext []byte, err error) {
+	if len(ciphertext) < c.aead.NonceSize()+c.aead.Overhead() {
+		return nil, fmt.Errorf("%d bytes long; expected to be at least %d bytes long: %w",
+			len(ciphertext), c.aead.NonceSize()+c.aead.Overhead(), ErrAuthentication)
+	}
+	nonce := ciphertext[:c.aead.NonceSize()]
+	ciphertext = ciphertext[c.aead.NonceSize():]
+	cleartext, err = c.aead.Open(nil, nonce, ciphertext, additional)
+	if err != nil {
+		return nil, ErrAuthentication
+	}
+	return cleartext, nil
+}
@@ -7,29 +7,89 @@ import (
 )
 
 type Factory struct {
-	cipher     blockCipher
+	key        []byte
+	codec      *valueCodec
 	index      storage.Store
 	repository storage.Store
+
+	// Key for computing repository refs, nil for plain refs (see
+	// WithRefScheme).
+	refKey []byte
+}
+
+// FactoryOption values influence the behavior of NewFactory.
+type FactoryOption func(*Factory) error
+
+// WithCompression specifies how block values should be compressed before
+// being encrypted and stored, by compression name (see ParseCompression).
+// Values that don't shrink are stored uncompressed. Blocks are readable
+// regardless of this option.
+func WithCompression(name string) FactoryOption {
+	return func(f *Factory) error {
+		c, err := ParseCompression(name)
+		if err != nil {
+			return err
+		}
+		f.codec.compression = c
+		return nil
+	}
+}
+
+// WithOldKeys specifies keys that were used in the past (see "muscle rekey"),
+// and should be tried in order to decrypt blocks that the current key
+// doesn't decrypt. Blocks are always encrypted with the current key.
+func WithOldKeys(keys ...[]byte) FactoryOption {
+	return func(f *Factory) error {
+		for _, key := range keys {
+			cipher, err := newBlockCipher(key)
+			if err != nil {
+				return err
+			}
+			f.codec.oldCiphers = append(f.codec.oldCiphers, cipher)
+		}
+		return nil
+	}
+}
+
+// WithLegacyFormats specifies whether blocks stored in the formats without
+// authentication, i.e., before authenticated encryption was introduced, can
+// be read. They can by default. Rejecting them is safe once all blocks in
+// the repository have been stored again, e.g., by "muscle rekey", and
+// makes a block whose format marker was tampered with fail authentication,
+// rather than decrypt to garbage.
+func WithLegacyFormats(accept bool) FactoryOption {
+	return func(f *Factory) error {
+		f.codec.rejectLegacy = !accept
+		return nil
+	}
 }
 
 // NewFactory creates a factory that creates blocks sharing the given cipher,
 // index, and repository.
-func NewFactory(index storage.Store, repository storage.Store, key []byte) (*Factory, error) {
+func NewFactory(index storage.Store, repository storage.Store, key []byte, opts ...FactoryOption) (*Factory, error) {
 	cipher, err := newBlockCipher(key)
 	if err != nil {
 		return nil, err
 	}
-	return &Factory{
-		cipher:     cipher,
+	f := &Factory{
+		key:        key,
+		codec:      &valueCodec{cipher: cipher},
 		index:      index,
 		repository: repository,
-	}, nil
+	}
+	for _, o := range opts {
+		if err := o(f); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
 }
 
 func (factory *Factory) New(ref Ref, capacity int) (*Block, error) {
 	block := &Block{
 		capacity:   capacity,
-		cipher:     factory.cipher,
+		codec:      factory.codec,
+		refKey:     factory.refKey,
 		index:      factory.index,
 		repository: factory.repository,
 	}
@@ -55,3 +115,36 @@ func (factory *Factory) New(ref Ref, capacity int) (*Block, error) {
 	}
 	return block, nil
 }
+
+// Recrypt loads the block with the given ref, and returns its value
+// encoded as the other factory would store it, e.g., encrypted with a
+// different key. The value is stored under the same key, regardless of the
+// encryption key, because repository refs are hashes of the value and index
+// refs are random.
+func (factory *Factory) Recrypt(ref Ref, other *Factory) (storage.Value, error) {
+	b, err := factory.New(ref, 0)
+	if err != nil {
+		return nil, err
+	}
+	if err := b.ensureReadable(); err != nil {
+		return nil, fmt.Errorf("block.Factory.Recrypt: %w", err)
+	}
+	stored, err := other.codec.encode(b.value)
+	if err != nil {
+		return nil, fmt.Errorf("block.Factory.Recrypt: %w", err)
+	}
+	return stored, nil
+}
+
+// Encode compresses and encrypts a value the way block values are stored,
+// for data stored outside of blocks, e.g., the indexes of pack objects (see
+// storage.Packed).
+func (factory *Factory) Encode(value []byte) ([]byte, error) {
+	return factory.codec.encode(value)
+}
+
+// Decode is the inverse of Encode. Like for blocks, the old keys are tried
+// if the current one fails.
+func (factory *Factory) Decode(stored []byte) ([]byte, error) {
+	return factory.codec.decode(stored, nil)
+}
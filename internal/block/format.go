@@ -0,0 +1,200 @@
+package block
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+)
+
+// Blocks stored before compression was introduced consist of a random
+// initialization vector followed by the AES-CTR encryption of the value.
+// Newer blocks start with a magic string, which a random initialization
+// vector is astronomically unlikely to match, followed by a format byte.
+// For formatCTR, which is only read and no longer written, the rest is laid
+// out as follows:
+//
+//	iv[16] ctr(header[1] payload)
+//
+// For formatGCM, the rest is laid out as follows:
+//
+//	nonce[12] gcm(header[1] payload) tag[16]
+//
+// where the magic string and format byte are authenticated as additional
+// data. In both formats, the header byte tells how the payload encodes the
+// value. A block whose magic string or format byte was tampered with can't
+// be told apart from a block in an unauthenticated format, hence the legacy
+// formats, without magic string or with formatCTR, can be rejected once a
+// repository holds none (see WithLegacyFormats).
+var magic = []byte("\xffmuscle\xff")
+
+const (
+	formatCTR byte = 1
+	formatGCM byte = 2
+)
+
+var (
+	// ErrAuthentication is returned when a stored block fails
+	// authentication, which means it was corrupted or tampered with.
+	ErrAuthentication = errors.New("authentication failed")
+
+	// ErrIntegrity is returned when the hash of a block's value does not
+	// match the block's repository ref.
+	ErrIntegrity = errors.New("integrity check failed")
+)
+
+// Values of the header byte.
+const (
+	payloadRaw     byte = 0
+	payloadDeflate byte = 1
+)
+
+// Compression says how block values are compressed before encryption.
+type Compression uint8
+
+const (
+	NoCompression Compression = iota
+	Deflate
+)
+
+// ParseCompression maps the names "none" (or the empty string) and
+// "deflate" to the corresponding compression.
+func ParseCompression(name string) (Compression, error) {
+	switch name {
+	case "", "none":
+		return NoCompression, nil
+	case "deflate":
+		return Deflate, nil
+	default:
+		return 0, fmt.Errorf("block.ParseCompression: unknown compression %q", name)
+	}
+}
+
+// valueCodec turns block values into what's stored and back.
+type valueCodec struct {
+	cipher      blockCipher
+	compression Compression
+
+	// Ciphers for old keys, only used for decoding, after the current
+	// cipher fails.
+	oldCiphers []blockCipher
+
+	// Whether to reject stored data in the unauthenticated formats.
+	rejectLegacy bool
+}
+
+func (c *valueCodec) encode(value []byte) ([]byte, error) {
+	header, payload := payloadRaw, value
+	if c.compression == Deflate {
+		if compressed, err := deflate(value); err != nil {
+			return nil, err
+		} else if len(compressed) < len(value) {
+			header, payload = payloadDeflate, compressed
+		}
+	}
+	cleartext := make([]byte, 1+len(payload))
+	cleartext[0] = header
+	copy(cleartext[1:], payload)
+	overhead := c.cipher.aead.NonceSize() + c.cipher.aead.Overhead()
+	stored := make([]byte, 0, len(magic)+1+overhead+len(cleartext))
+	stored = append(stored, magic...)
+	stored = append(stored, formatGCM)
+	return c.cipher.seal(stored, cleartext, stored)
+}
+
+// decode decodes stored data with the current cipher or, failing that,
+// with the old ciphers. For data encrypted without authentication, the
+// check function, if not nil, is what tells whether a cipher succeeded.
+func (c *valueCodec) decode(stored []byte, check func([]byte) error) (value []byte, err error) {
+	for i := -1; i < len(c.oldCiphers); i++ {
+		cipher := &c.cipher
+		if i >= 0 {
+			cipher = &c.oldCiphers[i]
+		}
+		value, err = decodeWith(cipher, stored, c.rejectLegacy)
+		if err == nil && check != nil {
+			err = check(value)
+		}
+		if err == nil {
+			return value, nil
+		}
+	}
+	return nil, err
+}
+
+func decodeWith(c *blockCipher, stored []byte, rejectLegacy bool) ([]byte, error) {
+	if !bytes.HasPrefix(stored, magic) {
+		if rejectLegacy {
+			return nil, errors.Wrap(ErrAuthentication, "missing magic string")
+		}
+		if l, min := len(stored), c.BlockSize(); l < min {
+			return nil, errors.Errorf("%d bytes long; expected to be at least %d bytes long", l, min)
+		}
+		return c.decrypt(stored), nil
+	}
+	if len(stored) == len(magic) {
+		return nil, errors.Wrap(ErrAuthentication, "missing format byte")
+	}
+	prefix, stored := stored[:len(magic)+1], stored[len(magic)+1:]
+	switch format := prefix[len(magic)]; format {
+	case formatCTR:
+		if rejectLegacy {
+			return nil, errors.Wrapf(ErrAuthentication, "unauthenticated format %d", format)
+		}
+		if l, min := len(stored), c.BlockSize()+1; l < min {
+			return nil, errors.Errorf("%d bytes long after format byte; expected to be at least %d bytes long", l, min)
+		}
+		return unpack(c.decrypt(stored))
+	case formatGCM:
+		cleartext, err := c.open(stored, prefix)
+		if err != nil {
+			return nil, err
+		}
+		if len(cleartext) == 0 {
+			return nil, errors.Errorf("missing payload header")
+		}
+		return unpack(cleartext)
+	default:
+		return nil, errors.Wrapf(ErrAuthentication, "unknown format %d", format)
+	}
+}
+
+func unpack(cleartext []byte) ([]byte, error) {
+	switch header, payload := cleartext[0], cleartext[1:]; header {
+	case payloadRaw:
+		return payload, nil
+	case payloadDeflate:
+		return inflate(payload)
+	default:
+		return nil, errors.Errorf("unknown payload header %d", header)
+	}
+}
+
+func deflate(value []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(value); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func inflate(payload []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(payload))
+	defer func() {
+		_ = r.Close()
+	}()
+	value, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "inflate")
+	}
+	return value, nil
+}
@@ -0,0 +1,194 @@
+package block
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"testing"
+	"testing/quick"
+)
+
+func newTestCodec(t *testing.T, compression Compression) *valueCodec {
+	t.Helper()
+	key := make([]byte, 16)
+	rand.Read(key)
+	cipher, err := newBlockCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &valueCodec{cipher: cipher, compression: compression}
+}
+
+func TestValueCodecRoundTrip(t *testing.T) {
+	for _, compression := range []Compression{NoCompression, Deflate} {
+		c := newTestCodec(t, compression)
+		f := func(value []byte, repeat uint8) bool {
+			// Make some values compressible.
+			value = bytes.Repeat(value, int(repeat%4)+1)
+			stored, err := c.encode(value)
+			if err != nil {
+				t.Log(err)
+				return false
+			}
+			decoded, err := c.decode(stored, nil)
+			if err != nil {
+				t.Log(err)
+				return false
+			}
+			return bytes.Equal(value, decoded)
+		}
+		if err := quick.Check(f, nil); err != nil {
+			t.Errorf("compression %d: %v", compression, err)
+		}
+	}
+}
+
+func TestValueCodecCompression(t *testing.T) {
+	c := newTestCodec(t, Deflate)
+	t.Run("compressible values shrink", func(t *testing.T) {
+		value := bytes.Repeat([]byte("all work and no play makes jack a dull boy\n"), 1000)
+		stored, err := c.encode(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(stored) >= len(value)/10 {
+			t.Errorf("got %d stored bytes for a %d-byte value", len(stored), len(value))
+		}
+	})
+	t.Run("incompressible values are stored raw", func(t *testing.T) {
+		value := make([]byte, 8192)
+		rand.Read(value)
+		stored, err := c.encode(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		overhead := len(magic) + 1 + c.cipher.aead.NonceSize() + 1 + c.cipher.aead.Overhead()
+		if got, want := len(stored), len(value)+overhead; got != want {
+			t.Errorf("got %d, want %d stored bytes", got, want)
+		}
+	})
+	t.Run("legacy values are readable", func(t *testing.T) {
+		value := []byte("written before compression existed")
+		stored, err := c.cipher.encrypt(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := c.decode(stored, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(value, decoded) {
+			t.Errorf("got %q, want %q", decoded, value)
+		}
+	})
+	t.Run("unauthenticated compressed values are readable", func(t *testing.T) {
+		value := []byte("written before authenticated encryption existed")
+		ciphertext, err := c.cipher.encrypt(append([]byte{payloadRaw}, value...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		stored := append(append(append([]byte(nil), magic...), formatCTR), ciphertext...)
+		decoded, err := c.decode(stored, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(value, decoded) {
+			t.Errorf("got %q, want %q", decoded, value)
+		}
+	})
+}
+
+func TestValueCodecAuthentication(t *testing.T) {
+	c := newTestCodec(t, NoCompression)
+	stored, err := c.encode([]byte("do not tamper with me"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tamper := func(t *testing.T, from int) {
+		t.Helper()
+		for i := from; i < len(stored); i++ {
+			tampered := append([]byte(nil), stored...)
+			tampered[i] ^= 0x01
+			if _, err := c.decode(tampered, nil); !errors.Is(err, ErrAuthentication) {
+				t.Errorf("byte %d: got %v, want %v", i, err, ErrAuthentication)
+			}
+		}
+		if _, err := c.decode(stored[:len(stored)-1], nil); !errors.Is(err, ErrAuthentication) {
+			t.Errorf("truncated: got %v, want %v", err, ErrAuthentication)
+		}
+		if _, err := c.decode(stored[:len(magic)], nil); !errors.Is(err, ErrAuthentication) {
+			t.Errorf("no format byte: got %v, want %v", err, ErrAuthentication)
+		}
+	}
+	t.Run("legacy formats accepted", func(t *testing.T) {
+		// Tampering with the magic string can't be detected, as it makes
+		// the block look like one written before the magic string was
+		// introduced.
+		tamper(t, len(magic))
+	})
+	t.Run("legacy formats rejected", func(t *testing.T) {
+		c.rejectLegacy = true
+		defer func() { c.rejectLegacy = false }()
+		tamper(t, 0)
+		legacy, err := c.cipher.encrypt([]byte("written before compression existed"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.decode(legacy, nil); !errors.Is(err, ErrAuthentication) {
+			t.Errorf("legacy: got %v, want %v", err, ErrAuthentication)
+		}
+		ctr := append(append(append([]byte(nil), magic...), formatCTR), legacy...)
+		if _, err := c.decode(ctr, nil); !errors.Is(err, ErrAuthentication) {
+			t.Errorf("unauthenticated: got %v, want %v", err, ErrAuthentication)
+		}
+	})
+}
+
+func TestParseCompression(t *testing.T) {
+	for name, want := range map[string]Compression{"": NoCompression, "none": NoCompression, "deflate": Deflate} {
+		if got, err := ParseCompression(name); err != nil || got != want {
+			t.Errorf("%q: got %v, %v, want %v", name, got, err, want)
+		}
+	}
+	if _, err := ParseCompression("lz4"); err == nil {
+		t.Error("got nil, want error")
+	}
+}
+
+func TestValueCodecOldKeys(t *testing.T) {
+	old, current := newTestCodec(t, NoCompression), newTestCodec(t, NoCompression)
+	current.oldCiphers = []blockCipher{newTestCodec(t, NoCompression).cipher, old.cipher}
+	value := []byte("encrypted with an old key")
+	t.Run("authenticated", func(t *testing.T) {
+		stored, err := old.encode(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := current.decode(stored, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(value, decoded) {
+			t.Errorf("got %q, want %q", decoded, value)
+		}
+	})
+	t.Run("unauthenticated", func(t *testing.T) {
+		stored, err := old.cipher.encrypt(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ref := RefOf(value)
+		decoded, err := current.decode(stored, func(p []byte) error {
+			if RefOf(p) != ref {
+				return ErrIntegrity
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(value, decoded) {
+			t.Errorf("got %q, want %q", decoded, value)
+		}
+	})
+}
@@ -0,0 +1,128 @@
+package block
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/nicolagi/muscle/storage"
+)
+
+// Names of the schemes for computing repository refs from block values.
+// With the plain scheme, a ref is the SHA-256 of the value, so whoever can
+// list the repository can confirm it contains a known value. With the
+// keyed scheme, a ref is the HMAC-SHA256 of the value, with a key derived
+// from the encryption key.
+const (
+	PlainRefs = "sha256"
+	KeyedRefs = "hmac-sha256"
+)
+
+// The scheme of a repository is recorded in the repository under this key.
+// For the keyed scheme, the record also holds the HMAC key, encoded like
+// block values, so that it survives changing the encryption key (see
+// "muscle rekey"). Repositories without a record use the plain scheme.
+const refSchemeKey storage.Key = "remote.refs"
+
+// refOf computes the ref of a value with the given HMAC key, or the plain
+// SHA-256 if the key is nil.
+func refOf(key, value []byte) (ref RepositoryRef) {
+	if key == nil {
+		return RefOf(value)
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(value)
+	copy(ref[:], mac.Sum(nil))
+	return ref
+}
+
+// WithRefScheme makes the factory compute repository refs with the
+// scheme recorded in the given store, typically the one holding the remote
+// root pointers. If there is no record, the requested scheme is recorded,
+// unless it is the plain one or the empty string. It is an error to
+// request a scheme other than the recorded one, because that would defeat
+// deduplication. Since the record is encrypted, this option must come
+// after WithOldKeys.
+func WithRefScheme(pointers storage.Store, requested string) FactoryOption {
+	return func(f *Factory) error {
+		if requested != "" && requested != PlainRefs && requested != KeyedRefs {
+			return fmt.Errorf("block.WithRefScheme: unknown scheme %q", requested)
+		}
+		scheme, key, err := f.loadRefScheme(pointers)
+		if errors.Is(err, storage.ErrNotFound) {
+			if requested != KeyedRefs {
+				return nil
+			}
+			mac := hmac.New(sha256.New, f.key)
+			mac.Write([]byte("muscle block refs"))
+			key = mac.Sum(nil)
+			if err := f.storeRefScheme(pointers, key); err != nil {
+				return err
+			}
+			f.refKey = key
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if requested != "" && requested != scheme {
+			return fmt.Errorf("block.WithRefScheme: requested %q, but the repository uses %q", requested, scheme)
+		}
+		f.refKey = key
+		return nil
+	}
+}
+
+func (factory *Factory) loadRefScheme(pointers storage.Store) (scheme string, key []byte, err error) {
+	record, err := pointers.Get(refSchemeKey)
+	if err != nil {
+		return "", nil, fmt.Errorf("block.Factory.loadRefScheme: %w", err)
+	}
+	fields := strings.Fields(string(record))
+	if len(fields) == 1 && fields[0] == PlainRefs {
+		return PlainRefs, nil, nil
+	}
+	if len(fields) != 2 || fields[0] != KeyedRefs {
+		return "", nil, fmt.Errorf("block.Factory.loadRefScheme: malformed record %q", record)
+	}
+	stored, err := hex.DecodeString(fields[1])
+	if err != nil {
+		return "", nil, fmt.Errorf("block.Factory.loadRefScheme: %w", err)
+	}
+	if key, err = factory.codec.decode(stored, nil); err != nil {
+		return "", nil, fmt.Errorf("block.Factory.loadRefScheme: %w", err)
+	}
+	return KeyedRefs, key, nil
+}
+
+func (factory *Factory) storeRefScheme(pointers storage.Store, key []byte) error {
+	stored, err := factory.codec.encode(key)
+	if err != nil {
+		return fmt.Errorf("block.Factory.storeRefScheme: %w", err)
+	}
+	if err := pointers.Put(refSchemeKey, []byte(fmt.Sprintf("%s %x\n", KeyedRefs, stored))); err != nil {
+		return fmt.Errorf("block.Factory.storeRefScheme: %w", err)
+	}
+	return nil
+}
+
+// RecryptRefScheme re-encodes the HMAC key in the ref scheme record, if
+// any, as the other factory would, e.g., encrypted with a different key.
+func (factory *Factory) RecryptRefScheme(pointers storage.Store, other *Factory) error {
+	scheme, key, err := factory.loadRefScheme(pointers)
+	if errors.Is(err, storage.ErrNotFound) || err == nil && scheme == PlainRefs {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return other.storeRefScheme(pointers, key)
+}
+
+// RefOf computes the repository ref of a value with the factory's scheme.
+func (factory *Factory) RefOf(value []byte) RepositoryRef {
+	return refOf(factory.refKey, value)
+}
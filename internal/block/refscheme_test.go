@@ -0,0 +1,115 @@
+package block
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/nicolagi/muscle/storage"
+)
+
+func TestRefScheme(t *testing.T) {
+	key := make([]byte, 16)
+	rand.Read(key)
+	newFactory := func(t *testing.T, pointers, repository storage.Store, key []byte, requested string, opts ...FactoryOption) *Factory {
+		t.Helper()
+		opts = append(opts, WithRefScheme(pointers, requested))
+		f, err := NewFactory(&storage.InMemory{}, repository, key, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return f
+	}
+	seal := func(t *testing.T, f *Factory, value string) Ref {
+		t.Helper()
+		b, err := f.New(nil, 8192)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := b.Write([]byte(value), 0); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := b.Seal(); err != nil {
+			t.Fatal(err)
+		}
+		return b.Ref()
+	}
+	t.Run("plain by default", func(t *testing.T) {
+		f := newFactory(t, &storage.InMemory{}, &storage.InMemory{}, key, "")
+		if got, want := seal(t, f, "value"), RefOf([]byte("value")); got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	})
+	t.Run("keyed scheme is recorded", func(t *testing.T) {
+		pointers, repository := &storage.InMemory{}, &storage.InMemory{}
+		f := newFactory(t, pointers, repository, key, KeyedRefs)
+		ref := seal(t, f, "value")
+		if ref == RefOf([]byte("value")) {
+			t.Fatal("got plain ref")
+		}
+		// Another host, not requesting any scheme.
+		g := newFactory(t, pointers, repository, key, "")
+		if got := seal(t, g, "value"); got != ref {
+			t.Errorf("got %v, want %v", got, ref)
+		}
+		b, err := g.New(ref, 8192)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := b.ReadAll(); err != nil || string(got) != "value" {
+			t.Errorf("got %q, %v", got, err)
+		}
+		if _, err := NewFactory(nil, repository, key, WithRefScheme(pointers, PlainRefs)); err == nil {
+			t.Error("got nil, want error for mismatching scheme")
+		}
+	})
+	t.Run("plain refs remain readable", func(t *testing.T) {
+		pointers, repository := &storage.InMemory{}, &storage.InMemory{}
+		ref := seal(t, newFactory(t, pointers, repository, key, ""), "value")
+		f := newFactory(t, pointers, repository, key, KeyedRefs)
+		b, err := f.New(ref, 8192)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := b.ReadAll(); err != nil || string(got) != "value" {
+			t.Errorf("got %q, %v", got, err)
+		}
+	})
+	t.Run("keyed and plain refs to the same value", func(t *testing.T) {
+		pointers, repository := &storage.InMemory{}, &storage.InMemory{}
+		plain := seal(t, newFactory(t, pointers, repository, key, ""), "value")
+		f := newFactory(t, pointers, repository, key, KeyedRefs)
+		keyed, other := seal(t, f, "value"), seal(t, f, "other value")
+		blocks := make(map[Ref]*Block)
+		for _, ref := range []Ref{plain, keyed, other} {
+			b, err := f.New(ref, 8192)
+			if err != nil {
+				t.Fatal(err)
+			}
+			blocks[ref] = b
+		}
+		if same, err := blocks[plain].SameValue(blocks[keyed]); err != nil || !same {
+			t.Errorf("got %v, %v, want the same value", same, err)
+		}
+		if same, err := blocks[plain].SameValue(blocks[other]); err != nil || same {
+			t.Errorf("got %v, %v, want different values", same, err)
+		}
+	})
+	t.Run("keyed scheme survives rekey", func(t *testing.T) {
+		pointers, repository := &storage.InMemory{}, &storage.InMemory{}
+		f := newFactory(t, pointers, repository, key, KeyedRefs)
+		ref := seal(t, f, "value")
+		newKey := make([]byte, 16)
+		rand.Read(newKey)
+		rekeyed, err := NewFactory(nil, nil, newKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := f.RecryptRefScheme(pointers, rekeyed); err != nil {
+			t.Fatal(err)
+		}
+		g := newFactory(t, pointers, repository, newKey, KeyedRefs)
+		if got := seal(t, g, "value"); got != ref {
+			t.Errorf("got %v, want %v", got, ref)
+		}
+	})
+}
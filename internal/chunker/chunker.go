@@ -0,0 +1,122 @@
+package chunker
+
+import (
+	"fmt"
+	"math/bits"
+)
+
+// Chunker finds content-defined cut points in a byte stream, using
+// the FastCDC algorithm with normalized chunking: the gear hash of the
+// bytes seen since the previous cut point is tested against a harder
+// mask before the average chunk size is reached, and against an easier
+// one afterwards, so that chunk sizes concentrate around the average.
+//
+// Because cut points only depend on the content since the previous
+// cut point, inserting or removing bytes in a stream only changes the
+// chunks around the edit; the following chunks are found again at the
+// same (shifted) boundaries.
+type Chunker struct {
+	min, avg, max int
+	maskS, maskL  uint64
+}
+
+// New returns a chunker producing chunks of at least min and at most max
+// bytes, and of avg bytes on average. The average must be a power of two.
+func New(min, avg, max int) (*Chunker, error) {
+	if min <= 0 || min > avg || avg > max {
+		return nil, fmt.Errorf("chunker.New: want 0 < min <= avg <= max, got %d, %d, %d", min, avg, max)
+	}
+	if avg&(avg-1) != 0 {
+		return nil, fmt.Errorf("chunker.New: average size %d is not a power of two", avg)
+	}
+	b := bits.TrailingZeros(uint(avg))
+	return &Chunker{
+		min:   min,
+		avg:   avg,
+		max:   max,
+		maskS: topBits(b + 2),
+		maskL: topBits(b - 2),
+	}, nil
+}
+
+// ForMax returns a chunker for the given maximum chunk size, deriving the
+// average as the largest power of two not exceeding half of the maximum,
+// and the minimum as a quarter of the maximum.
+func ForMax(max int) (*Chunker, error) {
+	if max < 8 {
+		return nil, fmt.Errorf("chunker.ForMax: maximum chunk size %d is too small", max)
+	}
+	avg := 1 << (bits.Len(uint(max/2)) - 1)
+	min := max / 4
+	if min > avg {
+		min = avg
+	}
+	return New(min, avg, max)
+}
+
+// Min returns the minimum chunk size.
+func (c *Chunker) Min() int { return c.min }
+
+// Max returns the maximum chunk size.
+func (c *Chunker) Max() int { return c.max }
+
+// Cut returns the length of the first chunk in data. The returned length
+// is len(data) if data is shorter than the minimum chunk size, or if no cut
+// point is found within data. In the latter case, if the stream continues
+// beyond data and len(data) is less than the maximum chunk size, the caller
+// should call Cut again with more data.
+func (c *Chunker) Cut(data []byte) int {
+	n := len(data)
+	if n <= c.min {
+		return n
+	}
+	if n > c.max {
+		n = c.max
+	}
+	normal := c.avg
+	if n < normal {
+		normal = n
+	}
+	var h uint64
+	i := c.min
+	for ; i < normal; i++ {
+		h = (h << 1) + gear[data[i]]
+		if h&c.maskS == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		h = (h << 1) + gear[data[i]]
+		if h&c.maskL == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
+
+// topBits returns a mask with the n most significant bits set. The gear
+// hash accumulates the influence of earlier bytes in the high bits, so
+// those are the ones to test.
+func topBits(n int) uint64 {
+	if n <= 0 {
+		return 0
+	}
+	return ^uint64(0) << uint(64-n)
+}
+
+// The gear table maps each byte to a pseudo-random 64-bit value.
+// It must never change, or the chunk boundaries of stored files would no
+// longer be found again, defeating deduplication.
+var gear [256]uint64
+
+func init() {
+	// SplitMix64 with a fixed seed.
+	state := uint64(0x6d7573636c65) // "muscle"
+	for i := range gear {
+		state += 0x9e3779b97f4a7c15
+		z := state
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		gear[i] = z ^ (z >> 31)
+	}
+}
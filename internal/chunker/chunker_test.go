@@ -0,0 +1,106 @@
+package chunker
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func chunks(c *Chunker, data []byte) (lengths []int) {
+	for len(data) > 0 {
+		n := c.Cut(data)
+		lengths = append(lengths, n)
+		data = data[n:]
+	}
+	return
+}
+
+func TestNew(t *testing.T) {
+	for _, tc := range []struct {
+		min, avg, max int
+		ok            bool
+	}{
+		{1024, 4096, 16384, true},
+		{0, 4096, 16384, false},
+		{8192, 4096, 16384, false},
+		{1024, 4096, 2048, false},
+		{1024, 3000, 16384, false},
+	} {
+		_, err := New(tc.min, tc.avg, tc.max)
+		if got := err == nil; got != tc.ok {
+			t.Errorf("New(%d, %d, %d): got error %v", tc.min, tc.avg, tc.max, err)
+		}
+	}
+}
+
+func TestCutSizes(t *testing.T) {
+	c, err := ForMax(64 * 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 4*1024*1024)
+	rand.Read(data)
+	lengths := chunks(c, data)
+	var total int
+	for i, n := range lengths {
+		if n > c.Max() {
+			t.Errorf("chunk %d: got %d bytes, want at most %d", i, n, c.Max())
+		}
+		if n < c.Min() && i < len(lengths)-1 {
+			t.Errorf("chunk %d: got %d bytes, want at least %d", i, n, c.Min())
+		}
+		total += n
+	}
+	if total != len(data) {
+		t.Errorf("got %d bytes in total, want %d", total, len(data))
+	}
+	// Expect roughly the average size (32 KiB), not all chunks at the maximum size.
+	if avg := len(data) / len(lengths); avg < 16*1024 || avg > 48*1024 {
+		t.Errorf("got average chunk size %d", avg)
+	}
+}
+
+func TestCutResistsShifts(t *testing.T) {
+	c, err := ForMax(16 * 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 1024*1024)
+	// Fixed data, as a few inserted bytes may well change more chunks.
+	rand.New(rand.NewSource(1)).Read(data)
+	shifted := append([]byte("inserted bytes"), data...)
+	cut := func(data []byte) map[string]bool {
+		m := make(map[string]bool)
+		for len(data) > 0 {
+			n := c.Cut(data)
+			m[string(data[:n])] = true
+			data = data[n:]
+		}
+		return m
+	}
+	before, after := cut(data), cut(shifted)
+	var common int
+	for k := range after {
+		if before[k] {
+			common++
+		}
+	}
+	if len(before)-common > 2 {
+		t.Errorf("got %d chunks in common out of %d", common, len(before))
+	}
+}
+
+func TestCutShortData(t *testing.T) {
+	c, err := New(4, 8, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, data := range [][]byte{nil, []byte("abc"), []byte("abcd")} {
+		if got, want := c.Cut(data), len(data); got != want {
+			t.Errorf("Cut(%q): got %d, want %d", data, got, want)
+		}
+	}
+	if got := c.Cut(bytes.Repeat([]byte{0}, 100)); got > 16 {
+		t.Errorf("got %d, want at most 16", got)
+	}
+}
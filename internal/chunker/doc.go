@@ -0,0 +1,2 @@
+// Package chunker splits byte streams into content-defined chunks.
+package chunker // import "github.com/nicolagi/muscle/internal/chunker"
@@ -0,0 +1,195 @@
+// Package kdf derives encryption keys from passphrases, with scrypt, and
+// wraps keys with passphrases so they can be moved between machines.
+package kdf // import "github.com/nicolagi/muscle/internal/kdf"
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/nicolagi/muscle/config"
+	"github.com/nicolagi/muscle/storage"
+	"golang.org/x/crypto/scrypt"
+)
+
+// ErrWrongPassphrase is returned when a passphrase doesn't produce the
+// expected key.
+var ErrWrongPassphrase = errors.New("wrong passphrase")
+
+// The parameters for deriving the repository key from a passphrase are
+// stored, in the clear, in the remote store under this key.
+const paramsKey storage.Key = "remote.kdf"
+
+const (
+	keyLen  = 32
+	saltLen = 32
+)
+
+// Cost parameters for new salts, requiring 32 MiB and a fraction of a
+// second to derive a key. Tests lower them.
+var cost = struct{ n, r, p int }{n: 1 << 15, r: 8, p: 1}
+
+// Bounds on the cost parameters of stored parameters and wrapped keys,
+// which aren't authenticated, so that they can be neither weakened nor
+// made to take too much memory (128*n*r bytes) or time. Tests lower them.
+var bounds = struct{ minN, minR, maxP, maxMemory int }{minN: 1 << 15, minR: 8, maxP: 16, maxMemory: 1 << 30}
+
+// Params holds what's needed to derive a key from a passphrase, which
+// isn't secret.
+type Params struct {
+	Algorithm string `json:"algorithm"`
+	Salt      []byte `json:"salt"`
+	N         int    `json:"n"`
+	R         int    `json:"r"`
+	P         int    `json:"p"`
+
+	// Verifier is a MAC computed with the derived key, to tell a wrong
+	// passphrase apart from an undecryptable block.
+	Verifier []byte `json:"verifier,omitempty"`
+}
+
+func newParams() (*Params, error) {
+	salt := make([]byte, saltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("kdf.newParams: %w", err)
+	}
+	return &Params{Algorithm: config.ScryptKeyDerivation, Salt: salt, N: cost.n, R: cost.r, P: cost.p}, nil
+}
+
+// Key derives a key from the passphrase, and checks it against the
+// verifier, returning ErrWrongPassphrase on mismatch. Parameters without a
+// verifier are rejected.
+func (params *Params) Key(passphrase []byte) ([]byte, error) {
+	if len(params.Verifier) == 0 {
+		return nil, fmt.Errorf("kdf.Params.Key: no verifier")
+	}
+	key, err := params.derive(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(params.Verifier, verifier(key)) {
+		return nil, ErrWrongPassphrase
+	}
+	return key, nil
+}
+
+// derive derives a key from the passphrase, without verifying it.
+func (params *Params) derive(passphrase []byte) ([]byte, error) {
+	if err := params.validate(); err != nil {
+		return nil, err
+	}
+	key, err := scrypt.Key(passphrase, params.Salt, params.N, params.R, params.P, keyLen)
+	if err != nil {
+		return nil, fmt.Errorf("kdf.Params.derive: %w", err)
+	}
+	return key, nil
+}
+
+// validate checks the algorithm, the salt, and the cost parameters against
+// bounds.
+func (params *Params) validate() error {
+	if params.Algorithm != config.ScryptKeyDerivation {
+		return fmt.Errorf("kdf: unknown algorithm %q", params.Algorithm)
+	}
+	if len(params.Salt) < saltLen {
+		return fmt.Errorf("kdf: salt is %d bytes long, want at least %d", len(params.Salt), saltLen)
+	}
+	n, r, p := params.N, params.R, params.P
+	if n < bounds.minN || n&(n-1) != 0 {
+		return fmt.Errorf("kdf: cost parameter n=%d is not a power of two of at least %d", n, bounds.minN)
+	}
+	if r < bounds.minR || p < 1 || p > bounds.maxP {
+		return fmt.Errorf("kdf: parameters r=%d, p=%d out of bounds", r, p)
+	}
+	if uint64(n)*uint64(r) > uint64(bounds.maxMemory/128) {
+		return fmt.Errorf("kdf: parameters n=%d, r=%d need more than %d bytes", n, r, bounds.maxMemory)
+	}
+	return nil
+}
+
+func verifier(key []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("muscle key verifier"))
+	return mac.Sum(nil)
+}
+
+// LoadParams loads the key derivation parameters from the repository,
+// rejecting those out of bounds or without a verifier. It returns an error
+// wrapping storage.ErrNotFound if there are none.
+func LoadParams(repository storage.Store) (*Params, error) {
+	b, err := repository.Get(paramsKey)
+	if err != nil {
+		return nil, fmt.Errorf("kdf.LoadParams: %w", err)
+	}
+	var params Params
+	if err := json.Unmarshal(b, &params); err != nil {
+		return nil, fmt.Errorf("kdf.LoadParams: %w", err)
+	}
+	if err := params.validate(); err != nil {
+		return nil, fmt.Errorf("kdf.LoadParams: %w", err)
+	}
+	if len(params.Verifier) == 0 {
+		return nil, fmt.Errorf("kdf.LoadParams: no verifier")
+	}
+	return &params, nil
+}
+
+// EncryptionKey returns the repository encryption key: the one in the
+// configuration or, for passphrase-derived keys, the one derived from the
+// configured passphrase and the parameters stored in the repository. The
+// parameters are created on first use.
+func EncryptionKey(c *config.C, repository storage.Store) ([]byte, error) {
+	if c.KeyDerivation == "" {
+		return c.EncryptionKeyBytes(), nil
+	}
+	params, err := LoadParams(repository)
+	if errors.Is(err, storage.ErrNotFound) {
+		if params, err = newParams(); err != nil {
+			return nil, err
+		}
+		return initParams(repository, params, c.Passphrase())
+	}
+	if err != nil {
+		return nil, err
+	}
+	return params.Key(c.Passphrase())
+}
+
+// initParams derives the key, then stores the parameters, including a
+// verifier for the key, in the repository, unless another host stored its
+// own first, in which case the key is derived from those.
+func initParams(repository storage.Store, params *Params, passphrase []byte) ([]byte, error) {
+	key, err := params.derive(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	params.Verifier = verifier(key)
+	b, err := json.Marshal(params)
+	if err != nil {
+		return nil, fmt.Errorf("kdf.initParams: %w", err)
+	}
+	err = storage.ErrNotImplemented
+	if swapper, ok := repository.(storage.Swapper); ok {
+		err = swapper.Swap(paramsKey, nil, b)
+	}
+	if errors.Is(err, storage.ErrNotImplemented) {
+		// Another host may still put its own parameters at the same
+		// time; the one stored last wins, and is read back below.
+		err = repository.Put(paramsKey, b)
+	}
+	if err != nil && !errors.Is(err, storage.ErrConflict) {
+		return nil, fmt.Errorf("kdf.initParams: %w", err)
+	}
+	stored, err := LoadParams(repository)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(stored.Salt, params.Salt) {
+		return key, nil
+	}
+	return stored.Key(passphrase)
+}
@@ -0,0 +1,162 @@
+package kdf
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/nicolagi/muscle/storage"
+)
+
+func init() {
+	// Cheap parameters, so tests run fast.
+	cost.n = 16
+	bounds.minN = 16
+}
+
+// putOnly hides the Swap method of a store.
+type putOnly struct {
+	storage.Store
+}
+
+func TestParamsInRepository(t *testing.T) {
+	repository := &storage.InMemory{}
+	params, err := newParams()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := initParams(repository, params, []byte("correct horse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadParams(repository)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Run("same passphrase gives same key", func(t *testing.T) {
+		again, err := loaded.Key([]byte("correct horse"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(key, again) {
+			t.Errorf("got %x, want %x", again, key)
+		}
+	})
+	t.Run("wrong passphrase is detected", func(t *testing.T) {
+		if _, err := loaded.Key([]byte("battery staple")); !errors.Is(err, ErrWrongPassphrase) {
+			t.Errorf("got %v, want %v", err, ErrWrongPassphrase)
+		}
+	})
+	t.Run("tampered parameters are rejected", func(t *testing.T) {
+		for _, tamper := range []func(*Params){
+			func(p *Params) { p.Verifier = nil },
+			func(p *Params) { p.N = 2 },
+			func(p *Params) { p.R = 1 },
+			func(p *Params) { p.N = 1 << 30 },
+			func(p *Params) { p.Salt = p.Salt[:1] },
+		} {
+			tampered := *loaded
+			tamper(&tampered)
+			b, err := json.Marshal(&tampered)
+			if err != nil {
+				t.Fatal(err)
+			}
+			other := &storage.InMemory{}
+			if err := other.Put(paramsKey, b); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := LoadParams(other); err == nil {
+				t.Errorf("%+v: got nil, want error", tampered)
+			}
+			if _, err := tampered.Key([]byte("correct horse")); err == nil {
+				t.Errorf("%+v: got nil, want error", tampered)
+			}
+		}
+	})
+}
+
+func TestConcurrentInitialization(t *testing.T) {
+	for _, repository := range []storage.Store{&storage.InMemory{}, putOnly{&storage.InMemory{}}} {
+		t.Run(fmt.Sprintf("%T", repository), func(t *testing.T) {
+			first, err := newParams()
+			if err != nil {
+				t.Fatal(err)
+			}
+			second, err := newParams()
+			if err != nil {
+				t.Fatal(err)
+			}
+			key1, err := initParams(repository, first, []byte("correct horse"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			// The second host didn't see the parameters of the first.
+			key2, err := initParams(repository, second, []byte("correct horse"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			stored, err := LoadParams(repository)
+			if err != nil {
+				t.Fatal(err)
+			}
+			key, err := stored.Key([]byte("correct horse"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(key2, key) {
+				t.Errorf("second host got %x, stored parameters give %x", key2, key)
+			}
+			if _, ok := repository.(storage.Swapper); ok && !bytes.Equal(key1, key) {
+				t.Errorf("first host got %x, stored parameters give %x", key1, key)
+			}
+		})
+	}
+}
+
+func TestWrapUnwrap(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	wrapped, err := Wrap(key, []byte("correct horse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(wrapped, "\n") {
+		t.Errorf("%q: want a single line", wrapped)
+	}
+	t.Run("round trip", func(t *testing.T) {
+		unwrapped, err := Unwrap(wrapped, []byte("correct horse"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(key, unwrapped) {
+			t.Errorf("got %x, want %x", unwrapped, key)
+		}
+	})
+	t.Run("wrong passphrase", func(t *testing.T) {
+		if _, err := Unwrap(wrapped, []byte("battery staple")); !errors.Is(err, ErrWrongPassphrase) {
+			t.Errorf("got %v, want %v", err, ErrWrongPassphrase)
+		}
+	})
+	t.Run("tampered header", func(t *testing.T) {
+		tampered := strings.Replace(wrapped, " 8 1 ", " 8 2 ", 1)
+		if tampered == wrapped {
+			t.Fatalf("%q: could not tamper", wrapped)
+		}
+		if _, err := Unwrap(tampered, []byte("correct horse")); err == nil {
+			t.Error("got nil, want error")
+		}
+	})
+	t.Run("excessive cost", func(t *testing.T) {
+		for _, params := range []string{" 1073741824 8 1 ", " 16 8 1000000 ", " 24 8 1 "} {
+			tampered := strings.Replace(wrapped, " 16 8 1 ", params, 1)
+			if tampered == wrapped {
+				t.Fatalf("%q: could not tamper", wrapped)
+			}
+			if _, err := Unwrap(tampered, []byte("correct horse")); err == nil || errors.Is(err, ErrWrongPassphrase) {
+				t.Errorf("%s: got %v, want a bounds error", params, err)
+			}
+		}
+	})
+}
@@ -0,0 +1,91 @@
+package kdf
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Wrapped keys are single lines of text, easy to copy and paste:
+//
+//	muscle-key-1 scrypt N r p salt sealed
+//
+// where salt and sealed are hex-encoded, and sealed is a nonce followed by
+// the AES-GCM encryption of the key under the key derived from the
+// passphrase, with everything before it as additional data.
+const wrapVersion = "muscle-key-1"
+
+// Wrap encrypts the key with a key derived from the passphrase.
+func Wrap(key, passphrase []byte) (string, error) {
+	params, err := newParams()
+	if err != nil {
+		return "", err
+	}
+	aead, err := wrappingAEAD(params, passphrase)
+	if err != nil {
+		return "", err
+	}
+	header := fmt.Sprintf("%s %s %d %d %d %x", wrapVersion, params.Algorithm, params.N, params.R, params.P, params.Salt)
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("kdf.Wrap: %w", err)
+	}
+	sealed := aead.Seal(nonce, nonce, key, []byte(header))
+	return fmt.Sprintf("%s %x", header, sealed), nil
+}
+
+// Unwrap is the inverse of Wrap. It returns ErrWrongPassphrase if the key
+// can't be decrypted, which also happens if the wrapped key was altered.
+func Unwrap(wrapped string, passphrase []byte) ([]byte, error) {
+	fields := strings.Fields(wrapped)
+	if len(fields) != 7 || fields[0] != wrapVersion {
+		return nil, fmt.Errorf("kdf.Unwrap: not a wrapped key")
+	}
+	params := &Params{Algorithm: fields[1]}
+	var err error
+	for i, dst := range []*int{&params.N, &params.R, &params.P} {
+		if *dst, err = strconv.Atoi(fields[2+i]); err != nil {
+			return nil, fmt.Errorf("kdf.Unwrap: %w", err)
+		}
+	}
+	if params.Salt, err = hex.DecodeString(fields[5]); err != nil {
+		return nil, fmt.Errorf("kdf.Unwrap: salt: %w", err)
+	}
+	sealed, err := hex.DecodeString(fields[6])
+	if err != nil {
+		return nil, fmt.Errorf("kdf.Unwrap: %w", err)
+	}
+	// Check the parameters before spending memory and time on them.
+	if err := params.validate(); err != nil {
+		return nil, fmt.Errorf("kdf.Unwrap: %w", err)
+	}
+	aead, err := wrappingAEAD(params, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("kdf.Unwrap: %d bytes long, shorter than nonce", len(sealed))
+	}
+	header := strings.Join(fields[:6], " ")
+	key, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(header))
+	if err != nil {
+		return nil, ErrWrongPassphrase
+	}
+	return key, nil
+}
+
+func wrappingAEAD(params *Params, passphrase []byte) (cipher.AEAD, error) {
+	key, err := params.derive(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,272 @@
+// Package reedsolomon implements a systematic Reed-Solomon erasure code
+// over GF(2^8): a value is split into k data shards, from which m parity
+// shards are computed, such that any k of the k+m shards suffice to
+// reconstruct the value.
+//
+// The encoding matrix is a Vandermonde matrix, transformed so that its top
+// k rows form the identity (hence data shards are plain slices of the
+// value), which preserves the property that any k rows are independent.
+package reedsolomon
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrTooFewShards is returned when fewer than k shards are available.
+var ErrTooFewShards = errors.New("too few shards")
+
+// GF(2^8) arithmetic, with the polynomial x^8+x^4+x^3+x^2+1 and
+// generator 2.
+var (
+	expTable [510]byte
+	logTable [256]byte
+	mulTable [256][256]byte
+)
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		expTable[i] = byte(x)
+		expTable[i+255] = byte(x)
+		logTable[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	for a := 1; a < 256; a++ {
+		for b := 1; b < 256; b++ {
+			mulTable[a][b] = expTable[int(logTable[a])+int(logTable[b])]
+		}
+	}
+}
+
+func inv(a byte) byte {
+	return expTable[255-int(logTable[a])]
+}
+
+// pow returns a to the n-th power.
+func pow(a byte, n int) byte {
+	if n == 0 {
+		return 1
+	}
+	if a == 0 {
+		return 0
+	}
+	return expTable[int(logTable[a])*n%255]
+}
+
+type matrix [][]byte
+
+func newMatrix(rows, cols int) matrix {
+	m := make(matrix, rows)
+	for r := range m {
+		m[r] = make([]byte, cols)
+	}
+	return m
+}
+
+func (m matrix) mul(n matrix) matrix {
+	p := newMatrix(len(m), len(n[0]))
+	for r := range p {
+		for c := range p[r] {
+			var v byte
+			for i := range n {
+				v ^= mulTable[m[r][i]][n[i][c]]
+			}
+			p[r][c] = v
+		}
+	}
+	return p
+}
+
+// invert returns the inverse of the square matrix m, by Gauss-Jordan
+// elimination.
+func (m matrix) invert() (matrix, error) {
+	n := len(m)
+	work := newMatrix(n, 2*n)
+	for r := range m {
+		copy(work[r], m[r])
+		work[r][n+r] = 1
+	}
+	for c := 0; c < n; c++ {
+		pivot := c
+		for pivot < n && work[pivot][c] == 0 {
+			pivot++
+		}
+		if pivot == n {
+			return nil, errors.New("reedsolomon: singular matrix")
+		}
+		work[c], work[pivot] = work[pivot], work[c]
+		if f := inv(work[c][c]); f != 1 {
+			for i := range work[c] {
+				work[c][i] = mulTable[f][work[c][i]]
+			}
+		}
+		for r := 0; r < n; r++ {
+			if f := work[r][c]; r != c && f != 0 {
+				for i := range work[r] {
+					work[r][i] ^= mulTable[f][work[c][i]]
+				}
+			}
+		}
+	}
+	result := make(matrix, n)
+	for r := range work {
+		result[r] = work[r][n:]
+	}
+	return result, nil
+}
+
+// Code is a Reed-Solomon code with k data shards and m parity shards.
+type Code struct {
+	k, m int
+	// The (k+m)×k encoding matrix, the top k rows being the identity.
+	encoding matrix
+}
+
+// New creates a code with k data shards and m parity shards.
+func New(k, m int) (*Code, error) {
+	if k <= 0 || m < 0 || k+m > 256 {
+		return nil, fmt.Errorf("reedsolomon.New: invalid number of shards, %d data and %d parity", k, m)
+	}
+	vandermonde := newMatrix(k+m, k)
+	for r := range vandermonde {
+		for c := range vandermonde[r] {
+			vandermonde[r][c] = pow(byte(r), c)
+		}
+	}
+	top, err := vandermonde[:k].invert()
+	if err != nil {
+		return nil, err
+	}
+	return &Code{k: k, m: m, encoding: vandermonde.mul(top)}, nil
+}
+
+// DataShards returns k.
+func (c *Code) DataShards() int {
+	return c.k
+}
+
+// ParityShards returns m.
+func (c *Code) ParityShards() int {
+	return c.m
+}
+
+// Split splits data into k data shards of equal size, padding with zeros
+// if needed, and computes the m parity shards. The data shards alias data
+// if no padding is needed.
+func (c *Code) Split(data []byte) [][]byte {
+	size := (len(data) + c.k - 1) / c.k
+	if size == 0 {
+		size = 1
+	}
+	if len(data) < c.k*size {
+		padded := make([]byte, c.k*size)
+		copy(padded, data)
+		data = padded
+	}
+	shards := make([][]byte, c.k+c.m)
+	for i := 0; i < c.k; i++ {
+		shards[i] = data[i*size : (i+1)*size : (i+1)*size]
+	}
+	for i := c.k; i < c.k+c.m; i++ {
+		shards[i] = make([]byte, size)
+	}
+	c.encode(c.encoding[c.k:], shards[:c.k], shards[c.k:])
+	return shards
+}
+
+// encode sets each output to the linear combination of the inputs with
+// the coefficients in the corresponding row.
+func (c *Code) encode(rows matrix, inputs, outputs [][]byte) {
+	for o, output := range outputs {
+		for i := range output {
+			output[i] = 0
+		}
+		for i, input := range inputs {
+			coefficients := &mulTable[rows[o][i]]
+			for j, b := range input {
+				output[j] ^= coefficients[b]
+			}
+		}
+	}
+}
+
+// Reconstruct fills in the missing shards, i.e., the nil ones, from the
+// others. All shards that are present must have the same size. It fails
+// with ErrTooFewShards if fewer than k shards are present.
+func (c *Code) Reconstruct(shards [][]byte) error {
+	if len(shards) != c.k+c.m {
+		return fmt.Errorf("reedsolomon.Code.Reconstruct: got %d shards, want %d", len(shards), c.k+c.m)
+	}
+	var present []int
+	size := -1
+	for i, shard := range shards {
+		if shard == nil {
+			continue
+		}
+		if size == -1 {
+			size = len(shard)
+		} else if len(shard) != size {
+			return fmt.Errorf("reedsolomon.Code.Reconstruct: shard %d has size %d, want %d", i, len(shard), size)
+		}
+		present = append(present, i)
+	}
+	if len(present) == len(shards) {
+		return nil
+	}
+	if len(present) < c.k {
+		return fmt.Errorf("reedsolomon.Code.Reconstruct: %d of %d shards: %w", len(present), c.k, ErrTooFewShards)
+	}
+	present = present[:c.k]
+	// The present shards are the data shards multiplied by the
+	// corresponding rows of the encoding matrix; invert those rows.
+	sub := make(matrix, c.k)
+	inputs := make([][]byte, c.k)
+	for r, i := range present {
+		sub[r] = c.encoding[i]
+		inputs[r] = shards[i]
+	}
+	decoding, err := sub.invert()
+	if err != nil {
+		return err
+	}
+	var rows matrix
+	var outputs [][]byte
+	for i := 0; i < c.k; i++ {
+		if shards[i] == nil {
+			shards[i] = make([]byte, size)
+			rows = append(rows, decoding[i])
+			outputs = append(outputs, shards[i])
+		}
+	}
+	c.encode(rows, inputs, outputs)
+	rows, outputs = nil, nil
+	for i := c.k; i < c.k+c.m; i++ {
+		if shards[i] == nil {
+			shards[i] = make([]byte, size)
+			rows = append(rows, c.encoding[i])
+			outputs = append(outputs, shards[i])
+		}
+	}
+	c.encode(rows, shards[:c.k], outputs)
+	return nil
+}
+
+// Join concatenates the data shards, which must be present, and truncates
+// the result to the given size, removing the padding added by Split.
+func (c *Code) Join(shards [][]byte, size int) ([]byte, error) {
+	data := make([]byte, 0, size)
+	for i := 0; i < c.k && len(data) < size; i++ {
+		if shards[i] == nil {
+			return nil, fmt.Errorf("reedsolomon.Code.Join: data shard %d: %w", i, ErrTooFewShards)
+		}
+		data = append(data, shards[i]...)
+	}
+	if len(data) < size {
+		return nil, fmt.Errorf("reedsolomon.Code.Join: got %d bytes, want %d", len(data), size)
+	}
+	return data[:size], nil
+}
@@ -0,0 +1,105 @@
+package reedsolomon
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"testing"
+)
+
+func TestArithmetic(t *testing.T) {
+	for a := 1; a < 256; a++ {
+		if got := mulTable[a][inv(byte(a))]; got != 1 {
+			t.Fatalf("%d times its inverse is %d", a, got)
+		}
+	}
+	// x^7 times x is x^8, which reduces to x^4+x^3+x^2+1.
+	if got := mulTable[0x80][0x02]; got != 0x1d {
+		t.Errorf("got %#x, want %#x", got, 0x1d)
+	}
+}
+
+func TestCode(t *testing.T) {
+	for _, tc := range []struct {
+		k, m, size int
+	}{
+		{1, 1, 10},
+		{4, 2, 0},
+		{4, 2, 1},
+		{4, 2, 1000},
+		{4, 2, 1001},
+		{6, 3, 4096},
+		{10, 4, 333},
+	} {
+		c, err := New(tc.k, tc.m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := make([]byte, tc.size)
+		rand.Read(data)
+		shards := c.Split(append([]byte(nil), data...))
+		if len(shards) != tc.k+tc.m {
+			t.Fatalf("got %d shards, want %d", len(shards), tc.k+tc.m)
+		}
+		// Drop up to m shards, a different set for each first one.
+		for first := 0; first < tc.k+tc.m; first++ {
+			damaged := make([][]byte, len(shards))
+			copy(damaged, shards)
+			for i := 0; i < tc.m; i++ {
+				damaged[(first+i*(first+1))%len(damaged)] = nil
+			}
+			if err := c.Reconstruct(damaged); err != nil {
+				t.Fatalf("k=%d m=%d first=%d: %v", tc.k, tc.m, first, err)
+			}
+			for i := range shards {
+				if !bytes.Equal(damaged[i], shards[i]) {
+					t.Errorf("k=%d m=%d first=%d: shard %d differs", tc.k, tc.m, first, i)
+				}
+			}
+			got, err := c.Join(damaged, tc.size)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("k=%d m=%d first=%d: data differs", tc.k, tc.m, first)
+			}
+		}
+		if tc.m > 0 {
+			damaged := make([][]byte, len(shards))
+			copy(damaged, shards[tc.m+1:])
+			if err := c.Reconstruct(damaged); !errors.Is(err, ErrTooFewShards) {
+				t.Errorf("got %v, want %v", err, ErrTooFewShards)
+			}
+		}
+	}
+}
+
+func TestAnyKShardsSuffice(t *testing.T) {
+	const k, m = 3, 3
+	c, err := New(k, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 300)
+	rand.Read(data)
+	shards := c.Split(data)
+	for subset := 0; subset < 1<<(k+m); subset++ {
+		var present int
+		damaged := make([][]byte, k+m)
+		for i := range damaged {
+			if subset&(1<<i) != 0 {
+				damaged[i] = shards[i]
+				present++
+			}
+		}
+		if present != k {
+			continue
+		}
+		if err := c.Reconstruct(damaged); err != nil {
+			t.Fatalf("subset %b: %v", subset, err)
+		}
+		if got, _ := c.Join(damaged, len(data)); !bytes.Equal(got, data) {
+			t.Errorf("subset %b: data differs", subset)
+		}
+	}
+}
@@ -0,0 +1,359 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrOffline is returned, wrapped, by a Breaker while its store is
+// unreachable.
+var ErrOffline = errors.New("offline")
+
+// Breaker is a store that fails fast while another store, e.g., S3, is
+// unreachable, rather than having each request wait for retries and time
+// out, which would freeze musclefs while it holds its locks.
+//
+// A request that fails because of the network, or a server error, or a
+// read that takes longer than a timeout, takes the breaker offline, and its
+// error wraps ErrOffline. Other errors, e.g., a missing item, a conflict,
+// or being denied access, are returned as they are. While offline, requests
+// fail immediately with ErrOffline, and the store is probed periodically in the background,
+// until it responds again. A read that times out keeps running in the
+// background. Writes aren't timed, since large values may take long to
+// upload, and they happen in the background anyway, e.g., in Paired.
+type Breaker struct {
+	store         Store
+	timeout       time.Duration
+	probeInterval time.Duration
+
+	mu      sync.Mutex
+	offline bool
+	since   time.Time
+	cause   error
+	// Closed while online, replaced when going offline.
+	online chan struct{}
+}
+
+var (
+	_ Store       = (*Breaker)(nil)
+	_ Lister      = (*Breaker)(nil)
+	_ RangeGetter = (*Breaker)(nil)
+	_ Stater      = (*Breaker)(nil)
+	_ Swapper     = (*Breaker)(nil)
+)
+
+// BreakerOption values influence the behavior of NewBreaker.
+type BreakerOption func(*Breaker)
+
+// WithBreakerTimeout sets how long a read can take before the store is
+// deemed unreachable, 30s by default. Listings aren't timed.
+func WithBreakerTimeout(d time.Duration) BreakerOption {
+	return func(b *Breaker) {
+		if d > 0 {
+			b.timeout = d
+		}
+	}
+}
+
+// WithProbeInterval sets how often the store is probed while offline, 15s
+// by default.
+func WithProbeInterval(d time.Duration) BreakerOption {
+	return func(b *Breaker) {
+		if d > 0 {
+			b.probeInterval = d
+		}
+	}
+}
+
+// NewBreaker creates a store that fails fast while the given store is
+// unreachable.
+func NewBreaker(store Store, opts ...BreakerOption) *Breaker {
+	b := &Breaker{
+		store:         store,
+		timeout:       30 * time.Second,
+		probeInterval: 15 * time.Second,
+		online:        make(chan struct{}),
+	}
+	close(b.online)
+	for _, o := range opts {
+		o(b)
+	}
+	return b
+}
+
+// BreakerStatus reports on the reachability of the store behind a Breaker.
+type BreakerStatus struct {
+	Offline bool
+	// When the store became unreachable, and the error that told.
+	Since time.Time
+	Cause error
+}
+
+// String formats the status as a line with a name and a value, like
+// PairedStats.
+func (s BreakerStatus) String() string {
+	if !s.Offline {
+		return "remote online\n"
+	}
+	return fmt.Sprintf("remote offline for %v: %v\n", time.Since(s.Since).Round(time.Second), s.Cause)
+}
+
+// Status returns whether the store is reachable.
+func (b *Breaker) Status() BreakerStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return BreakerStatus{Offline: b.offline, Since: b.since, Cause: b.cause}
+}
+
+// WaitOnline returns once the store is reachable, e.g., to resume copying
+// items to it (see WithOfflineWait).
+func (b *Breaker) WaitOnline() {
+	b.mu.Lock()
+	online := b.online
+	b.mu.Unlock()
+	<-online
+}
+
+// failure tells whether an error means that the store is unreachable: a
+// network error, a timeout, or a server error.
+func failure(err error) bool {
+	if err == nil || errors.As(err, new(callbackError)) {
+		return false
+	}
+	var (
+		opErr   *net.OpError
+		dnsErr  *net.DNSError
+		urlErr  *url.Error
+		timeout interface{ Timeout() bool }
+	)
+	switch {
+	case errors.As(err, &opErr), errors.As(err, &dnsErr), errors.As(err, &urlErr):
+		return true
+	case errors.As(err, &timeout) && timeout.Timeout():
+		return true
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, io.ErrUnexpectedEOF):
+		return true
+	}
+	// The AWS SDK doesn't support errors.As for the errors it wraps.
+	var failed awserr.RequestFailure
+	if errors.As(err, &failed) && failed.StatusCode() >= 500 {
+		return true
+	}
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) {
+		switch awsErr.Code() {
+		case request.ErrCodeRequestError, request.ErrCodeResponseTimeout, request.ErrCodeRead:
+			return true
+		}
+		return failure(awsErr.OrigErr())
+	}
+	return false
+}
+
+// timeoutError is the failure of a request that took too long.
+type timeoutError struct {
+	op      string
+	k       Key
+	timeout time.Duration
+}
+
+func (e timeoutError) Error() string {
+	return fmt.Sprintf("%s %q: no response within %v", e.op, e.k, e.timeout)
+}
+
+func (timeoutError) Timeout() bool { return true }
+
+// do runs a request, unless offline, within the timeout, if positive.
+func (b *Breaker) do(op string, k Key, timeout time.Duration, f func() error) error {
+	b.mu.Lock()
+	offline, since, cause := b.offline, b.since, b.cause
+	b.mu.Unlock()
+	if offline {
+		return errors.Wrapf(ErrOffline, "%s %q: remote unreachable since %s (%v)", op, k, since.Format(time.Stamp), cause)
+	}
+	if timeout <= 0 {
+		return b.check(f())
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- f()
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return b.check(err)
+	case <-timer.C:
+		return b.check(timeoutError{op: op, k: k, timeout: timeout})
+	}
+}
+
+// check takes the breaker offline if the error is a failure.
+func (b *Breaker) check(err error) error {
+	if !failure(err) {
+		return err
+	}
+	b.trip(err)
+	return fmt.Errorf("%v: %w", err, ErrOffline)
+}
+
+// trip takes the breaker offline, if online, and starts probing the store.
+func (b *Breaker) trip(cause error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.offline {
+		return
+	}
+	b.offline = true
+	b.since = time.Now()
+	b.cause = cause
+	b.online = make(chan struct{})
+	log.WithField("cause", cause).Warning("Remote store unreachable, going offline")
+	go b.probe()
+}
+
+// probe requests a missing item periodically, until the store responds.
+func (b *Breaker) probe() {
+	ticker := time.NewTicker(b.probeInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		done := make(chan error, 1)
+		go func() {
+			_, err := b.store.Get(Key("breaker-probe"))
+			done <- err
+		}()
+		var err error
+		select {
+		case err = <-done:
+		case <-time.After(b.timeout):
+			err = timeoutError{op: "probe", k: Key("breaker-probe"), timeout: b.timeout}
+		}
+		if failure(err) {
+			log.WithField("cause", err).Debug("Remote store still unreachable")
+			continue
+		}
+		b.mu.Lock()
+		log.WithField("duration", time.Since(b.since).Round(time.Second)).Info("Remote store reachable again, going online")
+		b.offline = false
+		b.cause = nil
+		close(b.online)
+		b.mu.Unlock()
+		return
+	}
+}
+
+// Get implements Store.
+func (b *Breaker) Get(k Key) (Value, error) {
+	var v Value
+	if err := b.do("get", k, b.timeout, func() (err error) {
+		v, err = b.store.Get(k)
+		return err
+	}); err != nil {
+		// The request may still be running, so leave v alone.
+		return nil, err
+	}
+	return v, nil
+}
+
+// Put implements Store.
+func (b *Breaker) Put(k Key, v Value) error {
+	return b.do("put", k, 0, func() error {
+		return b.store.Put(k, v)
+	})
+}
+
+// Delete implements Store.
+func (b *Breaker) Delete(k Key) error {
+	return b.do("delete", k, 0, func() error {
+		return b.store.Delete(k)
+	})
+}
+
+// GetRange implements RangeGetter, reading the whole value if the other
+// store doesn't support ranged reads.
+func (b *Breaker) GetRange(k Key, offset, length int64) (Value, error) {
+	var v Value
+	if err := b.do("get", k, b.timeout, func() (err error) {
+		if r, ok := b.store.(RangeGetter); ok {
+			v, err = r.GetRange(k, offset, length)
+			return err
+		}
+		if v, err = b.store.Get(k); err != nil {
+			return err
+		}
+		if offset > int64(len(v)) {
+			offset = int64(len(v))
+		}
+		if offset+length > int64(len(v)) {
+			length = int64(len(v)) - offset
+		}
+		v = v[offset : offset+length]
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// Stat implements Stater, if the other store does.
+func (b *Breaker) Stat(k Key) (ItemInfo, error) {
+	stater, ok := b.store.(Stater)
+	if !ok {
+		return ItemInfo{}, errors.Wrapf(ErrNotImplemented, "%T.Stat", b.store)
+	}
+	var info ItemInfo
+	if err := b.do("stat", k, b.timeout, func() (err error) {
+		info, err = stater.Stat(k)
+		return err
+	}); err != nil {
+		return ItemInfo{}, err
+	}
+	return info, nil
+}
+
+// Swap implements Swapper, if the other store does.
+func (b *Breaker) Swap(k Key, old, new Value) error {
+	swapper, ok := b.store.(Swapper)
+	if !ok {
+		return errors.Wrapf(ErrNotImplemented, "%T.Swap", b.store)
+	}
+	return b.do("swap", k, 0, func() error {
+		return swapper.Swap(k, old, new)
+	})
+}
+
+// List implements Lister, if the other store does. Errors returned by
+// the callback don't take the breaker offline.
+func (b *Breaker) List(ctx context.Context, prefix string, f func(ListItem) error) error {
+	lister, ok := b.store.(Lister)
+	if !ok {
+		return errors.Wrapf(ErrNotImplemented, "%T.List", b.store)
+	}
+	err := b.do("list", Key(prefix), 0, func() error {
+		return lister.List(ctx, prefix, func(item ListItem) error {
+			if err := f(item); err != nil {
+				return callbackError{err}
+			}
+			return nil
+		})
+	})
+	var cerr callbackError
+	if errors.As(err, &cerr) {
+		return cerr.error
+	}
+	return err
+}
+
+type callbackError struct {
+	error
+}
@@ -0,0 +1,137 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+func TestBreaker(t *testing.T) {
+	var mu sync.Mutex
+	var down, hang bool
+	unhang := make(chan struct{})
+	defer close(unhang)
+	inner := &InMemory{}
+	check := func() error {
+		mu.Lock()
+		d, h := down, hang
+		mu.Unlock()
+		if h {
+			<-unhang
+		}
+		if d {
+			return &net.OpError{Op: "dial", Net: "tcp", Err: syscall.EHOSTUNREACH}
+		}
+		return nil
+	}
+	b := NewBreaker(storeFuncs{
+		get: func(k Key) (Value, error) {
+			if err := check(); err != nil {
+				return nil, err
+			}
+			return inner.Get(k)
+		},
+		put: func(k Key, v Value) error {
+			if err := check(); err != nil {
+				return err
+			}
+			return inner.Put(k, v)
+		},
+	}, WithBreakerTimeout(20*time.Millisecond), WithProbeInterval(5*time.Millisecond))
+	set := func(d, h bool) {
+		mu.Lock()
+		down, hang = d, h
+		mu.Unlock()
+	}
+	waitOnline := func() {
+		t.Helper()
+		done := make(chan struct{})
+		go func() {
+			b.WaitOnline()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("still offline")
+		}
+	}
+	key := RandomPointer().Key()
+
+	if _, err := b.Get(key); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("got %v, want %v", err, ErrNotFound)
+	}
+	if b.Status().Offline {
+		t.Fatal("offline after a missing item")
+	}
+
+	t.Run("failure", func(t *testing.T) {
+		set(true, false)
+		if err := b.Put(key, Value("value")); !errors.Is(err, ErrOffline) {
+			t.Errorf("got %v, want %v", err, ErrOffline)
+		}
+		if status := b.Status(); !status.Offline || status.Cause == nil {
+			t.Errorf("got %+v, want offline", status)
+		}
+		if _, err := b.Get(key); !errors.Is(err, ErrOffline) {
+			t.Errorf("got %v, want %v", err, ErrOffline)
+		}
+		set(false, false)
+		waitOnline()
+		if err := b.Put(key, Value("value")); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("other errors", func(t *testing.T) {
+		for _, err := range []error{
+			&os.PathError{Op: "open", Path: "x", Err: syscall.EACCES},
+			awserr.NewRequestFailure(awserr.New("AccessDenied", "access denied", nil), 403, "id"),
+			fmt.Errorf("decoding: %w", errors.New("bad magic")),
+		} {
+			b := NewBreaker(storeFuncs{get: func(Key) (Value, error) { return nil, err }})
+			if _, got := b.Get(key); got != err {
+				t.Errorf("got %v, want %v", got, err)
+			}
+			if b.Status().Offline {
+				t.Errorf("%v: offline", err)
+			}
+		}
+		for _, err := range []error{
+			awserr.NewRequestFailure(awserr.New("SlowDown", "slow down", nil), 503, "id"),
+			awserr.New("RequestError", "send request failed", &net.DNSError{Err: "no such host", Name: "s3"}),
+		} {
+			b := NewBreaker(storeFuncs{get: func(Key) (Value, error) { return nil, err }}, WithProbeInterval(time.Hour))
+			if _, got := b.Get(key); !errors.Is(got, ErrOffline) {
+				t.Errorf("got %v, want %v", got, ErrOffline)
+			}
+		}
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		set(false, true)
+		start := time.Now()
+		if _, err := b.Get(key); !errors.Is(err, ErrOffline) {
+			t.Errorf("got %v, want %v", err, ErrOffline)
+		}
+		if _, err := b.Get(key); !errors.Is(err, ErrOffline) {
+			t.Errorf("got %v, want %v", err, ErrOffline)
+		}
+		if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+			t.Errorf("took %v, want failing fast", elapsed)
+		}
+		set(false, false)
+		unhang <- struct{}{}
+		waitOnline()
+		if v, err := b.Get(key); err != nil || string(v) != "value" {
+			t.Errorf("got %q and %v", v, err)
+		}
+	})
+}
@@ -0,0 +1,247 @@
+package storage
+
+import (
+	"container/list"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// Cache is a DiskStore with a capacity. Once the values it holds exceed the
+// capacity, it evicts the least recently used ones, except those that are
+// protected, e.g., because they haven't been propagated to the slow store
+// yet (see Paired). Recency survives restarts because accessing a value
+// also updates the modification time of the corresponding file.
+type Cache struct {
+	disk     *DiskStore
+	maxBytes int64
+
+	mu sync.Mutex
+	// Index of the cached values, the most recently used at the front.
+	lru     *list.List
+	entries map[Key]*list.Element
+	size    int64
+	guards  []func(Key) bool
+	stats   CacheStats
+
+	// If a pass of evict leaves the cache over capacity, because values
+	// are protected, don't scan them all again on each put, only once
+	// this time has passed or guards are added.
+	evictAfter time.Time
+}
+
+// How long to wait before scanning the cache for values to evict again,
+// after a scan found too many protected values.
+const evictRetryInterval = 10 * time.Second
+
+type cacheEntry struct {
+	key  Key
+	size int64
+}
+
+// CacheStats reports on the activity of a Cache.
+type CacheStats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+
+	// Number and total size of the cached values.
+	Items    int
+	Size     int64
+	MaxBytes int64
+}
+
+// HitRate returns the fraction of gets that found the value in the cache.
+func (s CacheStats) HitRate() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+func (s CacheStats) String() string {
+	return fmt.Sprintf("size %d/%d bytes in %d items, hit rate %.2f (%d hits, %d misses), %d evictions",
+		s.Size, s.MaxBytes, s.Items, s.HitRate(), s.Hits, s.Misses, s.Evictions)
+}
+
+// NewCache creates a cache in the given directory, indexing what's already
+// there. A non-positive capacity means the cache is unbounded.
+func NewCache(dir string, maxBytes int64) (*Cache, error) {
+	c := &Cache{
+		disk:     NewDiskStore(dir),
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		entries:  make(map[Key]*list.Element),
+	}
+	type file struct {
+		entry cacheEntry
+		mtime time.Time
+	}
+	var files []file
+	err := filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if os.IsNotExist(err) && p == dir {
+			return filepath.SkipDir
+		}
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() && !strings.HasPrefix(fi.Name(), tempFilePrefix) {
+			files = append(files, file{
+				entry: cacheEntry{key: Key(fi.Name()), size: fi.Size()},
+				mtime: fi.ModTime(),
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "indexing cache %q", dir)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].mtime.After(files[j].mtime)
+	})
+	for _, f := range files {
+		entry := f.entry
+		c.entries[entry.key] = c.lru.PushBack(&entry)
+		c.size += entry.size
+	}
+	return c, nil
+}
+
+// Protect adds a function telling which values must not be evicted.
+func (c *Cache) Protect(guard func(Key) bool) {
+	c.mu.Lock()
+	c.guards = append(c.guards, guard)
+	c.evictAfter = time.Time{}
+	c.mu.Unlock()
+}
+
+func (c *Cache) Get(k Key) (Value, error) {
+	v, err := c.disk.Get(k)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if errors.Is(err, ErrNotFound) {
+		c.stats.Misses++
+		c.remove(k)
+		return nil, err
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.stats.Hits++
+	c.touch(k, int64(len(v)))
+	now := time.Now()
+	if err := os.Chtimes(c.disk.pathFor(k), now, now); err != nil {
+		log.WithFields(log.Fields{
+			"key":   k,
+			"cause": err.Error(),
+		}).Debug("Could not update cache item modification time")
+	}
+	return v, nil
+}
+
+// Contains tells whether the cache holds a value for the key, without
+// reading it.
+func (c *Cache) Contains(k Key) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.entries[k]
+	return ok
+}
+
+func (c *Cache) Put(k Key, v Value) error {
+	if err := c.disk.Put(k, v); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.touch(k, int64(len(v)))
+	c.evict()
+	return nil
+}
+
+func (c *Cache) Delete(k Key) error {
+	err := c.disk.Delete(k)
+	c.mu.Lock()
+	c.remove(k)
+	c.mu.Unlock()
+	return err
+}
+
+// Stats returns a snapshot of the cache statistics.
+func (c *Cache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := c.stats
+	s.Items = len(c.entries)
+	s.Size = c.size
+	s.MaxBytes = c.maxBytes
+	return s
+}
+
+// Pre-condition: c.mu is locked.
+func (c *Cache) touch(k Key, size int64) {
+	if e, ok := c.entries[k]; ok {
+		entry := e.Value.(*cacheEntry)
+		c.size += size - entry.size
+		entry.size = size
+		c.lru.MoveToFront(e)
+		return
+	}
+	c.entries[k] = c.lru.PushFront(&cacheEntry{key: k, size: size})
+	c.size += size
+}
+
+// Pre-condition: c.mu is locked.
+func (c *Cache) remove(k Key) {
+	if e, ok := c.entries[k]; ok {
+		c.size -= e.Value.(*cacheEntry).size
+		c.lru.Remove(e)
+		delete(c.entries, k)
+	}
+}
+
+// evict removes the least recently used values, except protected ones and
+// the most recently used one, until the cache is within capacity.
+// Pre-condition: c.mu is locked.
+func (c *Cache) evict() {
+	if c.maxBytes <= 0 || c.size <= c.maxBytes || time.Now().Before(c.evictAfter) {
+		return
+	}
+	for e := c.lru.Back(); c.size > c.maxBytes && e != nil && e != c.lru.Front(); {
+		prev := e.Prev()
+		entry := e.Value.(*cacheEntry)
+		if !c.protected(entry.key) {
+			if err := c.disk.Delete(entry.key); err != nil && !errors.Is(err, ErrNotFound) {
+				log.WithFields(log.Fields{
+					"key":   entry.key,
+					"cause": err.Error(),
+				}).Warning("Could not evict item from the cache")
+			} else {
+				c.size -= entry.size
+				c.lru.Remove(e)
+				delete(c.entries, entry.key)
+				c.stats.Evictions++
+			}
+		}
+		e = prev
+	}
+	if c.size > c.maxBytes {
+		c.evictAfter = time.Now().Add(evictRetryInterval)
+	}
+}
+
+func (c *Cache) protected(k Key) bool {
+	for _, guard := range c.guards {
+		if guard(k) {
+			return true
+		}
+	}
+	return false
+}
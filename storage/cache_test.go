@@ -0,0 +1,164 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestCache(t *testing.T) {
+	key := func(i int) Key {
+		return Key(fmt.Sprintf("%064x", i))
+	}
+	value := make(Value, 100)
+	fill := func(t *testing.T, c *Cache, n int) {
+		t.Helper()
+		for i := 0; i < n; i++ {
+			if err := c.Put(key(i), value); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	cached := func(c *Cache, i int) bool {
+		ok, _ := c.disk.Contains(key(i))
+		return ok
+	}
+	t.Run("least recently used values are evicted", func(t *testing.T) {
+		c, err := NewCache(t.TempDir(), 350)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fill(t, c, 3)
+		if _, err := c.Get(key(0)); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Put(key(3), value); err != nil {
+			t.Fatal(err)
+		}
+		if cached(c, 1) {
+			t.Error("least recently used value not evicted")
+		}
+		for _, i := range []int{0, 2, 3} {
+			if !cached(c, i) {
+				t.Errorf("%d: evicted", i)
+			}
+		}
+		s := c.Stats()
+		if s.Size != 300 || s.Items != 3 || s.Evictions != 1 {
+			t.Errorf("got %v", s)
+		}
+	})
+	t.Run("protected values are not evicted", func(t *testing.T) {
+		c, err := NewCache(t.TempDir(), 250)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Protect(func(k Key) bool { return k == key(0) })
+		fill(t, c, 4)
+		if !cached(c, 0) {
+			t.Error("protected value evicted")
+		}
+		if cached(c, 1) || cached(c, 2) {
+			t.Error("unprotected values not evicted")
+		}
+	})
+	t.Run("everything protected", func(t *testing.T) {
+		c, err := NewCache(t.TempDir(), 150)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Protect(func(Key) bool { return true })
+		fill(t, c, 3)
+		if s := c.Stats(); s.Items != 3 || s.Evictions != 0 {
+			t.Errorf("got %v", s)
+		}
+	})
+	t.Run("protected values aren't scanned on each put", func(t *testing.T) {
+		c, err := NewCache(t.TempDir(), 150)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var calls int
+		c.Protect(func(Key) bool {
+			calls++
+			return true
+		})
+		fill(t, c, 10)
+		// Only the put going over capacity scans values.
+		if calls != 1 {
+			t.Errorf("got %d guard calls, want 1", calls)
+		}
+		c.Protect(func(Key) bool { return false })
+		calls = 0
+		fill(t, c, 1)
+		if calls != 9 {
+			t.Errorf("got %d guard calls after adding a guard, want 9", calls)
+		}
+	})
+	t.Run("hit rate", func(t *testing.T) {
+		c, err := NewCache(t.TempDir(), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fill(t, c, 1)
+		for i := 0; i < 4; i++ {
+			if _, err := c.Get(key(i)); i > 0 && !errors.Is(err, ErrNotFound) {
+				t.Errorf("got %v, want %v", err, ErrNotFound)
+			}
+		}
+		if got := c.Stats().HitRate(); got != 0.25 {
+			t.Errorf("got %v, want 0.25", got)
+		}
+	})
+	t.Run("recency survives restarts", func(t *testing.T) {
+		dir := t.TempDir()
+		c, err := NewCache(dir, 350)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fill(t, c, 3)
+		// Modification times might have a coarse granularity.
+		time.Sleep(10 * time.Millisecond)
+		if _, err := c.Get(key(0)); err != nil {
+			t.Fatal(err)
+		}
+		c, err = NewCache(dir, 350)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s := c.Stats(); s.Size != 300 {
+			t.Errorf("got %v", s)
+		}
+		if err := c.Put(key(3), value); err != nil {
+			t.Fatal(err)
+		}
+		if !cached(c, 0) {
+			t.Error("recently used value evicted")
+		}
+	})
+	t.Run("pending items are protected", func(t *testing.T) {
+		c, err := NewCache(t.TempDir(), 150)
+		if err != nil {
+			t.Fatal(err)
+		}
+		logPath, cleanup := disposablePathName(t)
+		defer cleanup()
+		p, err := NewPaired(c, NullStore{}, logPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Avoid propagation, so all items remain pending.
+		p.once.Do(func() {})
+		for i := 0; i < 3; i++ {
+			if err := p.Put(key(i), value); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for i := 0; i < 3; i++ {
+			if !cached(c, i) {
+				t.Errorf("%d: evicted", i)
+			}
+		}
+	})
+}
@@ -0,0 +1,272 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testStoreContract checks the behavior all Store implementations share.
+// If the store also implements Stater, Lister, RangeGetter or Swapper,
+// that's checked as well.
+// The store must be empty.
+func testStoreContract(t *testing.T, store Store) {
+	t.Run("get missing item", func(t *testing.T) {
+		if _, err := store.Get(RandomPointer().Key()); !errors.Is(err, ErrNotFound) {
+			t.Errorf("got %v, want %v", err, ErrNotFound)
+		}
+	})
+	t.Run("get what was put", func(t *testing.T) {
+		key := RandomPointer().Key()
+		for _, value := range []Value{Value("first"), Value("second, overwriting the first"), Value{}} {
+			if err := store.Put(key, value); err != nil {
+				t.Fatal(err)
+			}
+			got, err := store.Get(key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, value) {
+				t.Errorf("got %q, want %q", got, value)
+			}
+		}
+	})
+	t.Run("get after delete", func(t *testing.T) {
+		key := RandomPointer().Key()
+		if err := store.Put(key, Value("value")); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.Delete(key); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.Get(key); !errors.Is(err, ErrNotFound) {
+			t.Errorf("got %v, want %v", err, ErrNotFound)
+		}
+		// Deleting again may succeed or report the item is missing.
+		if err := store.Delete(key); err != nil && !errors.Is(err, ErrNotFound) {
+			t.Errorf("got %v, want nil or %v", err, ErrNotFound)
+		}
+	})
+	if stater, ok := store.(Stater); ok {
+		t.Run("stat", func(t *testing.T) {
+			key := RandomPointer().Key()
+			if _, err := stater.Stat(key); !errors.Is(err, ErrNotFound) {
+				t.Errorf("got %v, want %v", err, ErrNotFound)
+			}
+			if err := store.Put(key, Value("12345")); err != nil {
+				t.Fatal(err)
+			}
+			info, err := stater.Stat(key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Some stores take more space than the value, e.g., Erasure.
+			if info.Size < 5 || info.Modified.IsZero() {
+				t.Errorf("got %+v", info)
+			}
+		})
+	}
+	if ranger, ok := store.(RangeGetter); ok {
+		t.Run("get range", func(t *testing.T) {
+			key := RandomPointer().Key()
+			if _, err := ranger.GetRange(key, 0, 1); !errors.Is(err, ErrNotFound) {
+				t.Errorf("got %v, want %v", err, ErrNotFound)
+			}
+			if err := store.Put(key, Value("0123456789")); err != nil {
+				t.Fatal(err)
+			}
+			for _, c := range []struct {
+				offset, length int64
+				want           string
+			}{
+				{0, 10, "0123456789"},
+				{3, 4, "3456"},
+				{8, 5, "89"},
+				{10, 1, ""},
+			} {
+				got, err := ranger.GetRange(key, c.offset, c.length)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(got) != c.want {
+					t.Errorf("offset %d length %d: got %q, want %q", c.offset, c.length, got, c.want)
+				}
+			}
+		})
+	}
+	if swapper, ok := store.(Swapper); ok {
+		t.Run("swap", func(t *testing.T) {
+			key := RandomPointer().Key()
+			steps := []struct {
+				old, new Value
+				conflict bool
+			}{
+				{Value("absent"), Value("first"), true},
+				{nil, Value("first"), false},
+				{nil, Value("second"), true},
+				{Value("other"), Value("second"), true},
+				{Value("first"), Value("second"), false},
+			}
+			for i, step := range steps {
+				err := swapper.Swap(key, step.old, step.new)
+				if step.conflict && !errors.Is(err, ErrConflict) {
+					t.Fatalf("step %d: got %v, want %v", i, err, ErrConflict)
+				}
+				if !step.conflict && err != nil {
+					t.Fatalf("step %d: %v", i, err)
+				}
+			}
+			if got, err := store.Get(key); err != nil {
+				t.Fatal(err)
+			} else if string(got) != "second" {
+				t.Errorf("got %q, want %q", got, "second")
+			}
+		})
+		t.Run("concurrent swaps", func(t *testing.T) {
+			key := RandomPointer().Key()
+			if err := swapper.Swap(key, nil, Value("start")); err != nil {
+				t.Fatal(err)
+			}
+			const n = 8
+			errs := make([]error, n)
+			var wg sync.WaitGroup
+			for i := 0; i < n; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					errs[i] = swapper.Swap(key, Value("start"), Value(fmt.Sprint(i)))
+				}(i)
+			}
+			wg.Wait()
+			winner := -1
+			for i, err := range errs {
+				switch {
+				case err == nil && winner == -1:
+					winner = i
+				case err == nil:
+					t.Errorf("swaps %d and %d both succeeded", winner, i)
+				case !errors.Is(err, ErrConflict):
+					t.Errorf("swap %d: %v", i, err)
+				}
+			}
+			if winner == -1 {
+				t.Fatal("no swap succeeded")
+			}
+			if got, err := store.Get(key); err != nil {
+				t.Fatal(err)
+			} else if string(got) != fmt.Sprint(winner) {
+				t.Errorf("got %q, want %q", got, fmt.Sprint(winner))
+			}
+		})
+	}
+	if lister, ok := store.(Lister); ok {
+		t.Run("list", func(t *testing.T) {
+			list := func(ctx context.Context, prefix string) (map[Key]ListItem, error) {
+				items := make(map[Key]ListItem)
+				err := lister.List(ctx, prefix, func(item ListItem) error {
+					if _, ok := items[item.Key]; ok {
+						t.Errorf("%q: listed twice", item.Key)
+					}
+					items[item.Key] = item
+					return nil
+				})
+				return items, err
+			}
+			want := make(map[Key]int)
+			if items, err := list(context.Background(), ""); err != nil {
+				t.Fatal(err)
+			} else {
+				for key := range items {
+					want[key] = -1
+				}
+			}
+			for i := 0; i < 25; i++ {
+				key := RandomPointer().Key()
+				if i%5 == 0 {
+					key = "zz" + key[2:]
+				}
+				value := Value(fmt.Sprint(i))
+				if err := store.Put(key, value); err != nil {
+					t.Fatal(err)
+				}
+				want[key] = len(value)
+			}
+			got, err := list(context.Background(), "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			for key, size := range want {
+				if item, ok := got[key]; !ok {
+					t.Errorf("%q: not listed", key)
+				} else if item.Size < int64(size) {
+					t.Errorf("%q: got size %d, want at least %d", key, item.Size, size)
+				}
+			}
+			if len(got) != len(want) {
+				t.Errorf("got %d, want %d keys", len(got), len(want))
+			}
+			got, err = list(context.Background(), "zz")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != 5 {
+				t.Errorf("got %d, want 5 keys with prefix", len(got))
+			}
+			for key := range got {
+				if !strings.HasPrefix(string(key), "zz") {
+					t.Errorf("%q: listed despite the prefix", key)
+				}
+			}
+			errStop := errors.New("stop")
+			var calls int
+			if err := lister.List(context.Background(), "", func(ListItem) error {
+				calls++
+				return errStop
+			}); !errors.Is(err, errStop) {
+				t.Errorf("got %v, want %v", err, errStop)
+			}
+			if calls != 1 {
+				t.Errorf("got %d calls after an error, want 1", calls)
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			if _, err := list(ctx, ""); !errors.Is(err, context.Canceled) {
+				t.Errorf("got %v, want %v", err, context.Canceled)
+			}
+		})
+	}
+}
+
+func TestStoreContract(t *testing.T) {
+	t.Run("disk", func(t *testing.T) {
+		testStoreContract(t, NewDiskStore(t.TempDir()))
+	})
+	t.Run("in memory", func(t *testing.T) {
+		testStoreContract(t, &InMemory{})
+	})
+	t.Run("mirror", func(t *testing.T) {
+		m, err := NewMirror([]Store{NewDiskStore(t.TempDir()), NewDiskStore(t.TempDir())}, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testStoreContract(t, m)
+	})
+	t.Run("breaker", func(t *testing.T) {
+		testStoreContract(t, NewBreaker(NewDiskStore(t.TempDir())))
+	})
+	t.Run("erasure", func(t *testing.T) {
+		var stores []Store
+		for i := 0; i < 3; i++ {
+			stores = append(stores, NewDiskStore(t.TempDir()))
+		}
+		e, err := NewErasure(stores, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testStoreContract(t, e)
+	})
+}
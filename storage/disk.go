@@ -1,10 +1,14 @@
 package storage
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"syscall"
 
 	"github.com/pkg/errors"
@@ -14,6 +18,12 @@ type DiskStore struct {
 	dir string
 }
 
+var (
+	_ Lister      = (*DiskStore)(nil)
+	_ RangeGetter = (*DiskStore)(nil)
+	_ Swapper     = (*DiskStore)(nil)
+)
+
 func NewDiskStore(dir string) *DiskStore {
 	return &DiskStore{dir: dir}
 }
@@ -26,9 +36,29 @@ func (s *DiskStore) Get(k Key) (Value, error) {
 	return b, err
 }
 
+// GetRange implements RangeGetter.
+func (s *DiskStore) GetRange(k Key, offset, length int64) (Value, error) {
+	f, err := os.Open(s.pathFor(k))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%q: %w", k, ErrNotFound)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+	b := make([]byte, length)
+	n, err := f.ReadAt(b, offset)
+	if err == io.EOF {
+		err = nil
+	}
+	return b[:n], err
+}
+
+// Put writes the value to a temporary file and renames it into place, so
+// that a crash or power loss can't leave a partially written value behind.
 func (s *DiskStore) Put(k Key, v Value) error {
 	p := s.pathFor(k)
-	err := ioutil.WriteFile(p, v, 0666)
+	err := writeFileAtomically(p, v)
 	if err != nil {
 		if !os.IsNotExist(err) {
 			return err
@@ -36,11 +66,71 @@ func (s *DiskStore) Put(k Key, v Value) error {
 		if err = os.MkdirAll(filepath.Dir(p), 0777); err != nil {
 			return err
 		}
-		return ioutil.WriteFile(p, v, 0666)
+		return writeFileAtomically(p, v)
 	}
 	return nil
 }
 
+// Prefixes of temporary files and of lock files, which ForEach skips.
+const (
+	tempFilePrefix = ".tmp-"
+	lockFilePrefix = ".lock-"
+)
+
+// Swap implements Swapper. Concurrent swaps of the same item, also from
+// other processes, are serialized by an advisory lock on a file next to the
+// item; the new value is written like in Put. Lock files are left behind,
+// since removing them would race with other swaps. Note that Put doesn't
+// take the lock, so it must not be used on the same items.
+func (s *DiskStore) Swap(k Key, old, new Value) error {
+	p := s.pathFor(k)
+	if err := os.MkdirAll(filepath.Dir(p), 0777); err != nil {
+		return err
+	}
+	lock, err := os.OpenFile(filepath.Join(filepath.Dir(p), lockFilePrefix+string(k)), os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+	// Closing the file releases the lock.
+	defer func() { _ = lock.Close() }()
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		return errors.Wrapf(err, "could not lock %v", k)
+	}
+	current, err := ioutil.ReadFile(p)
+	switch {
+	case os.IsNotExist(err):
+		if old != nil {
+			return fmt.Errorf("%q: missing: %w", k, ErrConflict)
+		}
+	case err != nil:
+		return err
+	case old == nil || !bytes.Equal(current, old):
+		return fmt.Errorf("%q: value changed: %w", k, ErrConflict)
+	}
+	return writeFileAtomically(p, new)
+}
+
+func writeFileAtomically(pathname string, contents []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(pathname), tempFilePrefix)
+	if err != nil {
+		return err
+	}
+	// Best effort, only needed if renaming doesn't happen.
+	defer func() { _ = os.Remove(f.Name()) }()
+	if _, err := f.Write(contents); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), pathname)
+}
+
 func (s *DiskStore) Delete(k Key) error {
 	err := os.Remove(s.pathFor(k))
 	if err != nil {
@@ -61,7 +151,7 @@ func (s *DiskStore) ForEach(cb func(Key) error) error {
 		if err != nil {
 			return err
 		}
-		if !fi.IsDir() {
+		if !fi.IsDir() && !strings.HasPrefix(fi.Name(), tempFilePrefix) && !strings.HasPrefix(fi.Name(), lockFilePrefix) {
 			kk = append(kk, Key(filepath.Base(p)))
 		}
 		return nil
@@ -77,6 +167,48 @@ func (s *DiskStore) ForEach(cb func(Key) error) error {
 	return nil
 }
 
+// List implements Lister. If the prefix determines the directory holding
+// the matching items, only that directory is walked.
+func (s *DiskStore) List(ctx context.Context, prefix string, f func(ListItem) error) error {
+	root := s.dir
+	if len(prefix) >= 2 && !strings.ContainsAny(prefix[:2], "./\\") {
+		root = filepath.Join(s.dir, prefix[:2])
+	}
+	return filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			// Deleted while walking, or never created.
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		name := fi.Name()
+		if fi.IsDir() || !strings.HasPrefix(name, prefix) ||
+			strings.HasPrefix(name, tempFilePrefix) || strings.HasPrefix(name, lockFilePrefix) {
+			return nil
+		}
+		return f(ListItem{
+			Key:      Key(name),
+			ItemInfo: ItemInfo{Size: fi.Size(), Modified: fi.ModTime()},
+		})
+	})
+}
+
+// Stat implements Stater.
+func (s *DiskStore) Stat(k Key) (ItemInfo, error) {
+	fi, err := os.Stat(s.pathFor(k))
+	if os.IsNotExist(err) {
+		return ItemInfo{}, fmt.Errorf("%q: %w", k, ErrNotFound)
+	}
+	if err != nil {
+		return ItemInfo{}, err
+	}
+	return ItemInfo{Size: fi.Size(), Modified: fi.ModTime()}, nil
+}
+
 func (s *DiskStore) Contains(k Key) (bool, error) {
 	_, err := os.Stat(s.pathFor(k))
 	if os.IsNotExist(err) {
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"testing"
 	"testing/quick"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/pkg/errors"
@@ -135,4 +136,22 @@ func TestDiskStore(t *testing.T) {
 			t.Error(err)
 		}
 	})
+	t.Run("stat reports size and modification time", func(t *testing.T) {
+		store := NewDiskStore(t.TempDir())
+		key := RandomPointer().Key()
+		if _, err := store.Stat(key); !errors.Is(err, ErrNotFound) {
+			t.Errorf("got %v, want %v", err, ErrNotFound)
+		}
+		before := time.Now().Add(-time.Second)
+		if err := store.Put(key, Value("12345")); err != nil {
+			t.Fatal(err)
+		}
+		info, err := store.Stat(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size != 5 || info.Modified.Before(before) {
+			t.Errorf("got %+v", info)
+		}
+	})
 }
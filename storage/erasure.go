@@ -0,0 +1,375 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"hash/crc32"
+
+	"github.com/nicolagi/muscle/internal/reedsolomon"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// Erasure is a store that splits each value into k data shards, computes
+// m parity shards with a Reed-Solomon code, and writes each of the k+m
+// shards to a different store, under the value's key. Any k shards
+// suffice to reconstruct the value, so up to m stores can be lost, at the
+// cost of (k+m)/k times the size of the values, rather than the multiple
+// copies of a Mirror.
+//
+// Puts must succeed on all stores, so that there's no window in which
+// fewer than k+m shards exist; when used as the slow store of a Paired,
+// failed puts are retried. Shards lost afterwards are re-created by Scrub.
+type Erasure struct {
+	stores []Store
+	code   *reedsolomon.Code
+}
+
+var (
+	_ Store  = (*Erasure)(nil)
+	_ Lister = (*Erasure)(nil)
+	_ Stater = (*Erasure)(nil)
+)
+
+// Each shard starts with a header, big-endian:
+//
+//	format     1 byte
+//	k, m       1 byte each
+//	index      1 byte, of the shard, from 0 to k+m-1
+//	size       8 bytes, of the value
+//	value sum  8 bytes, the first of the value's SHA-256 hash
+//	shard sum  4 bytes, CRC-32C of the shard's data after the header
+//
+// The value sum prevents mixing shards of different values for the same
+// key, e.g., after an overwrite that only partially succeeded. The shard
+// sum detects corrupted shards, which are treated like missing ones.
+const (
+	shardFormat       = 1
+	shardHeaderLength = 24
+)
+
+var (
+	errCorruptShard = errors.New("corrupt shard")
+	crc32c          = crc32.MakeTable(crc32.Castagnoli)
+)
+
+type shardHeader struct {
+	index    int
+	size     uint64
+	valueSum uint64
+}
+
+// erasureShard is the outcome of reading a shard.
+type erasureShard struct {
+	header shardHeader
+	data   []byte
+	err    error
+}
+
+// ErasureScrubStats reports on a Scrub pass.
+type ErasureScrubStats struct {
+	// Number of keys found in any of the stores.
+	Keys int
+	// Number of shards re-created, and of those that couldn't be.
+	Rewritten int
+	Failed    int
+	// Keys of values that couldn't be reconstructed.
+	Lost []Key
+}
+
+// NewErasure creates a store writing k data shards, where k is dataShards,
+// and as many parity shards as there are remaining stores.
+func NewErasure(stores []Store, dataShards int) (*Erasure, error) {
+	if dataShards <= 0 || dataShards > len(stores) {
+		return nil, errors.Errorf("%d data shards for %d stores", dataShards, len(stores))
+	}
+	code, err := reedsolomon.New(dataShards, len(stores)-dataShards)
+	if err != nil {
+		return nil, err
+	}
+	return &Erasure{stores: stores, code: code}, nil
+}
+
+func (e *Erasure) encode(v Value) [][]byte {
+	sum := sha256.Sum256(v)
+	parts := e.code.Split(v)
+	shards := make([][]byte, len(parts))
+	for i, part := range parts {
+		shard := make([]byte, shardHeaderLength+len(part))
+		shard[0] = shardFormat
+		shard[1] = byte(e.code.DataShards())
+		shard[2] = byte(e.code.ParityShards())
+		shard[3] = byte(i)
+		binary.BigEndian.PutUint64(shard[4:], uint64(len(v)))
+		copy(shard[12:20], sum[:8])
+		binary.BigEndian.PutUint32(shard[20:], crc32.Checksum(part, crc32c))
+		copy(shard[shardHeaderLength:], part)
+		shards[i] = shard
+	}
+	return shards
+}
+
+func (e *Erasure) decodeShard(index int, shard []byte) (shardHeader, []byte, error) {
+	if len(shard) < shardHeaderLength ||
+		shard[0] != shardFormat ||
+		int(shard[1]) != e.code.DataShards() ||
+		int(shard[2]) != e.code.ParityShards() ||
+		int(shard[3]) != index {
+		return shardHeader{}, nil, errCorruptShard
+	}
+	data := shard[shardHeaderLength:]
+	if crc32.Checksum(data, crc32c) != binary.BigEndian.Uint32(shard[20:]) {
+		return shardHeader{}, nil, errCorruptShard
+	}
+	return shardHeader{
+		index:    index,
+		size:     binary.BigEndian.Uint64(shard[4:]),
+		valueSum: binary.BigEndian.Uint64(shard[12:]),
+	}, data, nil
+}
+
+// fetch reads the shards of an item concurrently. Unless all is true, it
+// returns as soon as k shards of the same value are read, leaving the
+// other shards zero.
+func (e *Erasure) fetch(k Key, all bool) []erasureShard {
+	type result struct {
+		index int
+		value Value
+		err   error
+	}
+	results := make(chan result, len(e.stores))
+	for i, s := range e.stores {
+		go func(i int, s Store) {
+			v, err := s.Get(k)
+			results <- result{index: i, value: v, err: err}
+		}(i, s)
+	}
+	shards := make([]erasureShard, len(e.stores))
+	counts := make(map[uint64]int)
+	for range e.stores {
+		r := <-results
+		shard := &shards[r.index]
+		if shard.err = r.err; shard.err != nil {
+			continue
+		}
+		shard.header, shard.data, shard.err = e.decodeShard(r.index, r.value)
+		if shard.err != nil {
+			continue
+		}
+		counts[shard.header.valueSum]++
+		if !all && counts[shard.header.valueSum] == e.code.DataShards() {
+			break
+		}
+	}
+	return shards
+}
+
+// reconstruct reconstructs the value from the shards read by fetch.
+func (e *Erasure) reconstruct(k Key, shards []erasureShard) (Value, uint64, error) {
+	counts := make(map[uint64]int)
+	var valueSum uint64
+	var found int
+	var failure error
+	for _, shard := range shards {
+		switch {
+		case shard.err == nil && shard.data != nil:
+			found++
+			counts[shard.header.valueSum]++
+			if counts[shard.header.valueSum] > counts[valueSum] {
+				valueSum = shard.header.valueSum
+			}
+		case errors.Is(shard.err, errCorruptShard):
+			found++
+		case shard.err != nil && !errors.Is(shard.err, ErrNotFound) && failure == nil:
+			failure = shard.err
+		}
+	}
+	if counts[valueSum] < e.code.DataShards() {
+		if failure != nil {
+			return nil, 0, failure
+		}
+		if found == 0 {
+			return nil, 0, errors.Wrapf(ErrNotFound, "key=%q in any store", k)
+		}
+		return nil, 0, errors.Wrapf(reedsolomon.ErrTooFewShards, "key=%q: %d shards of %d", k, counts[valueSum], e.code.DataShards())
+	}
+	parts := make([][]byte, len(shards))
+	var size uint64
+	for i, shard := range shards {
+		if shard.err == nil && shard.data != nil && shard.header.valueSum == valueSum {
+			parts[i] = shard.data
+			size = shard.header.size
+		}
+	}
+	if err := e.code.Reconstruct(parts); err != nil {
+		return nil, 0, errors.Wrapf(err, "key=%q", k)
+	}
+	v, err := e.code.Join(parts, int(size))
+	if err != nil {
+		return nil, 0, errors.Wrapf(err, "key=%q", k)
+	}
+	if sum := sha256.Sum256(v); binary.BigEndian.Uint64(sum[:8]) != valueSum {
+		return nil, 0, errors.Errorf("key=%q: reconstructed value does not match its checksum", k)
+	}
+	return v, valueSum, nil
+}
+
+// Get reads shards concurrently and reconstructs the value from the first
+// k consistent ones.
+func (e *Erasure) Get(k Key) (Value, error) {
+	v, _, err := e.reconstruct(k, e.fetch(k, false))
+	return v, err
+}
+
+// Put writes the shards to all stores. It fails if any store fails.
+func (e *Erasure) Put(k Key, v Value) error {
+	shards := e.encode(v)
+	errs := each(e.stores, func(i int, s Store) error {
+		return s.Put(k, shards[i])
+	})
+	for i, err := range errs {
+		if err != nil {
+			return errors.Wrapf(err, "shard %d", i)
+		}
+	}
+	return nil
+}
+
+// Delete deletes the shards from all stores. It fails if any store fails,
+// and with ErrNotFound if no store had a shard.
+func (e *Erasure) Delete(k Key) error {
+	errs := each(e.stores, func(_ int, s Store) error {
+		return s.Delete(k)
+	})
+	var missing int
+	for i, err := range errs {
+		if errors.Is(err, ErrNotFound) {
+			missing++
+		} else if err != nil {
+			return errors.Wrapf(err, "shard %d", i)
+		}
+	}
+	if missing == len(e.stores) {
+		return errors.Wrapf(ErrNotFound, "key=%q in any store", k)
+	}
+	return nil
+}
+
+// Stat implements Stater. The size is that of all shards, i.e., the space
+// taken by the item, and the modification time the latest of the shards'.
+func (e *Erasure) Stat(k Key) (ItemInfo, error) {
+	infos := make([]ItemInfo, len(e.stores))
+	errs := each(e.stores, func(i int, s Store) (err error) {
+		stater, ok := s.(Stater)
+		if !ok {
+			return errors.Wrapf(ErrNotImplemented, "%T.Stat", s)
+		}
+		infos[i], err = stater.Stat(k)
+		return err
+	})
+	var total ItemInfo
+	var missing int
+	for i, err := range errs {
+		if errors.Is(err, ErrNotFound) {
+			missing++
+			continue
+		}
+		if err != nil {
+			return ItemInfo{}, errors.Wrapf(err, "shard %d", i)
+		}
+		total.Size += infos[i].Size
+		if infos[i].Modified.After(total.Modified) {
+			total.Modified = infos[i].Modified
+		}
+	}
+	if missing == len(e.stores) {
+		return ItemInfo{}, errors.Wrapf(ErrNotFound, "key=%q in any store", k)
+	}
+	return total, nil
+}
+
+// List implements Lister. It lists the items found in any store, once,
+// described like by Stat. The items are only listed once all stores have
+// been listed.
+func (e *Erasure) List(ctx context.Context, prefix string, f func(ListItem) error) error {
+	listers, err := asListers(e.stores)
+	if err != nil {
+		return err
+	}
+	var keys []Key
+	infos := make(map[Key]*ItemInfo)
+	for _, l := range listers {
+		if err := l.List(ctx, prefix, func(item ListItem) error {
+			info := infos[item.Key]
+			if info == nil {
+				info = new(ItemInfo)
+				infos[item.Key] = info
+				keys = append(keys, item.Key)
+			}
+			info.Size += item.Size
+			if item.Modified.After(info.Modified) {
+				info.Modified = item.Modified
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+	}
+	for _, k := range keys {
+		if err := f(ListItem{Key: k, ItemInfo: *infos[k]}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Scrub reads all shards of all items, and re-creates those that are
+// missing or corrupt, or belong to a different value than the majority,
+// from the others.
+func (e *Erasure) Scrub() (stats ErasureScrubStats, err error) {
+	var keys []Key
+	if err := e.List(context.Background(), "", func(item ListItem) error {
+		keys = append(keys, item.Key)
+		return nil
+	}); err != nil {
+		return stats, err
+	}
+	for _, k := range keys {
+		stats.Keys++
+		shards := e.fetch(k, true)
+		v, valueSum, err := e.reconstruct(k, shards)
+		if errors.Is(err, ErrNotFound) {
+			// Deleted since listed.
+			continue
+		}
+		if err != nil {
+			stats.Lost = append(stats.Lost, k)
+			log.WithFields(log.Fields{
+				"key":   k,
+				"cause": err.Error(),
+			}).Warning("Could not reconstruct item")
+			continue
+		}
+		var encoded [][]byte
+		for i, shard := range shards {
+			if shard.err == nil && shard.header.valueSum == valueSum {
+				continue
+			}
+			if encoded == nil {
+				encoded = e.encode(v)
+			}
+			if err := e.stores[i].Put(k, encoded[i]); err != nil {
+				stats.Failed++
+				log.WithFields(log.Fields{
+					"key":   k,
+					"shard": i,
+					"cause": err.Error(),
+				}).Warning("Could not re-create shard")
+			} else {
+				stats.Rewritten++
+			}
+		}
+	}
+	return stats, nil
+}
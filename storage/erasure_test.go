@@ -0,0 +1,149 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/nicolagi/muscle/internal/reedsolomon"
+)
+
+func TestErasure(t *testing.T) {
+	const k, m = 4, 2
+	newErasure := func(t *testing.T) (*Erasure, []*DiskStore) {
+		t.Helper()
+		var disks []*DiskStore
+		var stores []Store
+		for i := 0; i < k+m; i++ {
+			disk := NewDiskStore(t.TempDir())
+			disks = append(disks, disk)
+			stores = append(stores, disk)
+		}
+		e, err := NewErasure(stores, k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return e, disks
+	}
+	value := make(Value, 10000)
+	rand.Read(value)
+	put := func(t *testing.T, s Store) Key {
+		t.Helper()
+		key := RandomPointer().Key()
+		if err := s.Put(key, value); err != nil {
+			t.Fatal(err)
+		}
+		return key
+	}
+	check := func(t *testing.T, s Store, key Key) {
+		t.Helper()
+		got, err := s.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, value) {
+			t.Error("value differs")
+		}
+	}
+	corrupt := func(t *testing.T, disk *DiskStore, key Key) {
+		t.Helper()
+		shard, err := disk.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		shard[len(shard)-1] ^= 1
+		if err := disk.Put(key, shard); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Run("shards are smaller than the value", func(t *testing.T) {
+		e, disks := newErasure(t)
+		key := put(t, e)
+		shard, err := disks[0].Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := len(value)/k + shardHeaderLength; len(shard) != want {
+			t.Errorf("got %d, want %d bytes", len(shard), want)
+		}
+	})
+	t.Run("any k shards suffice", func(t *testing.T) {
+		e, disks := newErasure(t)
+		key := put(t, e)
+		if err := disks[0].Delete(key); err != nil {
+			t.Fatal(err)
+		}
+		corrupt(t, disks[4], key)
+		check(t, e, key)
+		corrupt(t, disks[5], key)
+		if _, err := e.Get(key); !errors.Is(err, reedsolomon.ErrTooFewShards) {
+			t.Errorf("got %v, want %v", err, reedsolomon.ErrTooFewShards)
+		}
+	})
+	t.Run("shards of different values are not mixed", func(t *testing.T) {
+		e, disks := newErasure(t)
+		key := put(t, e)
+		// A partially failed overwrite.
+		other := make(Value, len(value))
+		for i, shard := range e.encode(other)[:m] {
+			if err := disks[i].Put(key, shard); err != nil {
+				t.Fatal(err)
+			}
+		}
+		check(t, e, key)
+	})
+	t.Run("scrub re-creates lost shards", func(t *testing.T) {
+		e, disks := newErasure(t)
+		a, b := put(t, e), put(t, e)
+		if err := disks[1].Delete(a); err != nil {
+			t.Fatal(err)
+		}
+		corrupt(t, disks[2], a)
+		if err := disks[5].Delete(b); err != nil {
+			t.Fatal(err)
+		}
+		// Beyond repair.
+		c := put(t, e)
+		for _, disk := range disks[:m+1] {
+			if err := disk.Delete(c); err != nil {
+				t.Fatal(err)
+			}
+		}
+		stats, err := e.Scrub()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.Keys != 3 || stats.Rewritten != 3 || stats.Failed != 0 || len(stats.Lost) != 1 || stats.Lost[0] != c {
+			t.Errorf("got %+v", stats)
+		}
+		// Now any m shards can be lost again.
+		for _, key := range []Key{a, b} {
+			for _, disk := range disks[:m] {
+				if err := disk.Delete(key); err != nil {
+					t.Fatal(err)
+				}
+			}
+			check(t, e, key)
+		}
+	})
+	t.Run("slow store of a paired store", func(t *testing.T) {
+		e, _ := newErasure(t)
+		logPath, cleanup := disposablePathName(t)
+		defer cleanup()
+		p, err := NewPaired(NewDiskStore(t.TempDir()), e, logPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.retryInterval = time.Millisecond
+		p.log.pollInterval = 5 * time.Millisecond
+		key := put(t, p)
+		for deadline := time.Now().Add(time.Second); p.IsPending(key); time.Sleep(10 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatal("item not propagated")
+			}
+		}
+		check(t, e, key)
+	})
+}
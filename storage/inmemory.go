@@ -1,6 +1,10 @@
 package storage
 
 import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
 	"sync"
 )
 
@@ -39,3 +43,58 @@ func (s *InMemory) Delete(k Key) error {
 	delete(s.m, k)
 	return nil
 }
+
+// Swap implements Swapper.
+func (s *InMemory) Swap(k Key, old, new Value) error {
+	s.Lock()
+	defer s.Unlock()
+	current, ok := s.m[k]
+	if !ok && old != nil {
+		return fmt.Errorf("%q: missing: %w", k, ErrConflict)
+	}
+	if ok && (old == nil || !bytes.Equal(current, old)) {
+		return fmt.Errorf("%q: value changed: %w", k, ErrConflict)
+	}
+	if s.m == nil {
+		s.m = make(map[Key]Value)
+	}
+	s.m[k] = new
+	return nil
+}
+
+// List implements Lister. Modification times aren't tracked. Items are
+// listed from a snapshot taken at the start.
+func (s *InMemory) List(ctx context.Context, prefix string, f func(ListItem) error) error {
+	var items []ListItem
+	s.Lock()
+	for k, v := range s.m {
+		if strings.HasPrefix(string(k), prefix) {
+			items = append(items, ListItem{Key: k, ItemInfo: ItemInfo{Size: int64(len(v))}})
+		}
+	}
+	s.Unlock()
+	for _, item := range items {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := f(item); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetRange implements RangeGetter.
+func (s *InMemory) GetRange(k Key, offset, length int64) (Value, error) {
+	v, err := s.Get(k)
+	if err != nil {
+		return nil, err
+	}
+	if offset > int64(len(v)) {
+		offset = int64(len(v))
+	}
+	if offset+length > int64(len(v)) {
+		length = int64(len(v)) - offset
+	}
+	return v[offset : offset+length], nil
+}
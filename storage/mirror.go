@@ -0,0 +1,366 @@
+package storage
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// Mirror is a store that replicates items to several stores (the mirrors),
+// e.g., an S3 bucket and a disk store on a NAS, so that none of them is a
+// single point of failure.
+//
+// Puts go to all mirrors concurrently and succeed if at least a quorum of
+// them succeeds. Gets go to all mirrors concurrently and return the first
+// value found; mirrors that turn out not to have the item get a copy in
+// the background. Items that are missing from some mirrors, e.g., because
+// they were down when the items were put, are copied over by Repair.
+//
+// Repair only copies missing items, it doesn't reconcile different values
+// for the same key. Since items are named after their contents, that only
+// matters for the few keys that are overwritten, e.g., the remote root
+// pointer: with a quorum less than the number of mirrors, a mirror that
+// missed an overwrite serves the stale value until the next one.
+type Mirror struct {
+	mirrors []Store
+	quorum  int
+}
+
+var (
+	_ Store   = (*Mirror)(nil)
+	_ Lister  = (*Mirror)(nil)
+	_ Stater  = (*Mirror)(nil)
+	_ Swapper = (*Mirror)(nil)
+)
+
+// MirrorRepairStats reports on a Repair pass.
+type MirrorRepairStats struct {
+	// Number of distinct keys found across mirrors.
+	Keys int
+	// Number of copies made, and of those that failed.
+	Copied int
+	Failed int
+}
+
+// NewMirror creates a store replicating items to the given mirrors. Puts
+// must succeed on quorum mirrors; a non-positive quorum means all of them.
+func NewMirror(mirrors []Store, quorum int) (*Mirror, error) {
+	if len(mirrors) == 0 {
+		return nil, errors.New("no mirrors")
+	}
+	if len(mirrors) > 64 {
+		// See the bit sets in Repair.
+		return nil, errors.Errorf("%d mirrors, want at most 64", len(mirrors))
+	}
+	if quorum <= 0 {
+		quorum = len(mirrors)
+	}
+	if quorum > len(mirrors) {
+		return nil, errors.Errorf("write quorum %d exceeds the number of mirrors, %d", quorum, len(mirrors))
+	}
+	return &Mirror{mirrors: mirrors, quorum: quorum}, nil
+}
+
+type mirrorResult struct {
+	index int
+	value Value
+	err   error
+}
+
+// Get returns the value from the first mirror that has it. It fails with
+// ErrNotFound only if all mirrors report the item missing; if any mirror
+// fails otherwise, it might have the item, so that error is returned.
+func (m *Mirror) Get(k Key) (Value, error) {
+	results := make(chan mirrorResult, len(m.mirrors))
+	for i, s := range m.mirrors {
+		go func(i int, s Store) {
+			v, err := s.Get(k)
+			results <- mirrorResult{index: i, value: v, err: err}
+		}(i, s)
+	}
+	var missing []int
+	var failure error
+	for n := 1; n <= len(m.mirrors); n++ {
+		r := <-results
+		switch {
+		case r.err == nil:
+			go m.readRepair(k, r.value, missing, results, len(m.mirrors)-n)
+			return r.value, nil
+		case errors.Is(r.err, ErrNotFound):
+			missing = append(missing, r.index)
+		case failure == nil:
+			failure = r.err
+		}
+	}
+	if failure != nil {
+		return nil, failure
+	}
+	return nil, errors.Wrapf(ErrNotFound, "key=%q in any mirror", k)
+}
+
+// readRepair waits for the outstanding results of a Get that found value v,
+// and copies the value to the mirrors that don't have it.
+func (m *Mirror) readRepair(k Key, v Value, missing []int, results chan mirrorResult, outstanding int) {
+	for ; outstanding > 0; outstanding-- {
+		if r := <-results; errors.Is(r.err, ErrNotFound) {
+			missing = append(missing, r.index)
+		}
+	}
+	for _, i := range missing {
+		if err := m.mirrors[i].Put(k, v); err != nil {
+			log.WithFields(log.Fields{
+				"key":    k,
+				"mirror": i,
+				"cause":  err.Error(),
+			}).Warning("Could not repair item in mirror")
+		}
+	}
+}
+
+// Put writes the item to all mirrors and waits for all of them, which
+// prevents an older value from overwriting a newer one in a slow mirror.
+// It fails if fewer than a quorum of mirrors succeed.
+func (m *Mirror) Put(k Key, v Value) error {
+	errs := each(m.mirrors, func(_ int, s Store) error {
+		return s.Put(k, v)
+	})
+	var ok int
+	var failure error
+	for i, err := range errs {
+		if err == nil {
+			ok++
+			continue
+		}
+		if failure == nil {
+			failure = err
+		}
+		log.WithFields(log.Fields{
+			"key":    k,
+			"mirror": i,
+			"cause":  err.Error(),
+		}).Warning("Could not write item to mirror")
+	}
+	if ok < m.quorum {
+		return errors.Wrapf(failure, "written to %d of %d mirrors, want %d", ok, len(m.mirrors), m.quorum)
+	}
+	return nil
+}
+
+// Swap implements Swapper. The first mirror, in configuration order,
+// arbitrates: the swap is done there, and must succeed, then the new value is
+// put to the other mirrors like in Put, and the quorum applies likewise.
+// Hence the first mirror must implement Swapper, and be available.
+func (m *Mirror) Swap(k Key, old, new Value) error {
+	swapper, ok := m.mirrors[0].(Swapper)
+	if !ok {
+		return errors.Wrapf(ErrNotImplemented, "%T.Swap", m.mirrors[0])
+	}
+	if err := swapper.Swap(k, old, new); err != nil {
+		return err
+	}
+	errs := each(m.mirrors[1:], func(_ int, s Store) error {
+		return s.Put(k, new)
+	})
+	written := 1
+	var failure error
+	for i, err := range errs {
+		if err == nil {
+			written++
+			continue
+		}
+		if failure == nil {
+			failure = err
+		}
+		log.WithFields(log.Fields{
+			"key":    k,
+			"mirror": i + 1,
+			"cause":  err.Error(),
+		}).Warning("Could not write item to mirror")
+	}
+	if written < m.quorum {
+		return errors.Wrapf(failure, "written to %d of %d mirrors, want %d", written, len(m.mirrors), m.quorum)
+	}
+	return nil
+}
+
+// Delete deletes the item from all mirrors. It fails if any mirror fails,
+// because a Repair would copy the item back from that mirror. It fails with
+// ErrNotFound if no mirror had the item.
+func (m *Mirror) Delete(k Key) error {
+	errs := each(m.mirrors, func(_ int, s Store) error {
+		return s.Delete(k)
+	})
+	var missing int
+	for _, err := range errs {
+		if errors.Is(err, ErrNotFound) {
+			missing++
+		} else if err != nil {
+			return err
+		}
+	}
+	if missing == len(m.mirrors) {
+		return errors.Wrapf(ErrNotFound, "key=%q in any mirror", k)
+	}
+	return nil
+}
+
+// Stat implements Stater. It describes the item in the first mirror, in
+// configuration order, that has it.
+func (m *Mirror) Stat(k Key) (ItemInfo, error) {
+	var failure error
+	for _, s := range m.mirrors {
+		stater, ok := s.(Stater)
+		if !ok {
+			return ItemInfo{}, errors.Wrapf(ErrNotImplemented, "%T.Stat", s)
+		}
+		info, err := stater.Stat(k)
+		if err == nil {
+			return info, nil
+		}
+		if !errors.Is(err, ErrNotFound) && failure == nil {
+			failure = err
+		}
+	}
+	if failure != nil {
+		return ItemInfo{}, failure
+	}
+	return ItemInfo{}, errors.Wrapf(ErrNotFound, "key=%q in any mirror", k)
+}
+
+// List implements Lister. It lists the items found in any mirror, once,
+// described as in the first mirror, in configuration order, that has them.
+func (m *Mirror) List(ctx context.Context, prefix string, f func(ListItem) error) error {
+	listers, err := asListers(m.mirrors)
+	if err != nil {
+		return err
+	}
+	return listUnion(ctx, listers, prefix, f)
+}
+
+// Repair lists the keys in all mirrors and copies the items missing from
+// some mirrors from one of those that have them.
+func (m *Mirror) Repair() (stats MirrorRepairStats, err error) {
+	listers, err := asListers(m.mirrors)
+	if err != nil {
+		return stats, err
+	}
+	// For each key, the set of mirrors holding it, as a bit set.
+	holders := make(map[Key]uint64)
+	for i, l := range listers {
+		if err := l.List(context.Background(), "", func(item ListItem) error {
+			holders[item.Key] |= 1 << uint(i)
+			return nil
+		}); err != nil {
+			return stats, err
+		}
+	}
+	stats.Keys = len(holders)
+	all := uint64(1)<<uint(len(m.mirrors)) - 1
+	for key, mask := range holders {
+		if mask == all {
+			continue
+		}
+		var value Value
+		for i, s := range m.mirrors {
+			if mask&(1<<uint(i)) == 0 {
+				continue
+			}
+			if value, err = s.Get(key); err == nil {
+				break
+			}
+		}
+		if err != nil {
+			// Most likely deleted since listed.
+			if !errors.Is(err, ErrNotFound) {
+				stats.Failed++
+				log.WithFields(log.Fields{
+					"key":   key,
+					"cause": err.Error(),
+				}).Warning("Could not read item to repair mirrors")
+			}
+			continue
+		}
+		for i, s := range m.mirrors {
+			if mask&(1<<uint(i)) != 0 {
+				continue
+			}
+			if err := s.Put(key, value); err != nil {
+				stats.Failed++
+				log.WithFields(log.Fields{
+					"key":    key,
+					"mirror": i,
+					"cause":  err.Error(),
+				}).Warning("Could not repair item in mirror")
+			} else {
+				stats.Copied++
+			}
+		}
+	}
+	return stats, nil
+}
+
+// RepairPeriodically runs Repair every interval, forever.
+func (m *Mirror) RepairPeriodically(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		stats, err := m.Repair()
+		if err != nil {
+			log.WithField("cause", err.Error()).Warning("Could not repair mirrors")
+			continue
+		}
+		log.WithFields(log.Fields{
+			"keys":   stats.Keys,
+			"copied": stats.Copied,
+			"failed": stats.Failed,
+		}).Info("Repaired mirrors")
+	}
+}
+
+// asListers returns the given stores as listers, if they all are.
+func asListers(stores []Store) ([]Lister, error) {
+	var listers []Lister
+	for _, s := range stores {
+		l, ok := s.(Lister)
+		if !ok {
+			return nil, errors.Wrapf(ErrNotImplemented, "%T.List", s)
+		}
+		listers = append(listers, l)
+	}
+	return listers, nil
+}
+
+// listUnion lists the items found in any of the listers, in order, once.
+func listUnion(ctx context.Context, listers []Lister, prefix string, f func(ListItem) error) error {
+	seen := make(map[Key]struct{})
+	for _, l := range listers {
+		if err := l.List(ctx, prefix, func(item ListItem) error {
+			if _, ok := seen[item.Key]; ok {
+				return nil
+			}
+			seen[item.Key] = struct{}{}
+			return f(item)
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// each calls f on all stores, and their indexes, concurrently, and returns
+// the errors, indexed like the stores.
+func each(stores []Store, f func(int, Store) error) []error {
+	errs := make([]error, len(stores))
+	var wg sync.WaitGroup
+	for i, s := range stores {
+		wg.Add(1)
+		go func(i int, s Store) {
+			defer wg.Done()
+			errs[i] = f(i, s)
+		}(i, s)
+	}
+	wg.Wait()
+	return errs
+}
@@ -0,0 +1,137 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+type brokenStore struct{}
+
+var errBroken = errors.New("broken")
+
+func (brokenStore) Get(Key) (Value, error) { return nil, errBroken }
+func (brokenStore) Put(Key, Value) error   { return errBroken }
+func (brokenStore) Delete(Key) error       { return errBroken }
+
+func TestMirror(t *testing.T) {
+	value := Value("value")
+	has := func(s Store, k Key) bool {
+		v, err := s.Get(k)
+		return err == nil && bytes.Equal(v, value)
+	}
+	t.Run("write quorum", func(t *testing.T) {
+		disk := NewDiskStore(t.TempDir())
+		m, err := NewMirror([]Store{disk, brokenStore{}}, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		k := RandomPointer().Key()
+		if err := m.Put(k, value); err != nil {
+			t.Fatal(err)
+		}
+		if !has(disk, k) {
+			t.Error("not written to working mirror")
+		}
+		m, err = NewMirror([]Store{disk, brokenStore{}}, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := m.Put(k, value); !errors.Is(err, errBroken) {
+			t.Errorf("got %v, want %v", err, errBroken)
+		}
+		if _, err := NewMirror([]Store{disk}, 2); err == nil {
+			t.Error("got nil, want error for quorum exceeding mirrors")
+		}
+	})
+	t.Run("get tolerates failures", func(t *testing.T) {
+		disk := NewDiskStore(t.TempDir())
+		m, err := NewMirror([]Store{brokenStore{}, disk}, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		k := RandomPointer().Key()
+		if _, err := m.Get(k); !errors.Is(err, errBroken) {
+			t.Errorf("got %v, want %v, as the broken mirror might have the item", err, errBroken)
+		}
+		if err := m.Put(k, value); err != nil {
+			t.Fatal(err)
+		}
+		if !has(m, k) {
+			t.Error("item not found")
+		}
+	})
+	t.Run("get copies item to mirrors missing it", func(t *testing.T) {
+		a, b := NewDiskStore(t.TempDir()), NewDiskStore(t.TempDir())
+		m, err := NewMirror([]Store{a, b}, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		k := RandomPointer().Key()
+		if err := b.Put(k, value); err != nil {
+			t.Fatal(err)
+		}
+		if !has(m, k) {
+			t.Fatal("item not found")
+		}
+		for deadline := time.Now().Add(time.Second); !has(a, k); time.Sleep(10 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatal("item not copied")
+			}
+		}
+	})
+	t.Run("delete fails if any mirror fails", func(t *testing.T) {
+		disk := NewDiskStore(t.TempDir())
+		m, err := NewMirror([]Store{disk, brokenStore{}}, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		k := RandomPointer().Key()
+		if err := m.Put(k, value); err != nil {
+			t.Fatal(err)
+		}
+		if err := m.Delete(k); !errors.Is(err, errBroken) {
+			t.Errorf("got %v, want %v", err, errBroken)
+		}
+	})
+	t.Run("repair", func(t *testing.T) {
+		stores := []Store{NewDiskStore(t.TempDir()), NewDiskStore(t.TempDir()), NewDiskStore(t.TempDir())}
+		m, err := NewMirror(stores, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var keys []Key
+		for i, s := range stores {
+			k := RandomPointer().Key()
+			if err := s.Put(k, value); err != nil {
+				t.Fatal(err)
+			}
+			keys = append(keys, k)
+			// Also one item in all but this mirror.
+			k = RandomPointer().Key()
+			for j, s := range stores {
+				if j != i {
+					if err := s.Put(k, value); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			keys = append(keys, k)
+		}
+		stats, err := m.Repair()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := (MirrorRepairStats{Keys: 6, Copied: 9}); stats != want {
+			t.Errorf("got %+v, want %+v", stats, want)
+		}
+		for i, s := range stores {
+			for _, k := range keys {
+				if !has(s, k) {
+					t.Errorf("mirror %d: %q missing", i, k)
+				}
+			}
+		}
+	})
+}
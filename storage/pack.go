@@ -0,0 +1,787 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nicolagi/muscle/config"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sync/errgroup"
+)
+
+// Codec encodes data before it's stored, and decodes it after it's read,
+// e.g., encrypting and decrypting it (see block.Factory).
+type Codec interface {
+	Encode([]byte) ([]byte, error)
+	Decode([]byte) ([]byte, error)
+}
+
+// Packed is a store that packs small items into larger pack objects in
+// another store, e.g., S3, so that a tree of many small files takes few
+// objects, and few requests to store. Larger items are stored as they are.
+//
+// A pack object, named "pack.<id>", is the concatenation of the values of
+// its items; its index object, named "pack.<id>.index", maps the keys of
+// the items to where their values are in the pack, and is encoded, i.e.,
+// encrypted, with a codec. The indexes of all packs are loaded when the
+// store is created, and reloaded when an item can't be found, since other
+// hosts may have written packs in the meantime, though not more often than
+// every few seconds, unless the pack of an indexed item is gone, e.g.,
+// repacked by another host. Values are read with
+// ranged reads, if the other store supports them. If more than one pack
+// has an item, e.g., because it was put twice, the latest pack wins, and a
+// packed item shadows an unpacked one, which is fine as long as keys are
+// derived from values, like those of blocks.
+//
+// Puts of small items go to the pack being filled, and return once the
+// pack and its index are stored, which happens when the pack reaches its
+// target size or some time after it was started, whichever comes first.
+// Hence, packs only fill up if puts are concurrent, e.g., from the many
+// propagation workers of a Paired.
+//
+// Deleting a packed item rewrites the index of its pack, so that the item
+// is gone, but its space is only reclaimed by Repack, which rewrites the
+// packs that are mostly garbage. DeleteMany rewrites each index once for
+// many items. Other hosts that have loaded the index
+// before the deletion can still read the item until they reload it.
+type Packed struct {
+	store  Store
+	codec  Codec
+	size   int
+	linger time.Duration
+
+	mu sync.Mutex
+	// Packs, by id, and the winning entry for each key.
+	packs   map[string]*packInfo
+	entries map[Key]packEntry
+	// The pack being filled, if any.
+	filling *packBuilder
+	// When the indexes were last reloaded, and the minimum time between
+	// reloads caused by missing items.
+	reloaded       time.Time
+	reloadInterval time.Duration
+	// Serializes reloads caused by missing items.
+	reloading sync.Mutex
+	// Serializes changes to stored indexes, by Delete and Repack.
+	rewriting sync.Mutex
+}
+
+var (
+	_ Store  = (*Packed)(nil)
+	_ Lister = (*Packed)(nil)
+	_ Stater = (*Packed)(nil)
+)
+
+const (
+	packPrefix      = "pack."
+	packIndexSuffix = ".index"
+	packIndexFormat = 1
+
+	// DefaultPackSize is the default target size of pack objects.
+	DefaultPackSize = 8 * 1024 * 1024
+
+	// Maximum number of items deleted concurrently by DeleteMany.
+	packDeleteConcurrency = 32
+)
+
+// Where an item's value is in a pack.
+type packEntry struct {
+	pack   string
+	offset int64
+	length int64
+}
+
+type packInfo struct {
+	id      string
+	created time.Time
+	size    int64
+	entries map[Key]packEntry
+	// When this store wrote the pack, if it did.
+	written time.Time
+}
+
+// A packBuilder collects the items of a pack being filled. Puts wait for
+// done to be closed, then find the outcome in err.
+type packBuilder struct {
+	id      string
+	created time.Time
+	buf     bytes.Buffer
+	entries map[Key]packEntry
+	once    sync.Once
+	done    chan struct{}
+	err     error
+}
+
+// PackRepackStats reports on a Repack pass.
+type PackRepackStats struct {
+	// Number of packs examined, rewritten and deleted (including those
+	// rewritten).
+	Packs     int
+	Rewritten int
+	Deleted   int
+	// Bytes reclaimed.
+	Freed int64
+}
+
+// PackedOption values influence the behavior of NewPacked.
+type PackedOption func(*Packed)
+
+// WithPackSize sets the target size of pack objects, DefaultPackSize if
+// not positive. Items of at least an eighth of that size aren't packed.
+func WithPackSize(n int) PackedOption {
+	return func(p *Packed) {
+		if n > 0 {
+			p.size = n
+		}
+	}
+}
+
+// WithPackLinger sets how long a pack is filled, at most, before it's
+// stored, 250ms by default.
+func WithPackLinger(d time.Duration) PackedOption {
+	return func(p *Packed) {
+		if d > 0 {
+			p.linger = d
+		}
+	}
+}
+
+// NewPacked creates a store packing items into the given store, which
+// must implement Lister, and loads the pack indexes, unless offline (see
+// Breaker).
+func NewPacked(store Store, codec Codec, opts ...PackedOption) (*Packed, error) {
+	if _, ok := store.(Lister); !ok {
+		return nil, errors.Wrapf(ErrNotImplemented, "%T.List", store)
+	}
+	p := &Packed{
+		store:   store,
+		codec:   codec,
+		size:    DefaultPackSize,
+		linger:  250 * time.Millisecond,
+		packs:   make(map[string]*packInfo),
+		entries: make(map[Key]packEntry),
+
+		reloadInterval: 10 * time.Second,
+	}
+	for _, o := range opts {
+		o(p)
+	}
+	if err := p.reload(); errors.Is(err, ErrOffline) {
+		// They'll be loaded on the first miss once online.
+		log.WithField("cause", err).Warning("Could not load pack indexes")
+	} else if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func packKey(id string) Key {
+	return Key(packPrefix + id)
+}
+
+func packIndexKey(id string) Key {
+	return Key(packPrefix + id + packIndexSuffix)
+}
+
+// reload loads the indexes of packs it doesn't know yet, and forgets about
+// packs that no longer exist.
+func (p *Packed) reload() error {
+	start := time.Now()
+	var ids []string
+	if err := p.store.(Lister).List(context.Background(), packPrefix, func(item ListItem) error {
+		if strings.HasSuffix(string(item.Key), packIndexSuffix) {
+			ids = append(ids, strings.TrimSuffix(strings.TrimPrefix(string(item.Key), packPrefix), packIndexSuffix))
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	found := make(map[string]*packInfo)
+	for _, id := range ids {
+		p.mu.Lock()
+		info := p.packs[id]
+		p.mu.Unlock()
+		if info == nil {
+			var err error
+			if info, err = p.loadIndex(id); errors.Is(err, ErrNotFound) {
+				// Deleted since listed.
+				continue
+			} else if err != nil {
+				return err
+			}
+		}
+		found[id] = info
+	}
+	p.mu.Lock()
+	for id, info := range p.packs {
+		// Keep the packs written while listing, which may not have been
+		// listed, and the latest version of the indexes already known,
+		// which Delete may have changed in the meantime.
+		if found[id] != nil || info.written.After(start) {
+			found[id] = info
+		}
+	}
+	p.packs = found
+	p.reloaded = start
+	p.mu.Unlock()
+	p.reindex()
+	return nil
+}
+
+// reloadMissing reloads the indexes after an item couldn't be found at the
+// given time, unless they have been reloaded since, e.g., for another item,
+// or were reloaded less than the reload interval before. It tells whether
+// the item should be looked up again.
+func (p *Packed) reloadMissing(missed time.Time) (bool, error) {
+	return p.reloadSince(missed, p.reloadInterval)
+}
+
+// reloadSince is like reloadMissing, with the given minimum time between
+// reloads.
+func (p *Packed) reloadSince(missed time.Time, interval time.Duration) (bool, error) {
+	p.reloading.Lock()
+	defer p.reloading.Unlock()
+	p.mu.Lock()
+	reloaded := p.reloaded
+	p.mu.Unlock()
+	if reloaded.After(missed) {
+		return true, nil
+	}
+	if time.Since(reloaded) < interval {
+		return false, nil
+	}
+	if err := p.reload(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// reindex recomputes the winning entry for each key.
+func (p *Packed) reindex() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var packs []*packInfo
+	for _, info := range p.packs {
+		packs = append(packs, info)
+	}
+	sort.Slice(packs, func(i, j int) bool {
+		if !packs[i].created.Equal(packs[j].created) {
+			return packs[i].created.Before(packs[j].created)
+		}
+		return packs[i].id < packs[j].id
+	})
+	p.entries = make(map[Key]packEntry)
+	for _, info := range packs {
+		for k, e := range info.entries {
+			p.entries[k] = e
+		}
+	}
+}
+
+// The index is laid out as follows, before encoding, with integers as
+// varints:
+//
+//	format     1 byte
+//	created    Unix time in nanoseconds
+//	size       of the pack
+//	count      of the entries, each being
+//	key length, key, offset, length
+func (p *Packed) loadIndex(id string) (*packInfo, error) {
+	encoded, err := p.store.Get(packIndexKey(id))
+	if err != nil {
+		return nil, err
+	}
+	b, err := p.codec.Decode(encoded)
+	if err != nil {
+		return nil, errors.Wrapf(err, "pack %s: decoding index", id)
+	}
+	malformed := errors.Errorf("pack %s: malformed index", id)
+	if len(b) == 0 || b[0] != packIndexFormat {
+		return nil, malformed
+	}
+	r := bytes.NewReader(b[1:])
+	var fields [3]int64
+	for i := range fields {
+		if fields[i], err = binary.ReadVarint(r); err != nil {
+			return nil, malformed
+		}
+	}
+	info := &packInfo{
+		id:      id,
+		created: time.Unix(0, fields[0]),
+		size:    fields[1],
+		entries: make(map[Key]packEntry),
+	}
+	for n := fields[2]; n > 0; n-- {
+		kl, err := binary.ReadVarint(r)
+		if err != nil || kl < 0 || kl > int64(r.Len()) {
+			return nil, malformed
+		}
+		k := make([]byte, kl)
+		_, _ = r.Read(k)
+		e := packEntry{pack: id}
+		if e.offset, err = binary.ReadVarint(r); err != nil {
+			return nil, malformed
+		}
+		if e.length, err = binary.ReadVarint(r); err != nil {
+			return nil, malformed
+		}
+		info.entries[Key(k)] = e
+	}
+	return info, nil
+}
+
+func (p *Packed) storeIndex(info *packInfo) error {
+	var b bytes.Buffer
+	var tmp [binary.MaxVarintLen64]byte
+	varint := func(n int64) {
+		b.Write(tmp[:binary.PutVarint(tmp[:], n)])
+	}
+	b.WriteByte(packIndexFormat)
+	varint(info.created.UnixNano())
+	varint(info.size)
+	varint(int64(len(info.entries)))
+	for k, e := range info.entries {
+		varint(int64(len(k)))
+		b.WriteString(string(k))
+		varint(e.offset)
+		varint(e.length)
+	}
+	encoded, err := p.codec.Encode(b.Bytes())
+	if err != nil {
+		return err
+	}
+	return p.store.Put(packIndexKey(info.id), encoded)
+}
+
+func newPackID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Get implements Store.
+func (p *Packed) Get(k Key) (Value, error) {
+	missed := time.Now()
+	v, indexed, err := p.getPacked(k)
+	if indexed && errors.Is(err, ErrNotFound) {
+		// The pack is gone, e.g., another host repacked it, so the item
+		// is likely in another pack. Not worth rate limiting the reload,
+		// which only failing to find items not indexed at all is.
+		if again, reloadErr := p.reloadSince(missed, 0); reloadErr != nil {
+			return nil, reloadErr
+		} else if again {
+			v, _, err = p.getPacked(k)
+		}
+	}
+	if !errors.Is(err, ErrNotFound) {
+		return v, err
+	}
+	if v, err := p.store.Get(k); !errors.Is(err, ErrNotFound) {
+		return v, err
+	}
+	if again, reloadErr := p.reloadMissing(missed); reloadErr != nil {
+		return nil, reloadErr
+	} else if !again {
+		return nil, err
+	}
+	v, _, err = p.getPacked(k)
+	return v, err
+}
+
+// getPacked reads a packed item. It also tells whether the item is in the
+// indexes, in which case ErrNotFound means its pack is gone.
+func (p *Packed) getPacked(k Key) (v Value, indexed bool, err error) {
+	p.mu.Lock()
+	e, ok := p.entries[k]
+	p.mu.Unlock()
+	if !ok {
+		return nil, false, errors.Wrapf(ErrNotFound, "key=%q in any pack", k)
+	}
+	if r, ok := p.store.(RangeGetter); ok {
+		v, err = r.GetRange(packKey(e.pack), e.offset, e.length)
+	} else if v, err = p.store.Get(packKey(e.pack)); err == nil && int64(len(v)) >= e.offset+e.length {
+		v = v[e.offset : e.offset+e.length]
+	}
+	if err != nil {
+		return nil, true, errors.Wrapf(err, "key=%q in pack %s", k, e.pack)
+	}
+	if int64(len(v)) != e.length {
+		return nil, true, errors.Errorf("key=%q in pack %s: got %d bytes, want %d", k, e.pack, len(v), e.length)
+	}
+	return v, true, nil
+}
+
+// Put implements Store. Small items are packed, and Put returns once
+// their pack is stored.
+func (p *Packed) Put(k Key, v Value) error {
+	if len(v) >= p.size/8 {
+		return p.store.Put(k, v)
+	}
+	p.mu.Lock()
+	b := p.filling
+	if b == nil {
+		id, err := newPackID()
+		if err != nil {
+			p.mu.Unlock()
+			return err
+		}
+		b = &packBuilder{
+			id:      id,
+			created: time.Now(),
+			entries: make(map[Key]packEntry),
+			done:    make(chan struct{}),
+		}
+		p.filling = b
+		time.AfterFunc(p.linger, func() { p.flush(b) })
+	}
+	b.entries[k] = packEntry{pack: b.id, offset: int64(b.buf.Len()), length: int64(len(v))}
+	b.buf.Write(v)
+	full := b.buf.Len() >= p.size
+	p.mu.Unlock()
+	if full {
+		go p.flush(b)
+	}
+	<-b.done
+	return b.err
+}
+
+// flush stores the pack, then its index, and wakes up the puts waiting
+// for it, once.
+func (p *Packed) flush(b *packBuilder) {
+	b.once.Do(func() {
+		p.mu.Lock()
+		if p.filling == b {
+			p.filling = nil
+		}
+		p.mu.Unlock()
+		info := &packInfo{
+			id:      b.id,
+			created: b.created,
+			size:    int64(b.buf.Len()),
+			entries: b.entries,
+		}
+		b.err = p.writePack(info, b.buf.Bytes())
+		close(b.done)
+	})
+}
+
+// writePack stores a pack and its index, in this order, so that an index
+// never refers to a missing pack, and makes its items available.
+func (p *Packed) writePack(info *packInfo, contents []byte) error {
+	if err := p.store.Put(packKey(info.id), contents); err != nil {
+		return errors.Wrapf(err, "pack %s", info.id)
+	}
+	if err := p.storeIndex(info); err != nil {
+		return errors.Wrapf(err, "pack %s: index", info.id)
+	}
+	info.written = time.Now()
+	p.mu.Lock()
+	p.packs[info.id] = info
+	p.mu.Unlock()
+	p.reindex()
+	return nil
+}
+
+// Delete implements Store. It removes the item from the indexes of all
+// packs that have it, and deletes the unpacked item, if any.
+func (p *Packed) Delete(k Key) error {
+	p.rewriting.Lock()
+	defer p.rewriting.Unlock()
+	packed, err := p.unindex([]Key{k})
+	if err != nil {
+		return err
+	}
+	err = p.store.Delete(k)
+	if errors.Is(err, ErrNotFound) && packed[k] {
+		return nil
+	}
+	return err
+}
+
+// DeleteMany is like Delete for each of the given items, but rewrites the
+// index of each pack once, rather than once per item, and deletes the
+// unpacked items concurrently. Items that don't exist are ignored.
+func (p *Packed) DeleteMany(keys []Key) error {
+	p.rewriting.Lock()
+	defer p.rewriting.Unlock()
+	if _, err := p.unindex(keys); err != nil {
+		return err
+	}
+	semc := make(chan struct{}, packDeleteConcurrency)
+	var g errgroup.Group
+	for _, k := range keys {
+		k := k
+		g.Go(func() error {
+			semc <- struct{}{}
+			defer func() { <-semc }()
+			if err := p.store.Delete(k); err != nil && !errors.Is(err, ErrNotFound) {
+				return errors.Wrapf(err, "key=%q", k)
+			}
+			return nil
+		})
+	}
+	return g.Wait()
+}
+
+// unindex removes the given items from the indexes of the packs that have
+// them, storing each changed index once, and tells which items were packed.
+// Pre-condition: p.rewriting is locked.
+func (p *Packed) unindex(keys []Key) (packed map[Key]bool, err error) {
+	packed = make(map[Key]bool)
+	for _, k := range keys {
+		packed[k] = false
+	}
+	p.mu.Lock()
+	var packs []string
+	for id, info := range p.packs {
+		for k := range packed {
+			if _, ok := info.entries[k]; ok {
+				packs = append(packs, id)
+				break
+			}
+		}
+	}
+	p.mu.Unlock()
+	for _, id := range packs {
+		p.mu.Lock()
+		info := p.packs[id]
+		if info == nil {
+			p.mu.Unlock()
+			continue
+		}
+		updated := *info
+		updated.entries = make(map[Key]packEntry, len(info.entries))
+		for key, e := range info.entries {
+			if _, ok := packed[key]; ok {
+				packed[key] = true
+			} else {
+				updated.entries[key] = e
+			}
+		}
+		p.mu.Unlock()
+		if err := p.storeIndex(&updated); err != nil {
+			return nil, errors.Wrapf(err, "pack %s: index", id)
+		}
+		p.mu.Lock()
+		if p.packs[id] == info {
+			p.packs[id] = &updated
+		}
+		p.mu.Unlock()
+	}
+	if len(packs) > 0 {
+		p.reindex()
+	}
+	return packed, nil
+}
+
+// Stat implements Stater. Packed items are described by their size and
+// the time their pack was created.
+func (p *Packed) Stat(k Key) (ItemInfo, error) {
+	stat := func() (ItemInfo, error) {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if e, ok := p.entries[k]; ok {
+			return ItemInfo{Size: e.length, Modified: p.packs[e.pack].created}, nil
+		}
+		return ItemInfo{}, errors.Wrapf(ErrNotFound, "key=%q in any pack", k)
+	}
+	missed := time.Now()
+	if info, err := stat(); err == nil {
+		return info, nil
+	}
+	stater, ok := p.store.(Stater)
+	if !ok {
+		return ItemInfo{}, errors.Wrapf(ErrNotImplemented, "%T.Stat", p.store)
+	}
+	info, err := stater.Stat(k)
+	if !errors.Is(err, ErrNotFound) {
+		return info, err
+	}
+	if again, reloadErr := p.reloadMissing(missed); reloadErr != nil {
+		return ItemInfo{}, reloadErr
+	} else if !again {
+		return ItemInfo{}, err
+	}
+	return stat()
+}
+
+// List implements Lister. It lists the packed items, then the unpacked
+// ones, but not the pack objects.
+func (p *Packed) List(ctx context.Context, prefix string, f func(ListItem) error) error {
+	if err := p.reload(); err != nil {
+		return err
+	}
+	var items []ListItem
+	p.mu.Lock()
+	for k, e := range p.entries {
+		if strings.HasPrefix(string(k), prefix) {
+			items = append(items, ListItem{Key: k, ItemInfo: ItemInfo{Size: e.length, Modified: p.packs[e.pack].created}})
+		}
+	}
+	p.mu.Unlock()
+	seen := make(map[Key]bool)
+	for _, item := range items {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := f(item); err != nil {
+			return err
+		}
+		seen[item.Key] = true
+	}
+	return p.store.(Lister).List(ctx, prefix, func(item ListItem) error {
+		if seen[item.Key] || strings.HasPrefix(string(item.Key), packPrefix) {
+			return nil
+		}
+		return f(item)
+	})
+}
+
+// Repack deletes the packs whose items have all been deleted or put again
+// in later packs, and rewrites those in which such items take more than
+// the given fraction of the space, so that only the other items are kept.
+// It also deletes packs without an index, that are at least a day old,
+// left over by puts that failed midway.
+func (p *Packed) Repack(garbage float64) (stats PackRepackStats, err error) {
+	p.rewriting.Lock()
+	defer p.rewriting.Unlock()
+	if err := p.reload(); err != nil {
+		return stats, err
+	}
+	p.mu.Lock()
+	var packs []*packInfo
+	for _, info := range p.packs {
+		packs = append(packs, info)
+	}
+	p.mu.Unlock()
+	for _, info := range packs {
+		stats.Packs++
+		live := make(map[Key]packEntry)
+		var liveBytes int64
+		p.mu.Lock()
+		for k, e := range info.entries {
+			if p.entries[k] == e {
+				live[k] = e
+				liveBytes += e.length
+			}
+		}
+		p.mu.Unlock()
+		if len(live) > 0 && float64(info.size-liveBytes) <= garbage*float64(info.size) {
+			continue
+		}
+		if len(live) > 0 {
+			if err := p.rewrite(info, live); err != nil {
+				return stats, err
+			}
+			stats.Rewritten++
+		}
+		if err := p.deletePack(info.id); err != nil {
+			return stats, err
+		}
+		stats.Deleted++
+		stats.Freed += info.size - liveBytes
+	}
+	orphans, err := p.orphans(24 * time.Hour)
+	if err != nil {
+		return stats, err
+	}
+	for _, item := range orphans {
+		if err := p.store.Delete(item.Key); err != nil && !errors.Is(err, ErrNotFound) {
+			return stats, err
+		}
+		stats.Deleted++
+		stats.Freed += item.Size
+	}
+	return stats, nil
+}
+
+// rewrite copies the given items of a pack to a new pack.
+func (p *Packed) rewrite(info *packInfo, live map[Key]packEntry) error {
+	contents, err := p.store.Get(packKey(info.id))
+	if err != nil {
+		return errors.Wrapf(err, "pack %s", info.id)
+	}
+	id, err := newPackID()
+	if err != nil {
+		return err
+	}
+	rewritten := &packInfo{
+		id:      id,
+		created: time.Now(),
+		entries: make(map[Key]packEntry),
+	}
+	var buf bytes.Buffer
+	for k, e := range live {
+		if e.offset+e.length > int64(len(contents)) {
+			return errors.Errorf("pack %s: %q past the end", info.id, k)
+		}
+		rewritten.entries[k] = packEntry{pack: id, offset: int64(buf.Len()), length: e.length}
+		buf.Write(contents[e.offset : e.offset+e.length])
+	}
+	rewritten.size = int64(buf.Len())
+	return p.writePack(rewritten, buf.Bytes())
+}
+
+// deletePack deletes the index, then the pack, so that an index never
+// refers to a missing pack.
+func (p *Packed) deletePack(id string) error {
+	if err := p.store.Delete(packIndexKey(id)); err != nil && !errors.Is(err, ErrNotFound) {
+		return errors.Wrapf(err, "pack %s: index", id)
+	}
+	if err := p.store.Delete(packKey(id)); err != nil && !errors.Is(err, ErrNotFound) {
+		return errors.Wrapf(err, "pack %s", id)
+	}
+	p.mu.Lock()
+	delete(p.packs, id)
+	p.mu.Unlock()
+	p.reindex()
+	return nil
+}
+
+// orphans lists the packs without an index, modified at least age ago.
+func (p *Packed) orphans(age time.Duration) (orphans []ListItem, err error) {
+	indexed := make(map[Key]bool)
+	var packs []ListItem
+	err = p.store.(Lister).List(context.Background(), packPrefix, func(item ListItem) error {
+		if strings.HasSuffix(string(item.Key), packIndexSuffix) {
+			indexed[Key(strings.TrimSuffix(string(item.Key), packIndexSuffix))] = true
+		} else {
+			packs = append(packs, item)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range packs {
+		if !indexed[item.Key] && !item.Modified.IsZero() && time.Since(item.Modified) >= age {
+			log.WithField("key", item.Key).Warning("Deleting pack without index")
+			orphans = append(orphans, item)
+		}
+	}
+	return orphans, nil
+}
+
+// NewPackedStore wraps the given store in a Packed if the configuration
+// enables packing (see config.C.PackSize), and returns it as is otherwise.
+func NewPackedStore(c *config.C, store Store, codec Codec) (Store, error) {
+	if c.PackSize <= 0 {
+		return store, nil
+	}
+	p, err := NewPacked(store, codec, WithPackSize(int(c.PackSize)))
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
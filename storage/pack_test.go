@@ -0,0 +1,246 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// xorCodec stands in for encryption.
+type xorCodec byte
+
+func (c xorCodec) Encode(b []byte) ([]byte, error) {
+	out := make([]byte, len(b))
+	for i := range b {
+		out[i] = b[i] ^ byte(c)
+	}
+	return out, nil
+}
+
+func (c xorCodec) Decode(b []byte) ([]byte, error) {
+	if len(b) > 0 && b[0]^byte(c) != packIndexFormat {
+		return nil, errors.New("wrong key")
+	}
+	return c.Encode(b)
+}
+
+func newTestPacked(t *testing.T, store Store) *Packed {
+	t.Helper()
+	p, err := NewPacked(store, xorCodec(0x5a), WithPackSize(1024), WithPackLinger(5*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// packObjects returns the number of packs and of other items in a store.
+func packObjects(t *testing.T, store Lister) (packs, others int) {
+	t.Helper()
+	if err := store.List(context.Background(), "", func(item ListItem) error {
+		switch {
+		case strings.HasSuffix(string(item.Key), packIndexSuffix):
+		case strings.HasPrefix(string(item.Key), packPrefix):
+			packs++
+		default:
+			others++
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestPackedContract(t *testing.T) {
+	testStoreContract(t, newTestPacked(t, NewDiskStore(t.TempDir())))
+}
+
+func TestPacked(t *testing.T) {
+	store := &InMemory{}
+	p := newTestPacked(t, store)
+	put := func(t *testing.T, p *Packed, values map[Key]Value) {
+		t.Helper()
+		var wg sync.WaitGroup
+		for k, v := range values {
+			wg.Add(1)
+			go func(k Key, v Value) {
+				defer wg.Done()
+				if err := p.Put(k, v); err != nil {
+					t.Error(err)
+				}
+			}(k, v)
+		}
+		wg.Wait()
+	}
+	get := func(t *testing.T, p *Packed, values map[Key]Value) {
+		t.Helper()
+		for k, v := range values {
+			if got, err := p.Get(k); err != nil {
+				t.Errorf("%q: %v", k, err)
+			} else if !bytes.Equal(got, v) {
+				t.Errorf("%q: got %q, want %q", k, got, v)
+			}
+		}
+	}
+	values := make(map[Key]Value)
+	for i := 0; i < 4; i++ {
+		values[RandomPointer().Key()] = Value(fmt.Sprintf("value %d", i))
+	}
+	var keep Key
+	for k := range values {
+		keep = k
+	}
+	large := RandomPointer().Key()
+
+	t.Run("concurrent puts share a pack", func(t *testing.T) {
+		put(t, p, values)
+		if err := p.Put(large, bytes.Repeat([]byte("x"), 200)); err != nil {
+			t.Fatal(err)
+		}
+		if packs, others := packObjects(t, store); packs != 1 || others != 1 {
+			t.Errorf("got %d packs and %d other items, want 1 and 1", packs, others)
+		}
+		get(t, p, values)
+		if v, err := store.Get(large); err != nil || len(v) != 200 {
+			t.Errorf("got %d bytes and %v, want the large item unpacked", len(v), err)
+		}
+	})
+
+	t.Run("index is encoded", func(t *testing.T) {
+		if _, err := NewPacked(store, xorCodec(0x33)); err == nil {
+			t.Error("got nil, want an error decoding the index")
+		}
+		if err := store.List(context.Background(), packPrefix, func(item ListItem) error {
+			v, _ := store.Get(item.Key)
+			for k := range values {
+				if bytes.Contains(v, []byte(k)) {
+					t.Errorf("%q: contains key %q in the clear", item.Key, k)
+				}
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("other instances load packs", func(t *testing.T) {
+		other := newTestPacked(t, store)
+		get(t, other, values)
+		more := map[Key]Value{RandomPointer().Key(): Value("more")}
+		put(t, p, more)
+		// Too soon after loading the indexes to load them again.
+		for k := range more {
+			if _, err := other.Get(k); !errors.Is(err, ErrNotFound) {
+				t.Errorf("%q: got %v, want %v", k, err, ErrNotFound)
+			}
+		}
+		other.reloadInterval = 0
+		get(t, other, more)
+		for k := range more {
+			values[k] = more[k]
+		}
+	})
+
+	t.Run("repack", func(t *testing.T) {
+		// Leaves the first pack mostly garbage, the second all garbage.
+		var wg sync.WaitGroup
+		for k := range values {
+			if k == keep {
+				continue
+			}
+			wg.Add(1)
+			go func(k Key) {
+				defer wg.Done()
+				if err := p.Delete(k); err != nil {
+					t.Error(err)
+				}
+			}(k)
+		}
+		wg.Wait()
+		for k := range values {
+			if _, err := newTestPacked(t, store).Get(k); k != keep && !errors.Is(err, ErrNotFound) {
+				t.Errorf("%q: got %v, want %v", k, err, ErrNotFound)
+			}
+		}
+		// Loaded before the repack, and too recently to reload the
+		// indexes for missing items.
+		reader := newTestPacked(t, store)
+		stats, err := p.Repack(0.5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.Packs != 2 || stats.Rewritten != 1 || stats.Deleted != 2 || stats.Freed == 0 {
+			t.Errorf("got %+v", stats)
+		}
+		if packs, _ := packObjects(t, store); packs != 1 {
+			t.Errorf("got %d packs, want 1", packs)
+		}
+		get(t, newTestPacked(t, store), map[Key]Value{keep: values[keep]})
+		// The rewritten pack is found as soon as the old one is missed.
+		get(t, reader, map[Key]Value{keep: values[keep]})
+		if err := p.Delete(keep); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := p.Repack(0.5); err != nil {
+			t.Fatal(err)
+		}
+		if packs, _ := packObjects(t, store); packs != 0 {
+			t.Errorf("got %d packs, want none", packs)
+		}
+	})
+}
+
+// indexCounter counts the pack indexes stored.
+type indexCounter struct {
+	*InMemory
+	puts int32
+}
+
+func (s *indexCounter) Put(k Key, v Value) error {
+	if strings.HasSuffix(string(k), packIndexSuffix) {
+		atomic.AddInt32(&s.puts, 1)
+	}
+	return s.InMemory.Put(k, v)
+}
+
+func TestPackedDeleteMany(t *testing.T) {
+	store := &indexCounter{InMemory: &InMemory{}}
+	p := newTestPacked(t, store)
+	keys := []Key{RandomPointer().Key()}
+	if err := p.Put(keys[0], bytes.Repeat([]byte("x"), 200)); err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		k := RandomPointer().Key()
+		keys = append(keys, k)
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := p.Put(k, Value(fmt.Sprintf("value %d", i))); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	packs, _ := packObjects(t, store)
+	atomic.StoreInt32(&store.puts, 0)
+	if err := p.DeleteMany(append(keys, RandomPointer().Key())); err != nil {
+		t.Fatal(err)
+	}
+	if got := int(atomic.LoadInt32(&store.puts)); got != packs {
+		t.Errorf("stored %d indexes for %d packs", got, packs)
+	}
+	other := newTestPacked(t, store)
+	for _, k := range keys {
+		if _, err := other.Get(k); !errors.Is(err, ErrNotFound) {
+			t.Errorf("%q: got %v, want %v", k, err, ErrNotFound)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package storage
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"io"
 	"os"
@@ -10,17 +11,20 @@ import (
 
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/sync/singleflight"
 )
 
 // Valid prefix byte in the propagation log lines. A pending item is only in the
-// fast store, that needs to copied to the slow store. A done item is in the slow
+// fast store, that needs to copied to the slow store. A priority item is a
+// pending item to be copied ahead of the others. A done item is in the slow
 // store and may or may not be in the fast store (might have been evicted). A
 // missing item is one that was to be propagated from fast to slow store, but
 // was not found in the fast store.
 const (
-	itemPending = 'p'
-	itemMissing = 'm'
-	itemDone    = 'd'
+	itemPending  = 'p'
+	itemPriority = 'P'
+	itemMissing  = 'm'
+	itemDone     = 'd'
 )
 
 // The log consists of lines of known length (a byte, a key, a newline).
@@ -28,10 +32,22 @@ const logLineLength = 66
 
 type propagationLog struct {
 	pollInterval time.Duration
-	readOffset   int64
 
-	mu   sync.Mutex
-	file *os.File
+	mu          sync.Mutex
+	file        *os.File
+	writeOffset int64
+
+	// Number of pending or missing lines for each key.
+	pending map[Key]int
+
+	// When each line yet to be marked was added, by offset. Lines carried
+	// over from a previous run count as added at startup. Lines not in here
+	// have been propagated, or found missing, already.
+	added map[int64]time.Time
+
+	// Lines marked since startup.
+	missing int
+	done    int
 }
 
 // newLog reads the log at pathname (creating it if necessary), compacts it, and time stamps the previous version.
@@ -44,11 +60,16 @@ func newLog(pathname string) (*propagationLog, error) {
 	if err != nil {
 		return nil, errors.Wrapf(err, "open %q write-only", pathname+".new")
 	}
+	pending := make(map[Key]int)
+	added := make(map[int64]time.Time)
+	now := time.Now()
 	s := bufio.NewScanner(curr)
 	for s.Scan() {
 		line := s.Text()
 		switch state := line[0]; state {
-		case itemPending, itemMissing:
+		case itemPending, itemPriority, itemMissing:
+			pending[Key(line[1:])]++
+			added[int64(len(added))*logLineLength] = now
 			if _, err := fmt.Fprintln(next, line); err != nil {
 				return nil, errors.Wrapf(err, "copying line from %q to %q", curr.Name(), next.Name())
 			}
@@ -74,15 +95,27 @@ func newLog(pathname string) (*propagationLog, error) {
 		return nil, errors.Wrapf(err, "open %q read-write", pathname)
 	}
 	// Seek to end for writes. (Reads will use ReadAt instead.)
-	if _, err := curr.Seek(0, io.SeekEnd); err != nil {
+	end, err := curr.Seek(0, io.SeekEnd)
+	if err != nil {
 		return nil, errors.Wrapf(err, "seek %q to EOF", curr.Name())
 	}
-	return &propagationLog{file: curr, pollInterval: 5 * time.Second}, nil
+	return &propagationLog{
+		file:         curr,
+		pollInterval: 5 * time.Second,
+		writeOffset:  end,
+		pending:      pending,
+		added:        added,
+	}, nil
 }
 
-func (pl *propagationLog) add(key Key) error {
+// add appends a line for the key, with the given state, either
+// itemPending or itemPriority.
+func (pl *propagationLog) add(key Key, state byte) error {
 	pl.mu.Lock()
-	n, err := fmt.Fprintf(pl.file, "%c%s\n", itemPending, key)
+	n, err := fmt.Fprintf(pl.file, "%c%s\n", state, key)
+	pl.pending[key]++
+	pl.added[pl.writeOffset] = time.Now()
+	pl.writeOffset += int64(n)
 	pl.mu.Unlock()
 	if n != logLineLength {
 		return fmt.Errorf("written only %d of %d bytes", n, logLineLength)
@@ -90,31 +123,92 @@ func (pl *propagationLog) add(key Key) error {
 	return err
 }
 
-func (pl *propagationLog) next(p []byte) {
+// next waits for a line past the cursor, of an item yet to be marked and
+// with a state accepted by the given function, copies it to p, advances the
+// cursor past it, and returns the offset of the line. It returns false if
+// stop is closed meanwhile.
+func (pl *propagationLog) next(p []byte, cursor *int64, accept func(state byte) bool, stop <-chan struct{}) (int64, bool) {
 	for {
 		pl.mu.Lock()
-		n, err := pl.file.ReadAt(p, pl.readOffset)
-		pl.mu.Unlock()
+		offset := *cursor
+		n, err := pl.file.ReadAt(p, offset)
 		if n == logLineLength && err == nil {
-			break
+			*cursor += logLineLength
+			_, unmarked := pl.added[offset]
+			pl.mu.Unlock()
+			if unmarked && accept(p[0]) {
+				return offset, true
+			}
+			continue
+		}
+		pl.mu.Unlock()
+		select {
+		case <-stop:
+			return 0, false
+		case <-time.After(pl.pollInterval):
 		}
-		time.Sleep(pl.pollInterval)
 	}
 }
 
-func (pl *propagationLog) mark(state byte) error {
+// mark records the new state of the item at the given offset, whose key is
+// also given. Lines can be marked in any order, since each line is
+// rewritten in place.
+func (pl *propagationLog) mark(offset int64, key Key, state byte) error {
 	pl.mu.Lock()
-	n, err := pl.file.WriteAt([]byte{state}, pl.readOffset)
+	n, err := pl.file.WriteAt([]byte{state}, offset)
+	if pl.pending[key]--; pl.pending[key] <= 0 {
+		delete(pl.pending, key)
+	}
+	delete(pl.added, offset)
+	if state == itemMissing {
+		pl.missing++
+	} else {
+		pl.done++
+	}
 	pl.mu.Unlock()
-	pl.readOffset += logLineLength // Advance to next line.
 	if n != 1 {
 		return fmt.Errorf("wrote %d bytes instead of 1", n)
 	}
 	return err
 }
 
-func (pl *propagationLog) skip() {
-	pl.readOffset += logLineLength
+// hold counts the key as pending until release is called, without adding
+// a line, so that the item isn't evicted from the fast store before the
+// line is added.
+func (pl *propagationLog) hold(key Key) {
+	pl.mu.Lock()
+	pl.pending[key]++
+	pl.mu.Unlock()
+}
+
+// release undoes hold.
+func (pl *propagationLog) release(key Key) {
+	pl.mu.Lock()
+	if pl.pending[key]--; pl.pending[key] <= 0 {
+		delete(pl.pending, key)
+	}
+	pl.mu.Unlock()
+}
+
+func (pl *propagationLog) isPending(key Key) bool {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	return pl.pending[key] > 0
+}
+
+// stats fills in the counters of s that the log keeps.
+func (pl *propagationLog) stats(s *PairedStats) {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	s.Pending = len(pl.added)
+	s.Missing = pl.missing
+	s.Done = pl.done
+	now := time.Now()
+	for _, t := range pl.added {
+		if age := now.Sub(t); age > s.OldestPending {
+			s.OldestPending = age
+		}
+	}
 }
 
 func (pl *propagationLog) close() {
@@ -130,48 +224,273 @@ func (pl *propagationLog) close() {
 // store for next time. It deletes from the slow store first and then from the fast store.
 type Paired struct {
 	retryInterval time.Duration
+	workers       int
+	waitOnline    func()
+
+	// Recently propagated items, for the throughput.
+	meter throughputMeter
 
 	fast Store
 	slow Store
 
+	// Shares the copies from the slow store to the fast store between
+	// concurrent gets of the same item, e.g., a read and a prefetch.
+	fetches singleflight.Group
+
 	// To start the background goroutine from Put operations.
 	once sync.Once
 
-	log *propagationLog
+	// Closed by Close, to stop the background goroutines, which
+	// Close waits for, except the workers.
+	stop      chan struct{}
+	stopOnce  sync.Once
+	stoppedWG sync.WaitGroup
+
+	log   *propagationLog
+	queue *propagationQueue
+}
+
+// PairedStats reports on the propagation of items from the fast store to
+// the slow store. Counts are of lines in the propagation log, i.e., an
+// item put twice before being propagated counts twice.
+type PairedStats struct {
+	// Items yet to be copied.
+	Pending int
+	// Items since startup that were to be copied but weren't found in
+	// the fast store, and those that were copied.
+	Missing int
+	Done    int
+
+	// How long the oldest pending item has been waiting; items pending
+	// from before a restart count as put at startup.
+	OldestPending time.Duration
+
+	// Bytes copied per second over the last minute.
+	Throughput float64
+
+	// Whether propagation is paused (see Paired.Pause), or only that of
+	// regular items, being outside of the schedule (see
+	// WithPropagationSchedule).
+	Paused      bool
+	Unscheduled bool
+}
+
+// String formats the stats as lines of names and values.
+func (s PairedStats) String() string {
+	state := "running"
+	switch {
+	case s.Paused:
+		state = "paused"
+	case s.Unscheduled:
+		state = "outside upload window"
+	}
+	return fmt.Sprintf("pending %d\nmissing %d\ndone %d\noldest-pending %v\nthroughput %.0f bytes/s\nstate %s\n",
+		s.Pending, s.Missing, s.Done, s.OldestPending.Round(time.Second), s.Throughput, state)
+}
+
+const throughputWindow = time.Minute
+
+type throughputMeter struct {
+	mu      sync.Mutex
+	samples []throughputSample
+}
+
+type throughputSample struct {
+	at    time.Time
+	bytes int
+}
+
+// record adds a sample and forgets those outside the window.
+func (m *throughputMeter) record(bytes int) {
+	now := time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.samples = append(m.trim(now), throughputSample{at: now, bytes: bytes})
+}
+
+// rate returns the bytes per second within the window.
+func (m *throughputMeter) rate() float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.samples = m.trim(time.Now())
+	var total int
+	for _, s := range m.samples {
+		total += s.bytes
+	}
+	return float64(total) / throughputWindow.Seconds()
+}
+
+// Pre-condition: m.mu is locked.
+func (m *throughputMeter) trim(now time.Time) []throughputSample {
+	i := 0
+	for i < len(m.samples) && now.Sub(m.samples[i].at) > throughputWindow {
+		i++
+	}
+	return m.samples[i:]
+}
+
+// DefaultPropagationWorkers is the default number of items that Paired
+// copies concurrently from the fast store to the slow store.
+const DefaultPropagationWorkers = 64
+
+// PairedOption configures a Paired store.
+type PairedOption func(*Paired)
+
+// WithPropagationWorkers sets the number of items copied concurrently from
+// the fast store to the slow store. Non-positive values are ignored.
+func WithPropagationWorkers(n int) PairedOption {
+	return func(p *Paired) {
+		if n > 0 {
+			p.workers = n
+		}
+	}
+}
+
+// WithPropagationSchedule restricts the propagation of items put with Put
+// to the times for which the given function returns true, e.g., to upload
+// file data at night only. Items put with PutPriority aren't restricted.
+func WithPropagationSchedule(allowed func(time.Time) bool) PairedOption {
+	return func(p *Paired) {
+		p.queue.allowed = allowed
+	}
+}
+
+// WithOfflineWait specifies how to wait for the slow store to be reachable
+// again, e.g., Breaker.WaitOnline, when copying an item to it fails with
+// ErrOffline, rather than retrying periodically.
+func WithOfflineWait(wait func()) PairedOption {
+	return func(p *Paired) {
+		p.waitOnline = wait
+	}
 }
 
 // NewPaired creates a write-back cache from fast to slow.
 // If the log path is empty, the cache is read-only and puts will fail.
-func NewPaired(fast, slow Store, logPath string) (p *Paired, err error) {
+// If the fast store is a Cache, it won't evict pending items.
+func NewPaired(fast, slow Store, logPath string, opts ...PairedOption) (p *Paired, err error) {
 	p = new(Paired)
 	p.retryInterval = 5 * time.Second
+	p.workers = DefaultPropagationWorkers
+	p.queue = newPropagationQueue(defaultPropagationQueueLength)
+	p.stop = make(chan struct{})
 	p.fast = fast
 	p.slow = slow
+	for _, o := range opts {
+		o(p)
+	}
 	if logPath != "" {
 		p.log, err = newLog(logPath)
 		if err != nil {
 			return
 		}
+		if c, ok := fast.(*Cache); ok {
+			c.Protect(p.IsPending)
+		}
 	}
 	return p, err
 }
 
+// IsPending tells whether an item is yet to be copied from the fast store
+// to the slow store.
+func (p *Paired) IsPending(k Key) bool {
+	return p.log != nil && p.log.isPending(k)
+}
+
+// Stats returns a snapshot of the propagation counters.
+func (p *Paired) Stats() PairedStats {
+	var s PairedStats
+	if p.log != nil {
+		p.log.stats(&s)
+	}
+	s.Throughput = p.meter.rate()
+	p.queue.mu.Lock()
+	s.Paused = p.queue.paused
+	s.Unscheduled = !p.queue.scheduled(time.Now())
+	p.queue.mu.Unlock()
+	return s
+}
+
+// Pause stops the propagation of items to the slow store, once those being
+// copied are, until Resume is called. Items are still put to the fast
+// store, and queued.
+func (p *Paired) Pause() {
+	p.queue.mu.Lock()
+	p.queue.paused = true
+	p.queue.mu.Unlock()
+}
+
+// Resume undoes Pause.
+func (p *Paired) Resume() {
+	p.queue.mu.Lock()
+	p.queue.paused = false
+	p.queue.mu.Unlock()
+	p.queue.nonEmpty.Broadcast()
+}
+
 func (p *Paired) Get(k Key) (v Value, err error) {
 	v, err = p.fast.Get(k)
 	if errors.Is(err, ErrNotFound) {
-		v, err = p.slow.Get(k)
-		if err == nil {
-			if e := p.fast.Put(k, v); e != nil {
-				log.WithFields(log.Fields{
-					"key":   k,
-					"cause": e.Error(),
-				}).Warning("Could not write item to the fast store")
-			}
-		}
+		v, err = p.fetch(k)
 	}
 	return
 }
 
+// Cached tells whether an item is in the fast store, so that getting it
+// won't wait for the slow store.
+func (p *Paired) Cached(k Key) bool {
+	if c, ok := p.fast.(*Cache); ok {
+		return c.Contains(k)
+	}
+	_, err := p.fast.Get(k)
+	return err == nil
+}
+
+// Prefetch copies an item from the slow store to the fast store, unless
+// already there, so that it can be read quickly later.
+func (p *Paired) Prefetch(k Key) error {
+	if p.Cached(k) {
+		return nil
+	}
+	_, err := p.fetch(k)
+	return err
+}
+
+// fetch gets an item from the slow store and writes it to the fast store,
+// once for concurrent callers.
+func (p *Paired) fetch(k Key) (Value, error) {
+	v, err, _ := p.fetches.Do(string(k), func() (interface{}, error) {
+		v, err := p.slow.Get(k)
+		if err != nil {
+			return nil, err
+		}
+		if e := p.fast.Put(k, v); e != nil {
+			log.WithFields(log.Fields{
+				"key":   k,
+				"cause": e.Error(),
+			}).Warning("Could not write item to the fast store")
+		}
+		return v, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(Value), nil
+}
+
+// Refetch implements Refetcher. It deletes the item from the fast store,
+// then gets it from the slow store.
+func (p *Paired) Refetch(k Key) (Value, error) {
+	if err := p.fast.Delete(k); err != nil && !errors.Is(err, ErrNotFound) {
+		return nil, err
+	}
+	return p.slow.Get(k)
+}
+
+// Recache implements Refetcher. It writes the item to the fast store.
+func (p *Paired) Recache(k Key, v Value) error {
+	return p.fast.Put(k, v)
+}
+
 var ErrReadOnly = errors.New("read-only store")
 
 // Put writes an item to the fast store and enqueues it to be written
@@ -183,14 +502,28 @@ var ErrReadOnly = errors.New("read-only store")
 // filesystem as queue (e.g., hard or symbolic links) but that leads to
 // assuming a disk store implementation and I don't want to.
 func (p *Paired) Put(k Key, v Value) error {
+	return p.put(k, v, itemPending)
+}
+
+// PutPriority implements PriorityPutter. Like Put, but the item is copied
+// to the slow store ahead of those put with Put.
+func (p *Paired) PutPriority(k Key, v Value) error {
+	return p.put(k, v, itemPriority)
+}
+
+func (p *Paired) put(k Key, v Value, state byte) error {
 	if p.log == nil {
 		return ErrReadOnly
 	}
 	p.EnsureBackgroundPuts()
+	// Protect the item from eviction from the fast store, by concurrent
+	// puts, until it's in the log.
+	p.log.hold(k)
+	defer p.log.release(k)
 	if err := p.fast.Put(k, v); err != nil {
 		return err
 	}
-	if err := p.log.add(k); err != nil {
+	if err := p.log.add(k, state); err != nil {
 		return err
 	}
 	return nil
@@ -199,37 +532,210 @@ func (p *Paired) Put(k Key, v Value) error {
 func (p *Paired) EnsureBackgroundPuts() {
 	p.once.Do(func() {
 		if p.log != nil {
-			go p.propagate()
+			p.stoppedWG.Add(1)
+			go func() {
+				defer p.stoppedWG.Done()
+				p.propagate()
+			}()
 		}
 	})
 }
 
-func (p *Paired) propagate() {
-	line := make([]byte, logLineLength)
+// Close stops copying items to the slow store. Items being copied are
+// finished in the background; the others, including those put afterwards,
+// are left in the log, to be copied after a restart.
+func (p *Paired) Close() {
+	// Don't start copying if not started already.
+	p.once.Do(func() {})
+	p.stopOnce.Do(func() {
+		close(p.stop)
+		p.queue.close()
+	})
+	p.stoppedWG.Wait()
+}
+
+type logItem struct {
+	offset int64
+	key    Key
+}
+
+// Maximum number of priority items, and of regular items, read from the log
+// ahead of being propagated.
+const defaultPropagationQueueLength = 1024
+
+// propagationQueue holds the items read from the log that are yet to be
+// propagated, priority ones first. Items can't be taken while paused, and
+// regular ones only at the times allowed, if restricted. Pushing waits while
+// there are already as many items of the same kind as the length.
+type propagationQueue struct {
+	mu       sync.Mutex
+	nonEmpty *sync.Cond
+	nonFull  *sync.Cond
+	length   int
+	priority []logItem
+	regular  []logItem
+	paused   bool
+	closed   bool
+	allowed  func(time.Time) bool
+}
+
+func newPropagationQueue(length int) *propagationQueue {
+	q := &propagationQueue{length: length}
+	q.nonEmpty = sync.NewCond(&q.mu)
+	q.nonFull = sync.NewCond(&q.mu)
+	return q
+}
+
+// push waits for room for the item and adds it to the queue. It returns
+// false if the queue is closed meanwhile.
+func (q *propagationQueue) push(item logItem, priority bool) bool {
+	q.mu.Lock()
+	items := &q.regular
+	if priority {
+		items = &q.priority
+	}
+	for len(*items) >= q.length && !q.closed {
+		q.nonFull.Wait()
+	}
+	if q.closed {
+		q.mu.Unlock()
+		return false
+	}
+	*items = append(*items, item)
+	q.mu.Unlock()
+	q.nonEmpty.Signal()
+	return true
+}
+
+// pop waits for an item that can be taken and removes it from the queue.
+// It returns false if the queue is closed meanwhile.
+func (q *propagationQueue) pop() (item logItem, ok bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
 	for {
-		p.log.next(line)
-		if state := line[0]; state != itemPending && state != itemMissing {
+		switch {
+		case q.closed:
+			return item, false
+		case q.paused:
+		case len(q.priority) > 0:
+			item, q.priority = q.priority[0], q.priority[1:]
+			q.nonFull.Broadcast()
+			return item, true
+		case len(q.regular) > 0 && q.scheduled(time.Now()):
+			item, q.regular = q.regular[0], q.regular[1:]
+			q.nonFull.Broadcast()
+			return item, true
+		}
+		q.nonEmpty.Wait()
+	}
+}
+
+// close makes waiting pushes and pops return.
+func (q *propagationQueue) close() {
+	q.mu.Lock()
+	q.closed = true
+	q.mu.Unlock()
+	q.nonEmpty.Broadcast()
+	q.nonFull.Broadcast()
+}
+
+func (q *propagationQueue) scheduled(t time.Time) bool {
+	return q.allowed == nil || q.allowed(t)
+}
+
+// propagate reads the log into a queue, from which a bounded number of
+// workers take items, priority ones first, copy them to the slow store
+// concurrently, and mark them in the log as they complete, in any order.
+// Priority and regular items are read separately, so that priority items
+// aren't held up by a full queue of regular ones, e.g., outside of the
+// schedule.
+func (p *Paired) propagate() {
+	queue := p.queue
+	if queue.allowed != nil {
+		// Wake up the workers waiting for the schedule to allow them.
+		p.stoppedWG.Add(1)
+		go func() {
+			defer p.stoppedWG.Done()
+			ticker := time.NewTicker(time.Minute)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					queue.nonEmpty.Broadcast()
+				case <-p.stop:
+					return
+				}
+			}
+		}()
+	}
+	for i := 0; i < p.workers; i++ {
+		go func() {
+			for {
+				item, ok := queue.pop()
+				if !ok {
+					return
+				}
+				p.propagateItem(item.offset, item.key)
+			}
+		}()
+	}
+	p.stoppedWG.Add(1)
+	go func() {
+		defer p.stoppedWG.Done()
+		p.readLog(true, func(state byte) bool {
+			return state == itemPriority
+		})
+	}()
+	p.readLog(false, func(state byte) bool {
+		switch state {
+		case itemPending, itemMissing:
+			return true
+		case itemPriority:
+			return false
+		default:
 			log.Warnf("skipping item with unexpected state: %d", state)
-			p.log.skip()
-			continue
+			return false
 		}
-		key := Key(line[1:65])
-		value, err := p.fast.Get(key)
-		if err != nil {
-			// If we can't update it in the log, it will be re-processed (needless but idempotent).
-			_ = p.log.mark(itemMissing)
-			continue
+	})
+}
+
+// readLog pushes the items in the log with the accepted states to the
+// queue, as priority items or not, until Close is called.
+func (p *Paired) readLog(priority bool, accept func(state byte) bool) {
+	var cursor int64
+	line := make([]byte, logLineLength)
+	for {
+		offset, ok := p.log.next(line, &cursor, accept, p.stop)
+		if !ok {
+			return
 		}
-		for {
-			if err = p.slow.Put(key, value); err == nil {
-				break
-			}
-			log.Warnf("failure to put %q to slow store (will retry): %v", key, err)
-			time.Sleep(p.retryInterval)
+		if !p.queue.push(logItem{offset: offset, key: Key(line[1:65])}, priority) {
+			return
 		}
+	}
+}
+
+func (p *Paired) propagateItem(offset int64, key Key) {
+	value, err := p.fast.Get(key)
+	if err != nil {
 		// If we can't update it in the log, it will be re-processed (needless but idempotent).
-		_ = p.log.mark(itemDone)
+		_ = p.log.mark(offset, key, itemMissing)
+		return
 	}
+	for {
+		if err = p.slow.Put(key, value); err == nil {
+			break
+		}
+		if p.waitOnline != nil && errors.Is(err, ErrOffline) {
+			p.waitOnline()
+			continue
+		}
+		log.Warnf("failure to put %q to slow store (will retry): %v", key, err)
+		time.Sleep(p.retryInterval)
+	}
+	p.meter.record(len(value))
+	// If we can't update it in the log, it will be re-processed (needless but idempotent).
+	_ = p.log.mark(offset, key, itemDone)
 }
 
 // Delete deletes an item from the slow store first, then from the fast store second. Note that if done in the other
@@ -242,3 +748,14 @@ func (p *Paired) Delete(k Key) error {
 	}
 	return p.fast.Delete(k)
 }
+
+// List implements Lister. It lists the items in the fast store, which
+// include those yet to be propagated, then those only in the slow store.
+// Both stores must implement Lister.
+func (p *Paired) List(ctx context.Context, prefix string, f func(ListItem) error) error {
+	listers, err := asListers([]Store{p.fast, p.slow})
+	if err != nil {
+		return err
+	}
+	return listUnion(ctx, listers, prefix, f)
+}
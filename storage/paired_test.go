@@ -2,12 +2,15 @@ package storage
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"testing/quick"
 	"time"
@@ -37,16 +40,17 @@ func TestPropagationLogPreservesStateAcrossRestarts(t *testing.T) {
 		for i, raw := range byteKeys {
 			k := Key(fmt.Sprintf("%x", raw))
 			keys[i] = k
-			require.Nil(t, log.add(k))
+			require.Nil(t, log.add(k, itemPending))
 		}
 		p := make([]byte, logLineLength)
+		var cursor int64
 		i := 0
 		stop := 0
 		if len(byteKeys) > 0 {
 			stop = restart % len(byteKeys)
 		}
 		for ; i < stop; i++ {
-			log.next(p)
+			offset := nextLine(log, p, &cursor)
 			if strings.IndexByte("pmd", p[0]) == -1 {
 				t.Errorf("unknown state %d", p[0])
 				return false
@@ -55,7 +59,7 @@ func TestPropagationLogPreservesStateAcrossRestarts(t *testing.T) {
 				t.Errorf("key mismatch, got %q, want %q", nextKey, keys[i])
 				return false
 			}
-			require.Nil(t, log.mark(itemDone))
+			require.Nil(t, log.mark(offset, keys[i], itemDone))
 		}
 		// Shutdown.
 		log.close()
@@ -63,8 +67,9 @@ func TestPropagationLogPreservesStateAcrossRestarts(t *testing.T) {
 		// Restart and process the rest.
 		log, err = newLog(logFile.Name())
 		require.Nil(t, err)
+		cursor = 0
 		for ; i < len(byteKeys); i++ {
-			log.next(p)
+			offset := nextLine(log, p, &cursor)
 			if strings.IndexByte("pmd", p[0]) == -1 {
 				t.Errorf("unknown state %d", p[0])
 				return false
@@ -73,7 +78,13 @@ func TestPropagationLogPreservesStateAcrossRestarts(t *testing.T) {
 				t.Errorf("key mismatch, got %q, want %q", nextKey, keys[i])
 				return false
 			}
-			require.Nil(t, log.mark(itemDone))
+			require.Nil(t, log.mark(offset, keys[i], itemDone))
+		}
+		for _, k := range keys {
+			if log.isPending(k) {
+				t.Errorf("%q: still pending", k)
+				return false
+			}
 		}
 
 		return true
@@ -243,6 +254,12 @@ func TestPaired(t *testing.T) {
 	})
 }
 
+// nextLine waits for the next line yet to be marked, whatever its state.
+func nextLine(log *propagationLog, p []byte, cursor *int64) int64 {
+	offset, _ := log.next(p, cursor, func(byte) bool { return true }, nil)
+	return offset
+}
+
 func disposablePathName(t *testing.T) (pathname string, cleanup func()) {
 	f, err := ioutil.TempFile("", "")
 	require.Nil(t, err)
@@ -251,3 +268,347 @@ func disposablePathName(t *testing.T) (pathname string, cleanup func()) {
 		assert.Nil(t, os.Remove(f.Name()))
 	}
 }
+
+func TestPropagationLogMarksOutOfOrder(t *testing.T) {
+	pathname, cleanup := disposablePathName(t)
+	defer cleanup()
+	log, err := newLog(pathname)
+	require.Nil(t, err)
+	keys := []Key{randomKey(32), randomKey(32), randomKey(32)}
+	for _, k := range keys {
+		require.Nil(t, log.add(k, itemPending))
+	}
+	p := make([]byte, logLineLength)
+	var cursor int64
+	var offsets []int64
+	for range keys {
+		offsets = append(offsets, nextLine(log, p, &cursor))
+	}
+	require.Nil(t, log.mark(offsets[2], keys[2], itemDone))
+	require.Nil(t, log.mark(offsets[0], keys[0], itemDone))
+	log.close()
+
+	// After a restart, only the item in the middle is left.
+	log, err = newLog(pathname)
+	require.Nil(t, err)
+	defer log.close()
+	assert.False(t, log.isPending(keys[0]))
+	assert.True(t, log.isPending(keys[1]))
+	assert.False(t, log.isPending(keys[2]))
+	cursor = 0
+	assert.Equal(t, int64(0), nextLine(log, p, &cursor))
+	assert.Equal(t, keys[1], Key(p[1:65]))
+}
+
+func TestPairedPropagatesConcurrently(t *testing.T) {
+	pathname, cleanup := disposablePathName(t)
+	defer cleanup()
+	slow := &InMemory{}
+	blocked := randomKey(32)
+	unblock := make(chan struct{})
+	defer close(unblock)
+	store, err := NewPaired(&InMemory{}, storeFuncs{
+		get: slow.Get,
+		put: func(k Key, v Value) error {
+			if k == blocked {
+				<-unblock
+			}
+			return slow.Put(k, v)
+		},
+	}, pathname, WithPropagationWorkers(2))
+	require.Nil(t, err)
+	store.log.pollInterval = 5 * time.Millisecond
+	require.Nil(t, store.Put(blocked, Value("blocked")))
+	k := randomKey(32)
+	require.Nil(t, store.Put(k, Value("value")))
+	for deadline := time.Now().Add(time.Second); store.IsPending(k); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("item stuck behind a slow put")
+		}
+	}
+	assert.True(t, store.IsPending(blocked))
+}
+
+func TestPairedStats(t *testing.T) {
+	pathname, cleanup := disposablePathName(t)
+	defer cleanup()
+	fast := &InMemory{}
+	store, err := NewPaired(fast, &InMemory{}, pathname)
+	require.Nil(t, err)
+	store.log.pollInterval = 5 * time.Millisecond
+	// Avoid propagation until the items are in.
+	store.once.Do(func() {})
+	for _, v := range []string{"one", "two", "three"} {
+		require.Nil(t, store.Put(randomKey(32), Value(v)))
+	}
+	missing := randomKey(32)
+	require.Nil(t, store.log.add(missing, itemPending))
+	time.Sleep(10 * time.Millisecond)
+	s := store.Stats()
+	assert.Equal(t, 4, s.Pending)
+	assert.True(t, s.OldestPending >= 10*time.Millisecond, "got %v", s.OldestPending)
+
+	go store.propagate()
+	for deadline := time.Now().Add(time.Second); store.Stats().Pending > 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("items not propagated")
+		}
+	}
+	s = store.Stats()
+	assert.Equal(t, 1, s.Missing)
+	assert.Equal(t, 3, s.Done)
+	assert.Equal(t, time.Duration(0), s.OldestPending)
+	assert.Equal(t, float64(len("onetwothree"))/60, s.Throughput)
+}
+
+func TestPairedPropagatesPriorityItemsFirst(t *testing.T) {
+	pathname, cleanup := disposablePathName(t)
+	defer cleanup()
+	first := randomKey(32)
+	started, unblock := make(chan struct{}), make(chan struct{})
+	var mu sync.Mutex
+	var order []Key
+	store, err := NewPaired(&InMemory{}, storeFuncs{
+		put: func(k Key, v Value) error {
+			if k == first {
+				close(started)
+				<-unblock
+			}
+			mu.Lock()
+			order = append(order, k)
+			mu.Unlock()
+			return nil
+		},
+	}, pathname, WithPropagationWorkers(1))
+	require.Nil(t, err)
+	store.log.pollInterval = time.Millisecond
+	// The only worker will be busy with the first item while the others
+	// are queued.
+	require.Nil(t, store.Put(first, Value("first")))
+	<-started
+	regular, priority := randomKey(32), randomKey(32)
+	require.Nil(t, store.Put(regular, Value("regular")))
+	require.Nil(t, store.PutPriority(priority, Value("priority")))
+	time.Sleep(50 * time.Millisecond)
+	close(unblock)
+	for deadline := time.Now().Add(time.Second); store.Stats().Pending > 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("items not propagated")
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []Key{first, priority, regular}, order)
+}
+
+func TestPairedList(t *testing.T) {
+	pathname, cleanup := disposablePathName(t)
+	defer cleanup()
+	fast, slow := &InMemory{}, &InMemory{}
+	store, err := NewPaired(fast, slow, pathname)
+	require.Nil(t, err)
+	// Avoid propagation, so that the pending item is only in the fast store.
+	store.once.Do(func() {})
+	pending, propagated, evicted := randomKey(32), randomKey(32), randomKey(32)
+	require.Nil(t, store.Put(pending, Value("pending")))
+	require.Nil(t, fast.Put(propagated, Value("propagated")))
+	require.Nil(t, slow.Put(propagated, Value("propagated")))
+	require.Nil(t, slow.Put(evicted, Value("evicted")))
+	got := make(map[Key]int64)
+	require.Nil(t, store.List(context.Background(), "", func(item ListItem) error {
+		_, ok := got[item.Key]
+		assert.False(t, ok, "%q listed twice", item.Key)
+		got[item.Key] = item.Size
+		return nil
+	}))
+	assert.Equal(t, map[Key]int64{
+		pending:    int64(len("pending")),
+		propagated: int64(len("propagated")),
+		evicted:    int64(len("evicted")),
+	}, got)
+}
+
+func TestPairedPauseAndSchedule(t *testing.T) {
+	pathname, cleanup := disposablePathName(t)
+	defer cleanup()
+	var allowed int32
+	store, err := NewPaired(&InMemory{}, &InMemory{}, pathname, WithPropagationSchedule(func(time.Time) bool {
+		return atomic.LoadInt32(&allowed) == 1
+	}))
+	require.Nil(t, err)
+	store.log.pollInterval = time.Millisecond
+	waitPropagated := func(k Key) {
+		t.Helper()
+		for deadline := time.Now().Add(time.Second); store.IsPending(k); time.Sleep(5 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatal("item not propagated")
+			}
+		}
+	}
+
+	store.Pause()
+	priority, regular := randomKey(32), randomKey(32)
+	require.Nil(t, store.PutPriority(priority, Value("priority")))
+	require.Nil(t, store.Put(regular, Value("regular")))
+	time.Sleep(50 * time.Millisecond)
+	assert.True(t, store.IsPending(priority))
+	assert.True(t, store.Stats().Paused)
+	assert.Contains(t, store.Stats().String(), "state paused\n")
+
+	// Only priority items are propagated outside of the schedule.
+	store.Resume()
+	waitPropagated(priority)
+	time.Sleep(50 * time.Millisecond)
+	assert.True(t, store.IsPending(regular))
+	assert.Contains(t, store.Stats().String(), "state outside upload window\n")
+
+	atomic.StoreInt32(&allowed, 1)
+	store.queue.nonEmpty.Broadcast()
+	waitPropagated(regular)
+	assert.Contains(t, store.Stats().String(), "state running\n")
+}
+
+func TestPairedBoundsQueue(t *testing.T) {
+	pathname, cleanup := disposablePathName(t)
+	defer cleanup()
+	// Regular items are never allowed, so they pile up.
+	store, err := NewPaired(&InMemory{}, &InMemory{}, pathname, WithPropagationSchedule(func(time.Time) bool {
+		return false
+	}))
+	require.Nil(t, err)
+	store.log.pollInterval = time.Millisecond
+	store.queue.length = 2
+	for i := 0; i < 10; i++ {
+		require.Nil(t, store.Put(randomKey(32), Value("regular")))
+	}
+	priority := randomKey(32)
+	require.Nil(t, store.PutPriority(priority, Value("priority")))
+	for deadline := time.Now().Add(time.Second); store.IsPending(priority); time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("priority item stuck behind regular ones")
+		}
+	}
+	store.queue.mu.Lock()
+	assert.Len(t, store.queue.regular, 2)
+	store.queue.mu.Unlock()
+	assert.Equal(t, 10, store.Stats().Pending)
+
+	closed := make(chan struct{})
+	go func() {
+		store.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("close hangs")
+	}
+}
+
+func TestPairedWaitsOnlineInsteadOfRetrying(t *testing.T) {
+	pathname, cleanup := disposablePathName(t)
+	defer cleanup()
+	var offline int32 = 1
+	var waits int32
+	store, err := NewPaired(&InMemory{}, storeFuncs{
+		put: func(Key, Value) error {
+			if atomic.LoadInt32(&offline) == 1 {
+				return ErrOffline
+			}
+			return nil
+		},
+	}, pathname, WithOfflineWait(func() {
+		atomic.AddInt32(&waits, 1)
+		atomic.StoreInt32(&offline, 0)
+	}))
+	require.Nil(t, err)
+	store.log.pollInterval = time.Millisecond
+	store.retryInterval = time.Hour
+	k := randomKey(32)
+	require.Nil(t, store.Put(k, Value("value")))
+	for deadline := time.Now().Add(time.Second); store.IsPending(k); time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("item not propagated")
+		}
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&waits))
+}
+
+func TestPairedPrefetchSharesFetches(t *testing.T) {
+	pathname, cleanup := disposablePathName(t)
+	defer cleanup()
+	slow := &InMemory{}
+	k := randomKey(32)
+	require.Nil(t, slow.Put(k, Value("value")))
+	var gets int32
+	release := make(chan struct{})
+	fast := &InMemory{}
+	store, err := NewPaired(fast, storeFuncs{
+		get: func(k Key) (Value, error) {
+			atomic.AddInt32(&gets, 1)
+			<-release
+			return slow.Get(k)
+		},
+	}, pathname)
+	require.Nil(t, err)
+	assert.False(t, store.Cached(k))
+	prefetched := make(chan error)
+	go func() {
+		prefetched <- store.Prefetch(k)
+	}()
+	for atomic.LoadInt32(&gets) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	got := make(chan Value)
+	go func() {
+		v, err := store.Get(k)
+		assert.Nil(t, err)
+		got <- v
+	}()
+	// Give the get a chance to join the fetch in progress.
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	require.Nil(t, <-prefetched)
+	assert.Equal(t, Value("value"), <-got)
+	assert.True(t, store.Cached(k))
+	require.Nil(t, store.Prefetch(k))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&gets))
+	v, err := fast.Get(k)
+	require.Nil(t, err)
+	assert.Equal(t, Value("value"), v)
+}
+
+func TestPairedProtectsItemsBeingPut(t *testing.T) {
+	pathname, cleanup := disposablePathName(t)
+	defer cleanup()
+	cache, err := NewCache(t.TempDir(), 10)
+	require.Nil(t, err)
+	slow := &InMemory{}
+	var store *Paired
+	store, err = NewPaired(storeFuncs{
+		get: cache.Get,
+		put: func(k Key, v Value) error {
+			if err := cache.Put(k, v); err != nil {
+				return err
+			}
+			// A concurrent put, e.g., of a prefetched item, fills the
+			// cache before the item is in the propagation log.
+			return cache.Put(randomKey(32), Value("prefetched item"))
+		},
+		delete: cache.Delete,
+	}, slow, pathname)
+	require.Nil(t, err)
+	cache.Protect(store.IsPending)
+	store.log.pollInterval = 5 * time.Millisecond
+	k := randomKey(32)
+	require.Nil(t, store.Put(k, Value("value")))
+	for deadline := time.Now().Add(time.Second); store.IsPending(k); time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("item not propagated")
+		}
+	}
+	v, err := slow.Get(k)
+	require.Nil(t, err)
+	assert.Equal(t, Value("value"), v)
+	assert.Zero(t, store.Stats().Missing)
+}
@@ -0,0 +1,135 @@
+package storage
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/nicolagi/muscle/config"
+	"github.com/pkg/errors"
+)
+
+// Limited is a store that limits how fast values are written to and read
+// from another store, e.g., so that musclefs doesn't saturate a slow or
+// metered link. Puts wait before writing, gets wait after reading, for as
+// long as it takes for the bytes transferred to fit within the rate, with
+// bursts of up to a second's worth of bytes.
+type Limited struct {
+	store    Store
+	upload   *rateLimiter
+	download *rateLimiter
+}
+
+var (
+	_ Store  = (*Limited)(nil)
+	_ Lister = (*Limited)(nil)
+	_ Stater = (*Limited)(nil)
+)
+
+// NewLimited creates a store limiting uploads to and downloads from the
+// given store to the given rates, in bytes per second, or not at all if
+// not positive.
+func NewLimited(store Store, upload, download int64) *Limited {
+	return &Limited{
+		store:    store,
+		upload:   newRateLimiter(upload),
+		download: newRateLimiter(download),
+	}
+}
+
+// NewLimitedStore wraps the given store in a Limited if the configuration
+// sets any rates (see config.C.UploadBytesPerSecond), and returns it as is
+// otherwise.
+func NewLimitedStore(c *config.C, store Store) Store {
+	if c.UploadBytesPerSecond <= 0 && c.DownloadBytesPerSecond <= 0 {
+		return store
+	}
+	return NewLimited(store, c.UploadBytesPerSecond, c.DownloadBytesPerSecond)
+}
+
+// Get implements Store.
+func (s *Limited) Get(k Key) (Value, error) {
+	v, err := s.store.Get(k)
+	if err == nil {
+		s.download.wait(len(v))
+	}
+	return v, err
+}
+
+// Put implements Store.
+func (s *Limited) Put(k Key, v Value) error {
+	s.upload.wait(len(v))
+	return s.store.Put(k, v)
+}
+
+// Delete implements Store.
+func (s *Limited) Delete(k Key) error {
+	return s.store.Delete(k)
+}
+
+// Stat implements Stater, if the other store does.
+func (s *Limited) Stat(k Key) (ItemInfo, error) {
+	stater, ok := s.store.(Stater)
+	if !ok {
+		return ItemInfo{}, errors.Wrapf(ErrNotImplemented, "%T.Stat", s.store)
+	}
+	return stater.Stat(k)
+}
+
+// List implements Lister, if the other store does.
+func (s *Limited) List(ctx context.Context, prefix string, f func(ListItem) error) error {
+	lister, ok := s.store.(Lister)
+	if !ok {
+		return errors.Wrapf(ErrNotImplemented, "%T.List", s.store)
+	}
+	return lister.List(ctx, prefix, f)
+}
+
+// rateLimiter is a token bucket, holding up to a second's worth of bytes.
+// Callers take the bytes they need, going into debt if there aren't
+// enough, and sleep until the debt would be paid back. A nil rateLimiter
+// doesn't limit anything.
+type rateLimiter struct {
+	rate float64
+
+	// For tests.
+	now   func() time.Time
+	sleep func(time.Duration)
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(bytesPerSecond int64) *rateLimiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	return &rateLimiter{
+		rate:   float64(bytesPerSecond),
+		now:    time.Now,
+		sleep:  time.Sleep,
+		tokens: float64(bytesPerSecond),
+	}
+}
+
+func (l *rateLimiter) wait(n int) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	now := l.now()
+	if !l.last.IsZero() {
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		if l.tokens > l.rate {
+			l.tokens = l.rate
+		}
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	debt := -l.tokens
+	l.mu.Unlock()
+	if debt > 0 {
+		l.sleep(time.Duration(debt / l.rate * float64(time.Second)))
+	}
+}
@@ -0,0 +1,35 @@
+package storage
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Unix(0, 0)
+	var slept time.Duration
+	l := newRateLimiter(1000)
+	l.now = func() time.Time { return now }
+	l.sleep = func(d time.Duration) {
+		slept += d
+		now = now.Add(d)
+	}
+	// A second's worth of bytes is free.
+	l.wait(1000)
+	if slept != 0 {
+		t.Errorf("got %v, want no sleep within the burst", slept)
+	}
+	l.wait(2500)
+	if slept != 2500*time.Millisecond {
+		t.Errorf("got %v, want 2.5s", slept)
+	}
+	// After a long pause, the bucket is full again, but not fuller.
+	now = now.Add(time.Hour)
+	slept = 0
+	l.wait(1500)
+	if slept != 500*time.Millisecond {
+		t.Errorf("got %v, want 0.5s", slept)
+	}
+	var unlimited *rateLimiter
+	unlimited.wait(1 << 30)
+}
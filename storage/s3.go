@@ -2,10 +2,13 @@ package storage
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
-	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
@@ -21,15 +24,58 @@ type s3Store struct {
 	bucket string
 }
 
-var _ Store = (*s3Store)(nil)
+var (
+	_ Store       = (*s3Store)(nil)
+	_ Lister      = (*s3Store)(nil)
+	_ RangeGetter = (*s3Store)(nil)
+	_ Swapper     = (*s3Store)(nil)
+)
+
+// Number of times failed requests are retried. I have very bad connectivity.
+// Tests lower it, so that failures show quickly.
+var s3MaxRetries = 16
 
 func newS3Store(c *config.C) (Store, error) {
-	const maxRetries = 16 // I have  very bad connectivity.
-	sess, err := session.NewSession(&aws.Config{
+	ac := &aws.Config{
 		Region:      aws.String(c.S3Region),
 		Credentials: credentials.NewSharedCredentials("", c.S3Profile),
-		MaxRetries:  aws.Int(maxRetries),
-	})
+		MaxRetries:  aws.Int(s3MaxRetries),
+	}
+	if c.S3AccessKeyID != "" || c.S3SecretAccessKey != "" {
+		ac.Credentials = credentials.NewStaticCredentials(c.S3AccessKeyID, c.S3SecretAccessKey, "")
+	}
+	if c.S3Endpoint != "" {
+		ac.Endpoint = aws.String(c.S3Endpoint)
+		if c.S3Region == "" {
+			// Required by the SDK, although mostly meaningless.
+			ac.Region = aws.String("us-east-1")
+		}
+	}
+	if c.S3PathStyle {
+		ac.S3ForcePathStyle = aws.Bool(true)
+	}
+	if c.S3CAFile != "" || c.S3InsecureSkipVerify {
+		// Our own transport, rather than the default one, which the SDK
+		// would modify to trust the CA file.
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: c.S3InsecureSkipVerify}
+		ac.HTTPClient = &http.Client{Transport: transport}
+	}
+	opts := session.Options{Config: *ac}
+	if c.S3CAFile != "" {
+		// Passed as a session option, rather than set in the TLS config of
+		// the HTTP client, the CA bundle takes precedence over the one named
+		// by the AWS_CA_BUNDLE environment variable.
+		pem, err := ioutil.ReadFile(c.S3CAFile)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if !x509.NewCertPool().AppendCertsFromPEM(pem) {
+			return nil, errors.Errorf("%q: no certificates found", c.S3CAFile)
+		}
+		opts.CustomCABundle = bytes.NewReader(pem)
+	}
+	sess, err := session.NewSessionWithOptions(opts)
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
@@ -40,6 +86,12 @@ func newS3Store(c *config.C) (Store, error) {
 }
 
 func (s *s3Store) Get(key Key) (contents Value, err error) {
+	contents, _, err = s.get(key)
+	return contents, err
+}
+
+// get returns the value of the item and its entity tag.
+func (s *s3Store) get(key Key) (contents Value, etag string, err error) {
 	output, err := s.client.GetObject(&s3.GetObjectInput{
 		Bucket: aws.String(s.bucket),
 		Key:    aws.String(string(key)),
@@ -47,17 +99,18 @@ func (s *s3Store) Get(key Key) (contents Value, err error) {
 	if err != nil {
 		if rfErr, ok := err.(awserr.RequestFailure); ok {
 			if rfErr.StatusCode() == http.StatusNotFound {
-				return nil, errors.Wrapf(ErrNotFound, "key=%q err=%+v", key, err)
+				return nil, "", errors.Wrapf(ErrNotFound, "key=%q err=%+v", key, err)
 			}
 		}
-		return nil, err
+		return nil, "", err
 	}
 	defer func() {
 		if err := output.Body.Close(); err != nil {
 			log.Printf("warning: storage.s3Store.Get: could not close response body: %v", err)
 		}
 	}()
-	return ioutil.ReadAll(output.Body)
+	contents, err = ioutil.ReadAll(output.Body)
+	return contents, aws.StringValue(output.ETag), err
 }
 
 func (s *s3Store) Put(key Key, value Value) (err error) {
@@ -72,6 +125,96 @@ func (s *s3Store) Put(key Key, value Value) (err error) {
 	return nil
 }
 
+// GetRange implements RangeGetter.
+func (s *s3Store) GetRange(key Key, offset, length int64) (Value, error) {
+	if length <= 0 {
+		return Value{}, nil
+	}
+	output, err := s.client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(string(key)),
+		Range:  aws.String(fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)),
+	})
+	if err != nil {
+		if rfErr, ok := err.(awserr.RequestFailure); ok {
+			switch rfErr.StatusCode() {
+			case http.StatusNotFound:
+				return nil, errors.Wrapf(ErrNotFound, "key=%q err=%+v", key, err)
+			case http.StatusRequestedRangeNotSatisfiable:
+				return Value{}, nil
+			}
+		}
+		return nil, errors.WithStack(err)
+	}
+	defer func() {
+		if err := output.Body.Close(); err != nil {
+			log.Printf("warning: storage.s3Store.GetRange: could not close response body: %v", err)
+		}
+	}()
+	return ioutil.ReadAll(output.Body)
+}
+
+// Swap implements Swapper. It compares the current value with old, then
+// puts the new value with an If-Match (or If-None-Match, if the item must
+// not exist) condition on the entity tag of the value compared, so that a
+// concurrent update in between makes the put fail. The versions of the SDK
+// in use predate these fields of PutObjectInput, hence the headers are set
+// on the request. Servers that ignore the conditions degrade to a
+// read-compare-write, which narrows but doesn't close the race.
+func (s *s3Store) Swap(key Key, old, new Value) error {
+	current, etag, err := s.get(key)
+	switch {
+	case errors.Is(err, ErrNotFound):
+		if old != nil {
+			return errors.Wrapf(ErrConflict, "key=%q: missing", key)
+		}
+	case err != nil:
+		return err
+	case old == nil || !bytes.Equal(current, old):
+		return errors.Wrapf(ErrConflict, "key=%q: value changed", key)
+	}
+	req, _ := s.client.PutObjectRequest(&s3.PutObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(string(key)),
+		Body:   bytes.NewReader(new),
+	})
+	if old == nil {
+		req.HTTPRequest.Header.Set("If-None-Match", "*")
+	} else {
+		req.HTTPRequest.Header.Set("If-Match", etag)
+	}
+	if err := req.Send(); err != nil {
+		if rfErr, ok := err.(awserr.RequestFailure); ok {
+			switch rfErr.StatusCode() {
+			case http.StatusPreconditionFailed, http.StatusConflict:
+				return errors.Wrapf(ErrConflict, "key=%q err=%+v", key, err)
+			}
+		}
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+// Stat implements Stater.
+func (s *s3Store) Stat(key Key) (ItemInfo, error) {
+	output, err := s.client.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(string(key)),
+	})
+	if err != nil {
+		if rfErr, ok := err.(awserr.RequestFailure); ok {
+			if rfErr.StatusCode() == http.StatusNotFound {
+				return ItemInfo{}, errors.Wrapf(ErrNotFound, "key=%q err=%+v", key, err)
+			}
+		}
+		return ItemInfo{}, errors.WithStack(err)
+	}
+	return ItemInfo{
+		Size:     aws.Int64Value(output.ContentLength),
+		Modified: aws.TimeValue(output.LastModified),
+	}, nil
+}
+
 func (s *s3Store) Delete(key Key) error {
 	if _, err := s.client.DeleteObject(&s3.DeleteObjectInput{
 		Bucket: aws.String(s.bucket),
@@ -82,34 +225,32 @@ func (s *s3Store) Delete(key Key) error {
 	return nil
 }
 
-func (s *s3Store) List() (keys chan string, err error) {
-	keys = make(chan string)
-	go s.list(keys)
-	return keys, nil
-}
-
-func (s *s3Store) list(recv chan string) {
-	input := &s3.ListObjectsInput{
-		Bucket:    aws.String(s.bucket),
-		Delimiter: aws.String(","),
-	}
-	var output *s3.ListObjectsOutput
-	var err error
-	for {
-		output, err = s.client.ListObjects(input)
-		if err != nil {
-			log.Printf("warning: storage.s3Store.list: %v", err)
-			// Retry indefinitely.
-			time.Sleep(5 * time.Second)
-			continue
-		}
-		for _, o := range output.Contents {
-			recv <- *o.Key
-		}
-		if output.NextMarker == nil {
-			break
+// List implements Lister.
+func (s *s3Store) List(ctx context.Context, prefix string, f func(ListItem) error) error {
+	var ferr error
+	err := s.client.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(prefix),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, o := range page.Contents {
+			ferr = f(ListItem{
+				Key: Key(aws.StringValue(o.Key)),
+				ItemInfo: ItemInfo{
+					Size:     aws.Int64Value(o.Size),
+					Modified: aws.TimeValue(o.LastModified),
+				},
+			})
+			if ferr != nil {
+				return false
+			}
 		}
-		input.Marker = output.NextMarker
+		return true
+	})
+	if ferr != nil {
+		return ferr
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
 	}
-	close(recv)
+	return errors.WithStack(err)
 }
@@ -0,0 +1,242 @@
+package storage
+
+import (
+	"crypto/md5"
+	"encoding/pem"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nicolagi/muscle/config"
+)
+
+// fakeS3 is a minimal S3 server, good enough for s3Store, addressed
+// path-style, including conditional puts and ranged gets. It only supports version 2 of
+// listings, and returns few keys per page, so that pagination is exercised.
+type fakeS3 struct {
+	bucket   string
+	pageSize int
+
+	mu      sync.Mutex
+	objects map[string]fakeObject
+}
+
+type fakeObject struct {
+	data     []byte
+	modified time.Time
+}
+
+type fakeListing struct {
+	XMLName               xml.Name `xml:"ListBucketResult"`
+	Name                  string
+	Prefix                string
+	ContinuationToken     string `xml:",omitempty"`
+	NextContinuationToken string `xml:",omitempty"`
+	KeyCount              int
+	MaxKeys               int
+	IsTruncated           bool
+	Contents              []fakeListingEntry
+}
+
+type fakeListingEntry struct {
+	Key          string
+	LastModified string
+	ETag         string
+	Size         int
+}
+
+func newFakeS3(bucket string) *fakeS3 {
+	return &fakeS3{
+		bucket:   bucket,
+		pageSize: 7,
+		objects:  make(map[string]fakeObject),
+	}
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	bucket, key := path, ""
+	if i := strings.IndexByte(path, '/'); i >= 0 {
+		bucket, key = path[:i], path[i+1:]
+	}
+	if bucket != f.bucket {
+		f.fail(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch {
+	case key == "" && r.Method == http.MethodGet && r.URL.Query().Get("list-type") == "2":
+		f.list(w, r)
+	case r.Method == http.MethodPut:
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			f.fail(w, http.StatusBadRequest, "IncompleteBody")
+			return
+		}
+		o, ok := f.objects[key]
+		if ifMatch := r.Header.Get("If-Match"); ifMatch != "" && (!ok || ifMatch != etag(o.data)) {
+			f.fail(w, http.StatusPreconditionFailed, "PreconditionFailed")
+			return
+		}
+		if r.Header.Get("If-None-Match") == "*" && ok {
+			f.fail(w, http.StatusPreconditionFailed, "PreconditionFailed")
+			return
+		}
+		f.objects[key] = fakeObject{data: data, modified: time.Now().UTC()}
+		w.Header().Set("ETag", etag(data))
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		o, ok := f.objects[key]
+		if !ok {
+			f.fail(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		data := o.data
+		var first, last int
+		ranged := false
+		if n, _ := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &first, &last); n == 2 {
+			if first >= len(data) {
+				f.fail(w, http.StatusRequestedRangeNotSatisfiable, "InvalidRange")
+				return
+			}
+			if last >= len(data) {
+				last = len(data) - 1
+			}
+			data = data[first : last+1]
+			ranged = true
+		}
+		// Not before the checks above, or errors would carry the length of the object.
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Header().Set("Last-Modified", o.modified.Format(http.TimeFormat))
+		w.Header().Set("ETag", etag(o.data))
+		if ranged {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", first, last, len(o.data)))
+			w.WriteHeader(http.StatusPartialContent)
+		}
+		if r.Method == http.MethodGet {
+			_, _ = w.Write(data)
+		}
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		f.fail(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
+
+// Pre-condition: f.mu is locked.
+func (f *fakeS3) list(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	result := fakeListing{
+		Name:              f.bucket,
+		Prefix:            query.Get("prefix"),
+		ContinuationToken: query.Get("continuation-token"),
+		MaxKeys:           f.pageSize,
+	}
+	// The continuation token is the last key of the previous page.
+	var keys []string
+	for key := range f.objects {
+		if key > result.ContinuationToken && strings.HasPrefix(key, result.Prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	if len(keys) > f.pageSize {
+		keys = keys[:f.pageSize]
+		result.IsTruncated = true
+		result.NextContinuationToken = keys[len(keys)-1]
+	}
+	result.KeyCount = len(keys)
+	for _, key := range keys {
+		o := f.objects[key]
+		result.Contents = append(result.Contents, fakeListingEntry{
+			Key:          key,
+			LastModified: o.modified.Format("2006-01-02T15:04:05.000Z"),
+			ETag:         etag(o.data),
+			Size:         len(o.data),
+		})
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	_, _ = w.Write([]byte(xml.Header))
+	_ = xml.NewEncoder(w).Encode(result)
+}
+
+func (f *fakeS3) fail(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	_, _ = fmt.Fprintf(w, "%s<Error><Code>%s</Code><Message>%s</Message></Error>", xml.Header, code, code)
+}
+
+func etag(data []byte) string {
+	return fmt.Sprintf("%q", fmt.Sprintf("%x", md5.Sum(data)))
+}
+
+// lowerS3Retries makes requests to the fake S3 fail at once, rather than
+// after many retries, e.g., when the test is wrong.
+func lowerS3Retries(t *testing.T) {
+	saved := s3MaxRetries
+	s3MaxRetries = 1
+	t.Cleanup(func() { s3MaxRetries = saved })
+}
+
+func TestS3StoreContract(t *testing.T) {
+	lowerS3Retries(t)
+	server := httptest.NewServer(newFakeS3("bucket"))
+	defer server.Close()
+	store, err := newS3Store(&config.C{
+		Storage:           "s3",
+		S3Endpoint:        server.URL,
+		S3PathStyle:       true,
+		S3AccessKeyID:     "id",
+		S3SecretAccessKey: "secret",
+		S3Bucket:          "bucket",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStoreContract(t, store)
+}
+
+func TestS3StoreTLSOptions(t *testing.T) {
+	lowerS3Retries(t)
+	server := httptest.NewTLSServer(newFakeS3("bucket"))
+	defer server.Close()
+	newStore := func(t *testing.T, c config.C) Store {
+		t.Helper()
+		c.Storage = "s3"
+		c.S3Endpoint = server.URL
+		c.S3PathStyle = true
+		c.S3AccessKeyID = "id"
+		c.S3SecretAccessKey = "secret"
+		c.S3Bucket = "bucket"
+		store, err := newS3Store(&c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return store
+	}
+	t.Run("trusted certificate", func(t *testing.T) {
+		caFile := filepath.Join(t.TempDir(), "ca.pem")
+		block := &pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}
+		if err := ioutil.WriteFile(caFile, pem.EncodeToMemory(block), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := newStore(t, config.C{S3CAFile: caFile}).Put(RandomPointer().Key(), Value("value")); err != nil {
+			t.Error(err)
+		}
+	})
+	t.Run("skip verification", func(t *testing.T) {
+		if err := newStore(t, config.C{S3InsecureSkipVerify: true}).Put(RandomPointer().Key(), Value("value")); err != nil {
+			t.Error(err)
+		}
+	})
+}
@@ -1,8 +1,10 @@
 package storage
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"time"
 
 	"github.com/nicolagi/muscle/config"
 )
@@ -10,6 +12,7 @@ import (
 var (
 	ErrNotFound       = errors.New("not found")
 	ErrNotImplemented = errors.New("not implemented")
+	ErrConflict       = errors.New("conflict")
 )
 
 type Key string
@@ -22,11 +25,68 @@ type Store interface {
 	Delete(Key) error
 }
 
+// Lister is implemented by stores that can enumerate their items. List
+// calls f for each item whose key starts with prefix, in no particular
+// order, and stops at the first error, which it returns, whether it comes
+// from the store, from f, or from ctx being done. Items put or deleted
+// while listing may or may not be listed.
 type Lister interface {
-	// TODO: This interface is strange; how can the error be known right away, but the
-	// keys are progressively written to the channel? Isn't it possible to encounter an error
-	// after List() returns, e.g., paginating results sets?
-	List() (keys chan string, err error)
+	List(ctx context.Context, prefix string, f func(ListItem) error) error
+}
+
+// ListItem describes an item found by List. Some stores don't track the
+// modification times of items, leaving it zero.
+type ListItem struct {
+	Key Key
+	ItemInfo
+}
+
+// PriorityPutter is implemented by stores that write items asynchronously,
+// e.g., Paired. PutPriority is like Put, but the item is written ahead of
+// those put with Put, e.g., because it's small and needed to make sense of
+// the others.
+type PriorityPutter interface {
+	PutPriority(Key, Value) error
+}
+
+// Swapper is implemented by stores that can update an item atomically,
+// conditionally on its current value, e.g., so that two hosts pushing at the
+// same time can't both move the remote root pointer. Swap replaces the
+// value of the item with new if the current one is old, and fails with an
+// error wrapping ErrConflict otherwise. A nil old means the item must not
+// exist.
+type Swapper interface {
+	Swap(k Key, old, new Value) error
+}
+
+// RangeGetter is implemented by stores that can read part of an item's
+// value, e.g., with an HTTP range request. GetRange returns length bytes
+// starting at offset, or fewer if the value is shorter.
+type RangeGetter interface {
+	GetRange(k Key, offset, length int64) (Value, error)
+}
+
+// Refetcher is implemented by stores that cache items from another store.
+// Refetch drops the cached copy of an item, e.g., because it was found to
+// be corrupted, and returns a fresh copy, which isn't cached until given to
+// Recache, e.g., once the caller has verified it.
+type Refetcher interface {
+	Refetch(Key) (Value, error)
+	Recache(Key, Value) error
+}
+
+// ItemInfo describes a stored item.
+type ItemInfo struct {
+	// Size is the space taken by the item in the store, which is at
+	// least the size of its value.
+	Size     int64
+	Modified time.Time
+}
+
+// Stater is implemented by stores that can describe an item without
+// reading it. Stat returns an error wrapping ErrNotFound for missing items.
+type Stater interface {
+	Stat(Key) (ItemInfo, error)
 }
 
 type Enumerable interface {
@@ -44,6 +104,26 @@ func NewStore(c *config.C) (Store, error) {
 		return NullStore{}, nil
 	case "s3":
 		return newS3Store(c)
+	case "mirror":
+		var mirrors []Store
+		for _, mc := range c.Mirrors {
+			m, err := NewStore(mc)
+			if err != nil {
+				return nil, fmt.Errorf("mirror: %w", err)
+			}
+			mirrors = append(mirrors, m)
+		}
+		return NewMirror(mirrors, c.MirrorWriteQuorum)
+	case "erasure":
+		var stores []Store
+		for _, sc := range c.ErasureShards {
+			s, err := NewStore(sc)
+			if err != nil {
+				return nil, fmt.Errorf("erasure: %w", err)
+			}
+			stores = append(stores, s)
+		}
+		return NewErasure(stores, c.ErasureDataShards)
 	default:
 		return nil, fmt.Errorf("%q: %w", c.Storage, ErrNotImplemented)
 	}
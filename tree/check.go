@@ -0,0 +1,278 @@
+package tree
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"sync"
+
+	"github.com/nicolagi/muscle/internal/block"
+	"github.com/nicolagi/muscle/storage"
+	"github.com/pkg/errors"
+)
+
+// CheckOption values influence the behavior of Store.Check.
+type CheckOption func(*checker)
+
+// WithCheckWorkers sets how many nodes are checked concurrently, 16 by
+// default.
+func WithCheckWorkers(n int) CheckOption {
+	return func(c *checker) {
+		if n > 0 {
+			c.workers = n
+		}
+	}
+}
+
+// WithRepair specifies how to restore items found missing, e.g., by copying
+// them from a local cache. Items restored successfully are checked again.
+func WithRepair(repair func(storage.Key) error) CheckOption {
+	return func(c *checker) {
+		c.repair = repair
+	}
+}
+
+// CheckReport is the outcome of Store.Check.
+type CheckReport struct {
+	// Number of nodes and file blocks checked.
+	Nodes  int
+	Blocks int
+	// Number of missing items restored (see WithRepair).
+	Repaired int
+	// Problems found, sorted by path.
+	Problems []CheckProblem
+}
+
+// CheckProblem is an inconsistency found by Store.Check. The path is that
+// of the node affected, or of its parent directory if the node couldn't be
+// loaded.
+type CheckProblem struct {
+	Path string
+	Err  error
+}
+
+func (p CheckProblem) String() string {
+	return fmt.Sprintf("%s: %v", p.Path, p.Err)
+}
+
+// Check verifies that the tree of a revision is intact: the revision and
+// all nodes can be loaded and decoded, all blocks exist and their values
+// match their hashes, file sizes agree with the sizes of their blocks, and
+// no directory has two children with the same name. Items are read through
+// the store's block factory, so to check the remote store, rather than a
+// local cache, the factory must read from the remote store directly.
+//
+// It fails only if the revision can't be loaded; other problems are
+// reported.
+func (s *Store) Check(revision storage.Pointer, opts ...CheckOption) (*CheckReport, error) {
+	c := &checker{
+		store:   s,
+		workers: 16,
+		report:  new(CheckReport),
+	}
+	for _, o := range opts {
+		o(c)
+	}
+	c.cond = sync.NewCond(&c.mu)
+	var r *Revision
+	if err := c.withRepair(revision.Key(), func() (err error) {
+		r, err = s.LoadRevisionByKey(revision)
+		return err
+	}); err != nil {
+		return nil, errors.Wrapf(err, "tree.Store.Check: revision %v", revision)
+	}
+	if !r.RootKey().IsNull() {
+		c.run(checkItem{node: &Node{pointer: r.RootKey()}})
+	}
+	sort.SliceStable(c.report.Problems, func(i, j int) bool {
+		return c.report.Problems[i].Path < c.report.Problems[j].Path
+	})
+	return c.report, nil
+}
+
+type checker struct {
+	store   *Store
+	workers int
+	repair  func(storage.Key) error
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	queue  []checkItem
+	active int
+	report *CheckReport
+}
+
+// A checkItem is a node to be loaded and checked. The parent path is empty
+// for the root; siblings share the set of names seen so far.
+type checkItem struct {
+	parent string
+	names  *childNames
+	node   *Node
+}
+
+type childNames struct {
+	sync.Mutex
+	seen map[string]bool
+}
+
+// run checks nodes with a fixed number of workers, depth first, until
+// there are no more nodes to check.
+func (c *checker) run(root checkItem) {
+	c.queue = append(c.queue, root)
+	var wg sync.WaitGroup
+	for i := 0; i < c.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				item, ok := c.pop()
+				if !ok {
+					return
+				}
+				c.done(c.check(item))
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func (c *checker) pop() (item checkItem, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(c.queue) == 0 && c.active > 0 {
+		c.cond.Wait()
+	}
+	if len(c.queue) == 0 {
+		return item, false
+	}
+	item = c.queue[len(c.queue)-1]
+	c.queue = c.queue[:len(c.queue)-1]
+	c.active++
+	return item, true
+}
+
+func (c *checker) done(children []checkItem) {
+	c.mu.Lock()
+	c.queue = append(c.queue, children...)
+	c.active--
+	c.cond.Broadcast()
+	c.mu.Unlock()
+}
+
+func (c *checker) problem(path string, err error) {
+	c.mu.Lock()
+	c.report.Problems = append(c.report.Problems, CheckProblem{Path: path, Err: err})
+	c.mu.Unlock()
+}
+
+// withRepair calls f, and if it fails because an item is missing, restores
+// the item, if possible, and calls f again.
+func (c *checker) withRepair(key storage.Key, f func() error) error {
+	err := f()
+	if c.repair == nil || !errors.Is(err, storage.ErrNotFound) {
+		return err
+	}
+	if rerr := c.repair(key); rerr != nil {
+		return fmt.Errorf("%w; could not repair: %v", err, rerr)
+	}
+	c.mu.Lock()
+	c.report.Repaired++
+	c.mu.Unlock()
+	return f()
+}
+
+// check loads and checks a node, and returns its children, if any.
+func (c *checker) check(item checkItem) []checkItem {
+	node := item.node
+	where := item.parent
+	if where == "" {
+		where = "/"
+	}
+	if ref, err := block.NewRef(node.pointer); err != nil {
+		c.problem(where, errors.Wrapf(err, "child node %v", node.pointer))
+		return nil
+	} else if _, ok := ref.(block.RepositoryRef); !ok {
+		c.problem(where, errors.Errorf("child node %v not sealed, only in the local staging area", node.pointer))
+		return nil
+	}
+	if err := c.withRepair(node.pointer.Key(), func() error {
+		return c.store.LoadNode(node)
+	}); err != nil {
+		c.problem(where, errors.Wrapf(err, "child node %v", node.pointer))
+		return nil
+	}
+	c.mu.Lock()
+	c.report.Nodes++
+	c.mu.Unlock()
+	p := "/"
+	if item.parent != "" {
+		p = path.Join(item.parent, node.info.Name)
+	}
+	if item.names != nil {
+		item.names.Lock()
+		if item.names.seen[node.info.Name] {
+			c.problem(item.parent, errors.Errorf("duplicate child name %q", node.info.Name))
+		}
+		item.names.seen[node.info.Name] = true
+		item.names.Unlock()
+	}
+	if node.IsDir() {
+		names := &childNames{seen: make(map[string]bool)}
+		children := make([]checkItem, len(node.children))
+		for i, child := range node.children {
+			children[i] = checkItem{parent: p, names: names, node: child}
+		}
+		// Let checked subtrees be garbage collected.
+		node.children = nil
+		return children
+	}
+	c.checkBlocks(p, node)
+	node.blocks = nil
+	return nil
+}
+
+// checkBlocks reads all blocks of a file, thereby verifying their hashes,
+// and checks their sizes against the file size and the chunking scheme.
+func (c *checker) checkBlocks(p string, node *Node) {
+	if node.chunking == contentChunking && len(node.ends) != len(node.blocks) {
+		c.problem(p, errors.Errorf("%d block ends for %d blocks", len(node.ends), len(node.blocks)))
+		return
+	}
+	var total uint64
+	for i, b := range node.blocks {
+		if _, ok := b.Ref().(block.RepositoryRef); !ok {
+			c.problem(p, errors.Errorf("block %d (%v) not sealed, only in the local staging area", i, b.Ref()))
+			return
+		}
+		var n int
+		if err := c.withRepair(b.Ref().Key(), func() (err error) {
+			n, err = b.Size()
+			return err
+		}); err != nil {
+			c.problem(p, errors.Wrapf(err, "block %d (%v)", i, b.Ref()))
+			return
+		}
+		b.Forget()
+		c.mu.Lock()
+		c.report.Blocks++
+		c.mu.Unlock()
+		var want int
+		switch {
+		case node.chunking == contentChunking:
+			want = node.blockLen(i)
+		case i < len(node.blocks)-1:
+			want = int(node.bsize)
+		default:
+			want = n
+		}
+		if n != want {
+			c.problem(p, errors.Errorf("block %d (%v) holds %d bytes, want %d", i, b.Ref(), n, want))
+		}
+		total += uint64(n)
+	}
+	if total < node.info.Size {
+		c.problem(p, fmt.Errorf("blocks hold %d of %d bytes: %w", total, node.info.Size, errTreeNodeTruncated))
+	} else if total > node.info.Size {
+		c.problem(p, errors.Errorf("blocks hold %d bytes, more than the size, %d", total, node.info.Size))
+	}
+}
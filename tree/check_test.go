@@ -0,0 +1,157 @@
+package tree
+
+import (
+	"errors"
+	"math/rand"
+	"testing"
+
+	"github.com/nicolagi/muscle/internal/block"
+	"github.com/nicolagi/muscle/storage"
+)
+
+func TestStoreCheck(t *testing.T) {
+	key := make([]byte, 16)
+	rand.Read(key)
+	repository := &storage.InMemory{}
+	bf, err := block.NewFactory(&storage.InMemory{}, repository, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	treeStore, err := NewStore(bf, &storage.InMemory{}, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree, err := NewTree(treeStore, WithMutable(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, root := tree.Root()
+	dir, err := tree.Add(root, "a", 0700|DMDIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	long, err := tree.Add(dir, "long", 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := long.WriteAt([]byte("hello, world"), 0); err != nil {
+		t.Fatal(err)
+	}
+	short, err := tree.Add(root, "short", 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := short.WriteAt([]byte("xy"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Seal(); err != nil {
+		t.Fatal(err)
+	}
+	revision := NewRevision(root, storage.Null)
+	if err := treeStore.StoreRevision(revision); err != nil {
+		t.Fatal(err)
+	}
+	check := func(t *testing.T, opts ...CheckOption) *CheckReport {
+		t.Helper()
+		report, err := treeStore.Check(revision.Key(), opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return report
+	}
+
+	t.Run("intact", func(t *testing.T) {
+		report := check(t)
+		if len(report.Problems) != 0 {
+			t.Errorf("got problems %v", report.Problems)
+		}
+		if report.Nodes != 4 || report.Blocks != 4 {
+			t.Errorf("got %d nodes and %d blocks, want 4 and 4", report.Nodes, report.Blocks)
+		}
+	})
+
+	missing := long.blocks[1].Ref().Key()
+	backup, err := repository.Get(missing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repository.Delete(missing); err != nil {
+		t.Fatal(err)
+	}
+	t.Run("missing block", func(t *testing.T) {
+		report := check(t)
+		if len(report.Problems) != 1 {
+			t.Fatalf("got problems %v, want one", report.Problems)
+		}
+		if p := report.Problems[0]; p.Path != "/a/long" || !errors.Is(p.Err, storage.ErrNotFound) {
+			t.Errorf("got %v", p)
+		}
+	})
+	t.Run("repair", func(t *testing.T) {
+		report := check(t, WithCheckWorkers(1), WithRepair(func(k storage.Key) error {
+			if k != missing {
+				t.Errorf("got %q, want %q", k, missing)
+			}
+			return repository.Put(k, backup)
+		}))
+		if len(report.Problems) != 0 || report.Repaired != 1 {
+			t.Errorf("got problems %v and %d repaired, want none and 1", report.Problems, report.Repaired)
+		}
+	})
+
+	corrupt := short.blocks[0].Ref().Key()
+	if err := repository.Put(corrupt, storage.Value("garbage")); err != nil {
+		t.Fatal(err)
+	}
+	t.Run("corrupt block", func(t *testing.T) {
+		report := check(t)
+		if len(report.Problems) != 1 || report.Problems[0].Path != "/short" {
+			t.Errorf("got problems %v, want one for /short", report.Problems)
+		}
+	})
+
+	t.Run("missing revision", func(t *testing.T) {
+		if _, err := treeStore.Check(storage.RandomPointer()); !errors.Is(err, storage.ErrNotFound) {
+			t.Errorf("got %v, want %v", err, storage.ErrNotFound)
+		}
+	})
+}
+
+func TestStoreCheckFindsDuplicateNames(t *testing.T) {
+	key := make([]byte, 16)
+	rand.Read(key)
+	bf, err := block.NewFactory(&storage.InMemory{}, &storage.InMemory{}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	treeStore, err := NewStore(bf, &storage.InMemory{}, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree, err := NewTree(treeStore, WithMutable(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, root := tree.Root()
+	for _, name := range []string{"one", "two"} {
+		if _, err := tree.Add(root, name, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Bypass the checks of Rename, like the merge bugs did.
+	root.children[1].info.Name = "one"
+	if err := tree.Seal(); err != nil {
+		t.Fatal(err)
+	}
+	revision := NewRevision(root, storage.Null)
+	if err := treeStore.StoreRevision(revision); err != nil {
+		t.Fatal(err)
+	}
+	report, err := treeStore.Check(revision.Key())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Problems) != 1 || report.Problems[0].Path != "/" {
+		t.Errorf("got problems %v, want one for /", report.Problems)
+	}
+}
@@ -0,0 +1,306 @@
+package tree
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/nicolagi/muscle/internal/block"
+	"github.com/nicolagi/muscle/internal/chunker"
+	"github.com/pkg/errors"
+)
+
+// A chunkingScheme determines how the content of a file is split into
+// blocks. It is recorded in each node, so that nodes written with
+// different schemes can coexist in the same tree.
+type chunkingScheme uint8
+
+const (
+	// All blocks but the last are exactly bsize bytes long.
+	fixedChunking chunkingScheme = iota
+
+	// Block boundaries are determined by the content (see
+	// internal/chunker), and the block size is only the maximum size of a
+	// block. Editing a file only changes the blocks around the edits, even
+	// if the edits insert or remove bytes.
+	contentChunking
+)
+
+func parseChunking(name string) (chunkingScheme, error) {
+	switch name {
+	case "", "fixed":
+		return fixedChunking, nil
+	case "fastcdc":
+		return contentChunking, nil
+	default:
+		return 0, errors.Errorf("unknown chunking scheme %q", name)
+	}
+}
+
+func (scheme chunkingScheme) String() string {
+	switch scheme {
+	case fixedChunking:
+		return "fixed"
+	case contentChunking:
+		return "fastcdc"
+	default:
+		return fmt.Sprintf("chunking(%d)", uint8(scheme))
+	}
+}
+
+// The functions below are only relevant for nodes using content-defined
+// chunking. Such nodes keep track of where each block ends, because blocks
+// have variable length. Writes are applied in place to the existing blocks,
+// and the blocks that have been written to are split again into
+// content-defined chunks before they are flushed or sealed (see
+// Node.rechunk).
+
+func (node *Node) blockStart(i int) uint64 {
+	if i == 0 {
+		return 0
+	}
+	return node.ends[i-1]
+}
+
+func (node *Node) blockLen(i int) int {
+	return int(node.ends[i] - node.blockStart(i))
+}
+
+// locate returns the index of the block containing the given offset, and
+// the offset within that block. If the offset is at or past the end of the
+// file, the index returned is the number of blocks.
+func (node *Node) locate(off uint64) (index int, blockOff int) {
+	index = sort.Search(len(node.ends), func(i int) bool {
+		return node.ends[i] > off
+	})
+	return index, int(off - node.blockStart(index))
+}
+
+// markRechunk records that blocks with indices in [from, to) need to be
+// chunked again.
+func (node *Node) markRechunk(from, to int) {
+	if node.rechunkTo <= node.rechunkFrom {
+		node.rechunkFrom, node.rechunkTo = from, to
+		return
+	}
+	if from < node.rechunkFrom {
+		node.rechunkFrom = from
+	}
+	if to > node.rechunkTo {
+		node.rechunkTo = to
+	}
+}
+
+// appendChunk adds an empty block at the end of the file.
+func (node *Node) appendChunk() error {
+	b, err := node.blockFactory.New(nil, int(node.bsize))
+	if err != nil {
+		return err
+	}
+	node.blocks = append(node.blocks, b)
+	node.ends = append(node.ends, node.info.Size)
+	return nil
+}
+
+// lastChunkForAppending returns the index of the last block, adding a new
+// block if there are no blocks or the last block is full.
+func (node *Node) lastChunkForAppending() (int, error) {
+	last := len(node.blocks) - 1
+	if last < 0 || node.blockLen(last) >= int(node.bsize) {
+		if err := node.appendChunk(); err != nil {
+			return 0, err
+		}
+		last++
+	}
+	return last, nil
+}
+
+func (node *Node) growChunks(requestedSize uint64) error {
+	for node.info.Size < requestedSize {
+		i, err := node.lastChunkForAppending()
+		if err != nil {
+			return err
+		}
+		n := uint64(int(node.bsize) - node.blockLen(i))
+		if missing := requestedSize - node.info.Size; n > missing {
+			n = missing
+		}
+		if err := node.blocks[i].Truncate(node.blockLen(i) + int(n)); err != nil {
+			return err
+		}
+		node.cache.touchBlock(node.blocks[i])
+		node.ends[i] += n
+		node.info.Size += n
+		node.markRechunk(i, i+1)
+	}
+	return nil
+}
+
+func (node *Node) shrinkChunks(requestedSize uint64) error {
+	q, r := node.locate(requestedSize)
+	if r > 0 {
+		if err := node.blocks[q].Truncate(r); err != nil {
+			return err
+		}
+		node.cache.touchBlock(node.blocks[q])
+		node.ends[q] = requestedSize
+		node.markRechunk(q, q+1)
+		q++
+	}
+	for _, b := range node.blocks[q:] {
+		node.dropBlock(b)
+	}
+	node.blocks = node.blocks[:q]
+	node.ends = node.ends[:q]
+	if node.rechunkTo > q {
+		node.rechunkTo = q
+	}
+	return nil
+}
+
+func (node *Node) writeChunks(p []byte, off int64) error {
+	if uint64(off) > node.info.Size {
+		if err := node.growChunks(uint64(off)); err != nil {
+			return err
+		}
+	}
+	for len(p) > 0 {
+		i, o := node.locate(uint64(off))
+		if i == len(node.blocks) {
+			var err error
+			if i, err = node.lastChunkForAppending(); err != nil {
+				return err
+			}
+			o = int(uint64(off) - node.blockStart(i))
+		}
+		chunk := p
+		// Only the last block can grow, other blocks are overwritten in place.
+		if i < len(node.blocks)-1 {
+			if max := node.blockLen(i) - o; len(chunk) > max {
+				chunk = chunk[:max]
+			}
+		}
+		written, delta, err := node.blocks[i].Write(chunk, o)
+		if err != nil {
+			return err
+		}
+		node.cache.touchBlock(node.blocks[i])
+		node.ends[i] += uint64(delta)
+		node.info.Size += uint64(delta)
+		node.markRechunk(i, i+1)
+		p = p[written:]
+		off += int64(written)
+	}
+	return nil
+}
+
+func (node *Node) readChunks(p []byte, off int64) (n int, err error) {
+	for n < len(p) {
+		i, o := node.locate(uint64(off) + uint64(n))
+		if i >= len(node.blocks) {
+			break
+		}
+		m, err := node.blocks[i].Read(p[n:], o)
+		n += m
+		if err == nil {
+			node.cache.touchBlock(node.blocks[i])
+		}
+		if m == 0 || err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// rechunk splits the blocks written to since the last call into
+// content-defined chunks. It starts from the first block written to, and
+// stops as soon as a new chunk boundary coincides with an existing block
+// boundary past the last block written to, because the following blocks
+// would be cut the same way again. Existing blocks whose content equals
+// that of a new chunk are reused, so that they need not be stored again.
+func (node *Node) rechunk() error {
+	if node.chunking != contentChunking || node.rechunkTo <= node.rechunkFrom {
+		return nil
+	}
+	c, err := chunker.ForMax(int(node.bsize))
+	if err != nil {
+		return fmt.Errorf("tree.Node.rechunk: %w", err)
+	}
+	from, to := node.rechunkFrom, node.rechunkTo
+	var (
+		chunks []*block.Block
+		ends   []uint64
+		buf    []byte
+		pos    = node.blockStart(from)
+		next   = from
+		stop   = len(node.blocks)
+	)
+	// Only blocks that were written to are candidates for reuse; blocks past
+	// those may be kept as they are.
+	reusable := make(map[block.RepositoryRef]*block.Block)
+	reused := make(map[*block.Block]bool)
+	newChunk := func(data []byte) (*block.Block, error) {
+		if b := reusable[node.blockFactory.RefOf(data)]; b != nil && !reused[b] {
+			reused[b] = true
+			return b, nil
+		}
+		b, err := node.blockFactory.New(nil, int(node.bsize))
+		if err != nil {
+			return nil, err
+		}
+		if _, _, err := b.Write(data, 0); err != nil {
+			return nil, err
+		}
+		return b, nil
+	}
+	for {
+		for len(buf) < c.Max() && next < len(node.blocks) {
+			b := node.blocks[next]
+			data, err := b.ReadAll()
+			if err != nil {
+				return fmt.Errorf("tree.Node.rechunk: %w", err)
+			}
+			if next < to {
+				if ref, ok := b.Ref().(block.RepositoryRef); ok {
+					reusable[ref] = b
+				} else {
+					reusable[node.blockFactory.RefOf(data)] = b
+				}
+			}
+			buf = append(buf, data...)
+			next++
+		}
+		if len(buf) == 0 {
+			break
+		}
+		n := c.Cut(buf)
+		b, err := newChunk(buf[:n])
+		if err != nil {
+			return fmt.Errorf("tree.Node.rechunk: %w", err)
+		}
+		chunks = append(chunks, b)
+		pos += uint64(n)
+		ends = append(ends, pos)
+		buf = buf[n:]
+		if i, o := node.locate(pos); o == 0 && i >= to && i <= next {
+			stop = i
+			break
+		}
+	}
+	for _, b := range node.blocks[from:stop] {
+		if !reused[b] {
+			node.dropBlock(b)
+		}
+	}
+	var blocks []*block.Block
+	blocks = append(blocks, node.blocks[:from]...)
+	blocks = append(blocks, chunks...)
+	blocks = append(blocks, node.blocks[stop:]...)
+	node.blocks = blocks
+	node.ends = append(append(node.ends[:from:from], ends...), node.ends[stop:]...)
+	node.rechunkFrom, node.rechunkTo = 0, 0
+	// Both the new chunks and the blocks read past them hold their values.
+	for _, b := range node.blocks[from : from+len(chunks)+next-stop] {
+		node.cache.touchBlock(b)
+	}
+	return nil
+}
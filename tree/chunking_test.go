@@ -0,0 +1,130 @@
+package tree
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"github.com/nicolagi/muscle/internal/block"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newContentChunkedNode(t *testing.T, bsize uint32) *Node {
+	t.Helper()
+	return &Node{
+		blockFactory: blockFactory(t, nil),
+		bsize:        bsize,
+		chunking:     contentChunking,
+	}
+}
+
+func nodeContent(t *testing.T, node *Node) []byte {
+	t.Helper()
+	p := make([]byte, node.info.Size+10)
+	n, err := node.ReadAt(p, 0)
+	require.Nil(t, err)
+	return p[:n]
+}
+
+func blockRefs(t *testing.T, node *Node) map[block.RepositoryRef]bool {
+	t.Helper()
+	refs := make(map[block.RepositoryRef]bool)
+	for _, b := range node.blocks {
+		data, err := b.ReadAll()
+		require.Nil(t, err)
+		refs[block.RefOf(data)] = true
+	}
+	return refs
+}
+
+// After any sequence of writes and truncations, rechunking should yield the
+// same blocks as writing the final content into a new node in one go.
+func TestContentChunkingProperties(t *testing.T) {
+	const bsize = 256
+	for i := 0; i < 200; i++ {
+		node := newContentChunkedNode(t, bsize)
+		var model []byte
+		for j := 0; j < 20; j++ {
+			switch rand.Intn(4) {
+			case 0:
+				size := rand.Intn(4 * bsize)
+				require.Nil(t, node.Truncate(uint64(size)))
+				if size < len(model) {
+					model = model[:size]
+				} else {
+					model = append(model, make([]byte, size-len(model))...)
+				}
+			case 1:
+				require.Nil(t, node.rechunk())
+			default:
+				p := make([]byte, rand.Intn(2*bsize))
+				rand.Read(p)
+				off := rand.Intn(len(model) + bsize)
+				require.Nil(t, node.WriteAt(p, int64(off)))
+				if end := off + len(p); end > len(model) {
+					model = append(model, make([]byte, end-len(model))...)
+				}
+				copy(model[off:], p)
+			}
+			require.Equal(t, uint64(len(model)), node.info.Size)
+			require.True(t, bytes.Equal(model, nodeContent(t, node)))
+		}
+		require.Nil(t, node.rechunk())
+		require.True(t, bytes.Equal(model, nodeContent(t, node)))
+
+		fresh := newContentChunkedNode(t, bsize)
+		require.Nil(t, fresh.WriteAt(model, 0))
+		require.Nil(t, fresh.rechunk())
+		if len(fresh.ends) > 0 || len(node.ends) > 0 {
+			// Nil and empty are the same for an empty file.
+			assert.Equal(t, fresh.ends, node.ends)
+		}
+		for i := range node.blocks {
+			assert.True(t, node.blockLen(i) <= bsize)
+			size, err := node.blocks[i].Size()
+			require.Nil(t, err)
+			assert.Equal(t, node.blockLen(i), size)
+		}
+	}
+}
+
+func TestContentChunkingDeduplicatesAfterInsertion(t *testing.T) {
+	const bsize = 4096
+	content := make([]byte, 256*1024)
+	// Fixed data, as a few inserted bytes may well change more blocks.
+	rand.New(rand.NewSource(1)).Read(content)
+	before := newContentChunkedNode(t, bsize)
+	require.Nil(t, before.WriteAt(content, 0))
+	require.Nil(t, before.rechunk())
+
+	// Insert a few bytes near the start of the file, rewriting everything after them.
+	edited := append([]byte(nil), content[:100]...)
+	edited = append(edited, "inserted"...)
+	edited = append(edited, content[100:]...)
+	after := newContentChunkedNode(t, bsize)
+	require.Nil(t, after.WriteAt(content, 0))
+	require.Nil(t, after.rechunk())
+	require.Nil(t, after.WriteAt(edited, 0))
+	require.Nil(t, after.rechunk())
+	require.True(t, bytes.Equal(edited, nodeContent(t, after)))
+
+	beforeRefs, afterRefs := blockRefs(t, before), blockRefs(t, after)
+	var changed int
+	for ref := range afterRefs {
+		if !beforeRefs[ref] {
+			changed++
+		}
+	}
+	if changed > 2 {
+		t.Errorf("got %d changed blocks out of %d", changed, len(afterRefs))
+	}
+}
+
+func TestFixedChunkingIsDefault(t *testing.T) {
+	scheme, err := parseChunking("")
+	require.Nil(t, err)
+	assert.Equal(t, fixedChunking, scheme)
+	_, err = parseChunking("rabin")
+	assert.NotNil(t, err)
+}
@@ -14,6 +14,7 @@ func TestLatestCodecForNodes(t *testing.T) {
 	c.register(13, &codecV13{})
 	c.register(14, &codecV14{})
 	c.register(15, &codecV15{})
+	c.register(16, &codecV16{})
 	key := make([]byte, 16)
 	factory, err := block.NewFactory(nil, nil, key)
 	if err != nil {
@@ -32,6 +33,7 @@ func TestLatestCodecForNodes(t *testing.T) {
 			children [][]byte,
 			indexBlocks [][16]byte,
 			repositoryBlocks [][32]byte,
+			contentChunked bool,
 		) bool {
 			input := &Node{}
 			input.flags = nodeFlags(flags) & ^(loaded | dirty)
@@ -74,6 +76,15 @@ func TestLatestCodecForNodes(t *testing.T) {
 				input.blocks = append(input.blocks, b)
 			}
 
+			if contentChunked {
+				input.chunking = contentChunking
+				var end uint64
+				for i := range input.blocks {
+					end += uint64(i + 1)
+					input.ends = append(input.ends, end)
+				}
+			}
+
 			// Normalize
 			for _, c := range input.children {
 				c.parent = input
@@ -0,0 +1,143 @@
+package tree
+
+import (
+	"fmt"
+
+	"github.com/nicolagi/muscle/internal/block"
+	"github.com/nicolagi/muscle/storage"
+)
+
+// Like v15, plus the chunking scheme after the block size, and the length of
+// each block for content-chunked nodes. Revisions are unchanged.
+type codecV16 struct{}
+
+func (codecV16) encodeNode(node *Node) ([]byte, error) {
+	size := 50
+	size += len(node.info.Name)
+	size += len(node.children)
+	size += len(node.blocks)
+	for _, ptr := range node.children {
+		size += int(ptr.pointer.Len())
+	}
+	for _, b := range node.blocks {
+		size += int(b.Ref().Len())
+	}
+	if node.chunking == contentChunking {
+		size += 4 * len(node.blocks)
+	}
+	buf := make([]byte, size)
+	ptr := buf
+	ptr = pint8(16, ptr)
+	// The QID type (file or directory) is derived from the mode (DMDIR flag).
+	ptr = pint8(0, ptr)
+	ptr = pint64(node.info.ID, ptr)
+	ptr = pint32(node.info.Version, ptr)
+	ptr = pstr(node.info.Name, ptr)
+	ptr = pint8(uint8(node.flags & ^(loaded|dirty)), ptr)
+	ptr = pint32(node.bsize, ptr)
+	ptr = pint8(uint8(node.chunking), ptr)
+	ptr = pint32(node.info.Mode, ptr)
+	ptr = pint64(node.info.Size, ptr)
+	ptr = pint32(node.info.Modified, ptr)
+	ptr = pint32(0, ptr)
+	ptr = pint32(uint32(len(node.children)), ptr)
+	for _, c := range node.children {
+		ptr = pint8(c.pointer.Len(), ptr)
+		ptr = pbytes(c.pointer.Bytes(), ptr)
+	}
+	ptr = pint32(uint32(len(node.blocks)), ptr)
+	for i, b := range node.blocks {
+		ptr = pint8(uint8(b.Ref().Len()), ptr)
+		ptr = pbytes(b.Ref().Bytes(), ptr)
+		if node.chunking == contentChunking {
+			ptr = pint32(uint32(node.blockLen(i)), ptr)
+		}
+	}
+	if len(ptr) != 0 {
+		panic(fmt.Sprintf("buffer length is non-zero: %d", len(ptr)))
+	}
+	return buf, nil
+}
+
+func (codecV16) decodeNode(data []byte, dest *Node) error {
+	ptr := data
+
+	var u8 uint8
+	var u32 uint32
+
+	// The QID type (file or directory) is derived from the mode (DMDIR flag).
+	_, ptr = gint8(ptr)
+	dest.info.ID, ptr = gint64(ptr)
+	dest.info.Version, ptr = gint32(ptr)
+	dest.info.Name, ptr = gstr(ptr)
+	u8, ptr = gint8(ptr)
+	dest.flags = nodeFlags(u8)
+	dest.bsize, ptr = gint32(ptr)
+	u8, ptr = gint8(ptr)
+	dest.chunking = chunkingScheme(u8)
+	if dest.chunking != fixedChunking && dest.chunking != contentChunking {
+		return fmt.Errorf("tree.codecV16.decodeNode: unknown chunking scheme %v", dest.chunking)
+	}
+	dest.info.Mode, ptr = gint32(ptr)
+	if dest.info.Mode&DMDIR != 0 {
+		// Ignore the length, it's 0 for directories, see stat(9p) or stat(5).
+		_, ptr = gint64(ptr)
+	} else {
+		dest.info.Size, ptr = gint64(ptr)
+	}
+	dest.info.Modified, ptr = gint32(ptr)
+
+	u32, ptr = gint32(ptr)
+	if u32 > 0 {
+		ptr = ptr[u32:]
+	}
+
+	u32, ptr = gint32(ptr)
+	for i := uint32(0); i < u32; i++ {
+		u8, ptr = gint8(ptr)
+		if err := dest.addChildPointer(storage.NewPointer(ptr[:u8])); err != nil {
+			return err
+		}
+		ptr = ptr[u8:]
+	}
+	u32, ptr = gint32(ptr)
+	var end uint64
+	for i := uint32(0); i < u32; i++ {
+		u8, ptr = gint8(ptr)
+		r, err := block.NewRef(ptr[:u8])
+		if err != nil {
+			return err
+		}
+		b, err := dest.blockFactory.New(r, int(dest.bsize))
+		if err != nil {
+			return err
+		}
+		dest.blocks = append(dest.blocks, b)
+		ptr = ptr[u8:]
+		if dest.chunking == contentChunking {
+			var length uint32
+			length, ptr = gint32(ptr)
+			end += uint64(length)
+			dest.ends = append(dest.ends, end)
+		}
+	}
+
+	if len(ptr) != 0 {
+		panic(fmt.Sprintf("buffer length is non-zero: %d", len(ptr)))
+	}
+
+	return nil
+}
+
+func (codecV16) encodeRevision(rev *Revision) ([]byte, error) {
+	buf, err := codecV15{}.encodeRevision(rev)
+	if err != nil {
+		return nil, err
+	}
+	buf[0] = 16
+	return buf, nil
+}
+
+func (codecV16) decodeRevision(data []byte, rev *Revision) error {
+	return codecV15{}.decodeRevision(data, rev)
+}
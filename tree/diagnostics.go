@@ -41,3 +41,37 @@ func (tree *Tree) ListNodesInUse() (paths []string) {
 	list(tree.root, "")
 	return
 }
+
+// StorageSize walks the whole tree and returns the total size of the file
+// blocks and their total size once compressed and encrypted, as stored.
+// It may need to fetch every block from storage.
+func (tree *Tree) StorageSize() (size, stored uint64, err error) {
+	var walk func(*Node) error
+	walk = func(node *Node) error {
+		if err := tree.Grow(node); err != nil {
+			return err
+		}
+		for _, b := range node.blocks {
+			n, err := b.Size()
+			if err != nil {
+				return fmt.Errorf("%v: %w", node, err)
+			}
+			m, err := b.StoredSize()
+			if err != nil {
+				return fmt.Errorf("%v: %w", node, err)
+			}
+			size += uint64(n)
+			stored += uint64(m)
+			// Avoid holding the whole tree's data in memory.
+			b.Forget()
+		}
+		for _, c := range node.children {
+			if err := walk(c); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	err = walk(tree.root)
+	return
+}
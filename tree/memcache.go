@@ -0,0 +1,248 @@
+package tree
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+
+	"github.com/nicolagi/muscle/internal/block"
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultMemoryBudget is how many bytes of memory the loaded nodes and
+// decrypted block values of a Store may take, unless set otherwise with
+// WithMemoryBudget.
+const DefaultMemoryBudget = 256 * 1024 * 1024
+
+// Rough estimates of the memory taken by a loaded node, other than its
+// block values, and by each of its children and blocks.
+const (
+	nodeMemory      = 512
+	childMemory     = 8
+	nodeBlockMemory = 192
+)
+
+// MemoryStats reports on the memory taken by loaded nodes and decrypted
+// block values.
+type MemoryStats struct {
+	// Estimated size, and the budget it's kept within.
+	Size   int64
+	Budget int64
+	// Number of nodes and block values tracked.
+	Nodes  int
+	Blocks int
+	// Block values dropped, and how many of those had to be written to
+	// the staging area first, and nodes unloaded, to stay within the
+	// budget.
+	Forgotten int64
+	Flushed   int64
+	Unloaded  int64
+}
+
+func (s MemoryStats) String() string {
+	return fmt.Sprintf("memory %d/%d bytes in %d nodes and %d blocks, %d blocks forgotten (%d flushed first), %d nodes unloaded",
+		s.Size, s.Budget, s.Nodes, s.Blocks, s.Forgotten, s.Flushed, s.Unloaded)
+}
+
+// memCache keeps track of the loaded nodes and the decrypted block values
+// of a Store, least recently used first, and drops some when they take
+// more memory than the budget. Block values are dropped as soon as they
+// exceed the budget, since they can be loaded again transparently, but
+// nodes are only unloaded by shrink (see Store.Shrink). Dirty blocks are
+// written to the staging area before being dropped. Nodes that are dirty,
+// referenced, or roots, stay loaded.
+//
+// Like nodes, it must not be used concurrently with the nodes it tracks.
+type memCache struct {
+	budget int64
+
+	mu sync.Mutex
+	// Of *memEntry, most recently used first.
+	nodes   *list.List
+	blocks  *list.List
+	entries map[interface{}]*list.Element
+	stats   MemoryStats
+}
+
+// A memEntry is either for a node or for a block value.
+type memEntry struct {
+	node  *Node
+	block *block.Block
+	size  int64
+}
+
+func newMemCache(budget int64) *memCache {
+	return &memCache{
+		budget:  budget,
+		nodes:   list.New(),
+		blocks:  list.New(),
+		entries: make(map[interface{}]*list.Element),
+		stats:   MemoryStats{Budget: budget},
+	}
+}
+
+func (c *memCache) Stats() MemoryStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats
+}
+
+func nodeSize(node *Node) int64 {
+	return nodeMemory + int64(len(node.info.Name)) +
+		childMemory*int64(len(node.children)) +
+		nodeBlockMemory*int64(len(node.blocks))
+}
+
+// touchNode marks a loaded node as the most recently used.
+func (c *memCache) touchNode(node *Node) {
+	if c == nil || node.flags&loaded == 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.touch(node, &memEntry{node: node, size: nodeSize(node)})
+}
+
+// touchBlock marks a block value as the most recently used, and drops the
+// least recently used ones if over budget. The block must hold its value,
+// that is, it must have just been read or written.
+func (c *memCache) touchBlock(b *block.Block) {
+	if c == nil {
+		return
+	}
+	n, err := b.Size()
+	if err != nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.touch(b, &memEntry{block: b, size: int64(n)})
+	c.evict(false)
+}
+
+// touch adds or updates an entry, and moves it to the front. Call with
+// c.mu held.
+func (c *memCache) touch(key interface{}, e *memEntry) {
+	if el, ok := c.entries[key]; ok {
+		old := el.Value.(*memEntry)
+		c.stats.Size += e.size - old.size
+		old.size = e.size
+		c.listOf(old).MoveToFront(el)
+		return
+	}
+	c.entries[key] = c.listOf(e).PushFront(e)
+	c.stats.Size += e.size
+	if e.node != nil {
+		c.stats.Nodes++
+	} else {
+		c.stats.Blocks++
+	}
+}
+
+func (c *memCache) listOf(e *memEntry) *list.List {
+	if e.node != nil {
+		return c.nodes
+	}
+	return c.blocks
+}
+
+// remove stops tracking a node or a block. Call with c.mu held.
+func (c *memCache) remove(key interface{}) {
+	el, ok := c.entries[key]
+	if !ok {
+		return
+	}
+	e := el.Value.(*memEntry)
+	c.listOf(e).Remove(el)
+	delete(c.entries, key)
+	c.stats.Size -= e.size
+	if e.node != nil {
+		c.stats.Nodes--
+	} else {
+		c.stats.Blocks--
+	}
+}
+
+// dropBlock stops tracking a block that's no longer part of a node.
+func (c *memCache) dropBlock(b *block.Block) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.remove(b)
+}
+
+// dropNode stops tracking a node that has been unloaded, its blocks, and
+// its loaded descendants.
+func (c *memCache) dropNode(node *Node) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.dropTree(node)
+}
+
+// dropTree is dropNode with c.mu held.
+func (c *memCache) dropTree(node *Node) {
+	c.remove(node)
+	for _, b := range node.blocks {
+		c.remove(b)
+	}
+	for _, child := range node.children {
+		c.dropTree(child)
+	}
+}
+
+// evict drops block values, and then unloads nodes if asked to, least
+// recently used first, until within budget. Entries that can't be
+// dropped are moved to the front. Call with c.mu held.
+func (c *memCache) evict(unload bool) {
+	for n := c.blocks.Len(); n > 0 && c.stats.Size > c.budget; n-- {
+		el := c.blocks.Back()
+		if b := el.Value.(*memEntry).block; c.forget(b) {
+			c.remove(b)
+		} else {
+			c.blocks.MoveToFront(el)
+		}
+	}
+	if !unload {
+		return
+	}
+	for n := c.nodes.Len(); n > 0 && c.stats.Size > c.budget; n-- {
+		el := c.nodes.Back()
+		if node := el.Value.(*memEntry).node; node.evictable() {
+			c.dropTree(node)
+			node.unload()
+			c.stats.Unloaded++
+		} else {
+			c.nodes.MoveToFront(el)
+		}
+	}
+}
+
+// forget drops a block value, writing it to the staging area first if it
+// is dirty, and tells whether it could. Call with c.mu held.
+func (c *memCache) forget(b *block.Block) bool {
+	flushed, err := b.Flush()
+	if err != nil {
+		log.WithField("cause", err).Warning("Could not flush block to free memory")
+		return false
+	}
+	// Not forgotten means it already was, e.g., by Node.Trim.
+	if b.Forget() {
+		c.stats.Forgotten++
+		if flushed {
+			c.stats.Flushed++
+		}
+	}
+	return true
+}
+
+// shrink drops block values and unloads nodes until within budget.
+func (c *memCache) shrink() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.evict(true)
+}
@@ -0,0 +1,169 @@
+package tree
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"github.com/nicolagi/muscle/internal/block"
+	"github.com/nicolagi/muscle/storage"
+)
+
+func TestStoreMemoryBudget(t *testing.T) {
+	key := make([]byte, 16)
+	rand.Read(key)
+	bf, err := block.NewFactory(&storage.InMemory{}, &storage.InMemory{}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const budget = 8192
+	treeStore, err := NewStore(bf, &storage.InMemory{}, t.TempDir(), WithMemoryBudget(budget))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree, err := NewTree(treeStore, WithMutable(1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, root := tree.Root()
+	a, err := tree.Add(root, "a", 0700|DMDIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	large, err := tree.Add(a, "large", 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := tree.Add(root, "b", 0700|DMDIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	small, err := tree.Add(b, "small", 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := make([]byte, 64*1024)
+	rand.Read(content)
+
+	t.Run("dirty blocks are flushed and forgotten", func(t *testing.T) {
+		if err := large.WriteAt(content, 0); err != nil {
+			t.Fatal(err)
+		}
+		stats := treeStore.MemoryStats()
+		if stats.Size > budget || stats.Flushed == 0 {
+			t.Errorf("got %+v", stats)
+		}
+	})
+
+	t.Run("block values are reloaded", func(t *testing.T) {
+		got := make([]byte, len(content))
+		for off := 0; off < len(got); off += 100 {
+			end := off + 100
+			if end > len(got) {
+				end = len(got)
+			}
+			if _, err := large.ReadAt(got[off:end], int64(off)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if !bytes.Equal(got, content) {
+			t.Error("content differs")
+		}
+		if stats := treeStore.MemoryStats(); stats.Size > budget {
+			t.Errorf("got %+v", stats)
+		}
+	})
+
+	if err := small.WriteAt([]byte("small"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("shrink unloads nodes not in use", func(t *testing.T) {
+		for _, dir := range []*Node{root, a, b} {
+			if err := tree.Grow(dir); err != nil {
+				t.Fatal(err)
+			}
+		}
+		small.Ref("test")
+		defer small.Unref("test")
+		// Nodes take less than the budget, so that only block values
+		// need be dropped until now.
+		treeStore.memory.budget = 1
+		treeStore.Shrink()
+		if a.flags&loaded != 0 {
+			t.Error("a still loaded")
+		}
+		if b.flags&loaded == 0 || small.flags&loaded == 0 || root.flags&loaded == 0 {
+			t.Error("nodes in use unloaded")
+		}
+		if stats := treeStore.MemoryStats(); stats.Unloaded == 0 {
+			t.Errorf("got %+v", stats)
+		}
+		nodes, err := tree.Walk(root, "a", "large")
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := make([]byte, 10)
+		if _, err := nodes[1].ReadAt(got, 0); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, content[:10]) {
+			t.Errorf("got %x, want %x", got, content[:10])
+		}
+	})
+}
+
+func TestStoreMemoryBudgetTruncate(t *testing.T) {
+	key := make([]byte, 16)
+	rand.Read(key)
+	bf, err := block.NewFactory(&storage.InMemory{}, &storage.InMemory{}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Every block value is dropped as soon as possible.
+	treeStore, err := NewStore(bf, &storage.InMemory{}, t.TempDir(), WithMemoryBudget(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree, err := NewTree(treeStore, WithMutable(1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, root := tree.Root()
+	file, err := tree.Add(root, "file", 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Ref("test")
+	defer file.Unref("test")
+	content := make([]byte, 100)
+	rand.Read(content)
+	if err := file.WriteAt(content, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := file.Truncate(10); err != nil {
+		t.Fatal(err)
+	}
+	check := func(t *testing.T) {
+		t.Helper()
+		got := make([]byte, len(content))
+		n, err := file.ReadAt(got, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got[:n], content[:10]) {
+			t.Errorf("got %x, want %x", got[:n], content[:10])
+		}
+	}
+	check(t)
+	if err := tree.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	check(t)
+}
@@ -43,6 +43,9 @@ func (tree *Tree) seal(node *Node) error {
 			return err
 		}
 	}
+	if err := node.rechunk(); err != nil {
+		return err
+	}
 	for _, b := range node.blocks {
 		if _, err := b.Seal(); err != nil {
 			return err
@@ -97,6 +100,9 @@ func (tree *Tree) depthFirstSave(node *Node) error {
 		"path": node.Path(),
 		"key":  node.pointer.Hex(),
 	}).Debug("Persisting node")
+	if err := node.rechunk(); err != nil {
+		return err
+	}
 	for _, b := range node.blocks {
 		_, err := b.Flush()
 		if err != nil {
@@ -53,6 +53,9 @@ func (ff nodeFlags) String() string {
 // Node describes a node in the filesystem tree.
 type Node struct {
 	blockFactory *block.Factory
+	// Tracks the memory taken by the node and its block values, if not
+	// nil (see Store.Shrink).
+	cache *memCache
 
 	// Number of 9P fids that refer to this node.  A node that has no
 	// references can be unloaded unless it has changed and needs to be
@@ -65,6 +68,15 @@ type Node struct {
 	flags nodeFlags
 	bsize uint32 // Block size, for future extension.
 
+	// How the file content is split into blocks. With content-defined
+	// chunking, bsize is the maximum block size, the ends field holds the
+	// offset at which each block ends, and blocks with indices in
+	// [rechunkFrom, rechunkTo) have been written to since they were last
+	// chunked.
+	chunking               chunkingScheme
+	ends                   []uint64
+	rechunkFrom, rechunkTo int
+
 	// Pointer to the parent node. For the root node (and only for the root
 	// node) this will be nil.
 	parent *Node
@@ -91,6 +103,12 @@ func (node *Node) Info() NodeInfo {
 	return node.info
 }
 
+// Pointer returns the pointer the node was last stored at, which is
+// current only if the node hasn't changed since the tree was flushed.
+func (node *Node) Pointer() storage.Pointer {
+	return node.pointer
+}
+
 func (node *Node) followBranch(name string) (*Node, error) {
 	if node.flags&loaded == 0 {
 		return nil, errors.Wrapf(ErrInvariant, "looking up %q within %q, which hasn't been loaded", name, node.Path())
@@ -257,10 +275,6 @@ func (node *Node) Unref(reason string) {
 // trimmed because its information can not be retrieved from local
 // or remote storage.
 func (node *Node) Trim() {
-
-	now := uint32(time.Now().Unix())
-	minAge := uint32(300) // 5 minutes
-
 	var trim func(node *Node)
 
 	trim = func(node *Node) {
@@ -270,31 +284,42 @@ func (node *Node) Trim() {
 			}
 		}
 
-		age := now - node.info.Modified
-
 		le := log.WithFields(log.Fields{
 			"path":  node.Path(),
 			"key":   node.pointer.Hex(),
-			"age":   age,
 			"refs":  node.refs,
 			"flags": node.flags,
 		})
 
-		if node.IsRoot() || node.flags&dirty != 0 || node.refs != 0 || age < minAge {
+		if !node.evictable() {
 			le.Debug("Not trimming")
 			return
 		}
 
 		le.Debug("Trimming")
-		node.flags &^= loaded
-		node.info.Name = ""
-		node.blocks = nil
-		node.children = nil
+		node.cache.dropNode(node)
+		node.unload()
 	}
 
 	trim(node)
 }
 
+// evictable tells whether the node can be unloaded, that is, it's loaded,
+// not the root, and neither dirty nor referenced.
+func (node *Node) evictable() bool {
+	return node.flags&loaded != 0 && !node.IsRoot() && node.flags&dirty == 0 && node.refs == 0
+}
+
+// unload drops the node's blocks and children, so they can be garbage
+// collected, and the node loaded again when needed.
+func (node *Node) unload() {
+	node.flags &^= loaded
+	node.info.Name = ""
+	node.blocks = nil
+	node.ends = nil
+	node.children = nil
+}
+
 // Returns the number of children removed (hopefully only 0 or 1).
 func (node *Node) removeChild(name string) (removedCount int) {
 	var newChildren []*Node
@@ -357,6 +382,10 @@ func (node *Node) Truncate(requestedSize uint64) error {
 	var err error
 	if requestedSize == node.info.Size {
 		return nil
+	} else if node.chunking == contentChunking && requestedSize > node.info.Size {
+		err = node.growChunks(requestedSize)
+	} else if node.chunking == contentChunking {
+		err = node.shrinkChunks(requestedSize)
 	} else if requestedSize > node.info.Size {
 		err = node.grow(requestedSize)
 	} else {
@@ -381,6 +410,7 @@ func (node *Node) grow(requestedSize uint64) (err error) {
 			return err
 		}
 		node.blocks = append(node.blocks, b)
+		node.cache.touchBlock(b)
 		return nil
 	}
 	blockSize := uint64(node.bsize)
@@ -390,6 +420,7 @@ func (node *Node) grow(requestedSize uint64) (err error) {
 		if err := node.blocks[q].Truncate(int(node.bsize)); err != nil {
 			return err
 		}
+		node.cache.touchBlock(node.blocks[q])
 		q, r = q+1, 0
 	}
 	for ; q < nextq; q++ {
@@ -399,7 +430,9 @@ func (node *Node) grow(requestedSize uint64) (err error) {
 	}
 	if nextr > 0 {
 		if r > 0 {
-			err = node.blocks[q].Truncate(nextr)
+			if err = node.blocks[q].Truncate(nextr); err == nil {
+				node.cache.touchBlock(node.blocks[q])
+			}
 		} else {
 			err = add(nextr)
 		}
@@ -418,21 +451,24 @@ func (node *Node) shrink(requestedSize uint64) error {
 		if err := node.blocks[q].Truncate(r); err != nil {
 			return err
 		}
+		node.cache.touchBlock(node.blocks[q])
 		q++
 	}
 	l := len(node.blocks)
 	for i := q; i < l; i++ {
-		node.blocks[i].Discard()
+		node.dropBlock(node.blocks[i])
 	}
 	node.blocks = node.blocks[:q]
 	return nil
 }
 
 func (node *Node) WriteAt(p []byte, off int64) error {
-	if err := node.ensureBlocksForWriting(off + int64(len(p))); err != nil {
-		return err
+	var err error
+	if node.chunking == contentChunking {
+		err = node.writeChunks(p, off)
+	} else if err = node.ensureBlocksForWriting(off + int64(len(p))); err == nil {
+		err = node.write(p, off)
 	}
-	err := node.write(p, off)
 	if err != nil {
 		return err
 	}
@@ -446,10 +482,12 @@ func (node *Node) write(p []byte, off int64) error {
 		return nil
 	}
 	bs := int64(node.bsize)
-	written, delta, err := node.getBlock(off).Write(p, int(off%bs))
+	b := node.getBlock(off)
+	written, delta, err := b.Write(p, int(off%bs))
 	if err != nil {
 		return err
 	}
+	node.cache.touchBlock(b)
 	off -= off % bs
 	off += bs
 	node.info.Size += uint64(delta)
@@ -476,6 +514,73 @@ func (node *Node) ensureBlocksForWriting(requiredBytes int64) error {
 	return nil
 }
 
+// BlockKeys returns the keys of up to n blocks of a file, starting from the
+// one holding the byte at the given offset, skipping blocks not yet sealed,
+// which are only in the staging area. They are meant for prefetching.
+func (node *Node) BlockKeys(off int64, n int) []storage.Key {
+	first := node.blockIndex(off)
+	var keys []storage.Key
+	for i := first; i < len(node.blocks) && i < first+n; i++ {
+		if ref, ok := node.blocks[i].Ref().(block.RepositoryRef); ok {
+			keys = append(keys, ref.Key())
+		}
+	}
+	return keys
+}
+
+// ReadKeys returns the keys of the blocks that reading n bytes at the given
+// offset would load from the repository, so that they can be fetched
+// beforehand, e.g., without holding a lock.
+func (node *Node) ReadKeys(off int64, n int) []storage.Key {
+	if n <= 0 {
+		return nil
+	}
+	last := node.blockIndex(off + int64(n) - 1)
+	var keys []storage.Key
+	for i := node.blockIndex(off); i <= last && i < len(node.blocks); i++ {
+		b := node.blocks[i]
+		if !b.Primed() {
+			continue
+		}
+		if ref, ok := b.Ref().(block.RepositoryRef); ok {
+			keys = append(keys, ref.Key())
+		}
+	}
+	return keys
+}
+
+// ChildKeys returns the keys of the children that Tree.Grow would load from
+// the repository, so that they can be fetched beforehand.
+func (node *Node) ChildKeys() []storage.Key {
+	var keys []storage.Key
+	for _, child := range node.children {
+		if child.flags&loaded != 0 || len(child.pointer) == 0 {
+			continue
+		}
+		ref, err := block.NewRef([]byte(child.pointer))
+		if err != nil {
+			continue
+		}
+		if ref, ok := ref.(block.RepositoryRef); ok {
+			keys = append(keys, ref.Key())
+		}
+	}
+	return keys
+}
+
+// blockIndex returns the index of the block holding the byte at the given
+// offset, or an index past the last block if past the end of the file.
+func (node *Node) blockIndex(off int64) int {
+	if node.chunking == contentChunking {
+		i, _ := node.locate(uint64(off))
+		return i
+	}
+	if node.bsize == 0 {
+		return 0
+	}
+	return int(off / int64(node.bsize))
+}
+
 func (node *Node) getBlock(off int64) *block.Block {
 	index := int(off / int64(node.bsize))
 	if index >= len(node.blocks) {
@@ -488,12 +593,18 @@ func (node *Node) ReadAt(p []byte, off int64) (int, error) {
 	if len(p) == 0 {
 		return 0, nil
 	}
+	if node.chunking == contentChunking {
+		return node.readChunks(p, off)
+	}
 	block := node.getBlock(off)
 	if block == nil {
 		return 0, nil
 	}
 	o := int(off % int64(node.bsize))
 	n, err := block.Read(p, o)
+	if err == nil {
+		node.cache.touchBlock(block)
+	}
 	if n == 0 || err != nil {
 		return n, err
 	}
@@ -513,9 +624,15 @@ func (node *Node) metadataBlock() (*block.Block, error) {
 	return b, nil
 }
 
+// dropBlock discards a block that's no longer part of the node.
+func (node *Node) dropBlock(b *block.Block) {
+	node.cache.dropBlock(b)
+	b.Discard()
+}
+
 func (node *Node) discard() {
 	for _, b := range node.blocks {
-		b.Discard()
+		node.dropBlock(b)
 	}
 	if len(node.pointer) > 0 {
 		if b, err := node.metadataBlock(); err != nil {
@@ -525,5 +642,6 @@ func (node *Node) discard() {
 		}
 	}
 	node.blocks = nil
+	node.ends = nil
 	node.pointer = nil
 }
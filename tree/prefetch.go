@@ -0,0 +1,135 @@
+package tree
+
+import (
+	"sync"
+
+	"github.com/nicolagi/muscle/storage"
+	"github.com/pkg/errors"
+)
+
+// PrefetchStats reports on the progress of Store.Prefetch.
+type PrefetchStats struct {
+	// Number of nodes and file blocks loaded, and size of the blocks.
+	Nodes  int
+	Blocks int
+	Bytes  int64
+	// Number of nodes and blocks that couldn't be loaded.
+	Errors int
+}
+
+// Prefetch loads all nodes and file blocks of the subtree rooted at the
+// node with the given pointer, so that, if the store reads through a cache,
+// they end up in the cache. It calls visit, if not nil, with the key of
+// each item loaded and the totals so far; calls are serialized. Items that
+// can't be loaded are counted and skipped, and the first such error is
+// returned once all other items are loaded.
+func (s *Store) Prefetch(root storage.Pointer, visit func(storage.Key, PrefetchStats)) (PrefetchStats, error) {
+	p := &prefetcher{
+		store:   s,
+		workers: 16,
+		visit:   visit,
+	}
+	p.cond = sync.NewCond(&p.mu)
+	p.run(&Node{pointer: root})
+	return p.stats, p.err
+}
+
+// prefetcher loads nodes with a fixed number of workers, like checker.
+type prefetcher struct {
+	store   *Store
+	workers int
+	visit   func(storage.Key, PrefetchStats)
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	queue  []*Node
+	active int
+	stats  PrefetchStats
+	err    error
+}
+
+func (p *prefetcher) run(root *Node) {
+	p.queue = append(p.queue, root)
+	var wg sync.WaitGroup
+	for i := 0; i < p.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				node, ok := p.pop()
+				if !ok {
+					return
+				}
+				p.done(p.load(node))
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func (p *prefetcher) pop() (*Node, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for len(p.queue) == 0 && p.active > 0 {
+		p.cond.Wait()
+	}
+	if len(p.queue) == 0 {
+		return nil, false
+	}
+	node := p.queue[len(p.queue)-1]
+	p.queue = p.queue[:len(p.queue)-1]
+	p.active++
+	return node, true
+}
+
+func (p *prefetcher) done(children []*Node) {
+	p.mu.Lock()
+	p.queue = append(p.queue, children...)
+	p.active--
+	p.cond.Broadcast()
+	p.mu.Unlock()
+}
+
+// loaded updates the stats and reports progress for an item, if err is
+// nil, or records the error otherwise.
+func (p *prefetcher) loaded(key storage.Key, err error, update func(*PrefetchStats)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err != nil {
+		p.stats.Errors++
+		if p.err == nil {
+			p.err = err
+		}
+		return
+	}
+	update(&p.stats)
+	if p.visit != nil {
+		p.visit(key, p.stats)
+	}
+}
+
+// load loads a node and its blocks, and returns its children, if any.
+func (p *prefetcher) load(node *Node) []*Node {
+	key := node.pointer.Key()
+	if err := p.store.LoadNode(node); err != nil {
+		p.loaded(key, errors.Wrapf(err, "node %v", node.pointer), nil)
+		return nil
+	}
+	p.loaded(key, nil, func(s *PrefetchStats) { s.Nodes++ })
+	for i, b := range node.blocks {
+		n, err := b.Size()
+		b.Forget()
+		if err != nil {
+			err = errors.Wrapf(err, "%s: block %d (%v)", node.info.Name, i, b.Ref())
+		}
+		p.loaded(b.Ref().Key(), err, func(s *PrefetchStats) {
+			s.Blocks++
+			s.Bytes += int64(n)
+		})
+	}
+	// Let prefetched subtrees be garbage collected.
+	children := node.children
+	node.children = nil
+	node.blocks = nil
+	return children
+}
@@ -0,0 +1,89 @@
+package tree
+
+import (
+	"errors"
+	"math/rand"
+	"testing"
+
+	"github.com/nicolagi/muscle/internal/block"
+	"github.com/nicolagi/muscle/storage"
+)
+
+func TestStorePrefetch(t *testing.T) {
+	key := make([]byte, 16)
+	rand.Read(key)
+	repository := &storage.InMemory{}
+	bf, err := block.NewFactory(&storage.InMemory{}, repository, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	treeStore, err := NewStore(bf, &storage.InMemory{}, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree, err := NewTree(treeStore, WithMutable(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, root := tree.Root()
+	dir, err := tree.Add(root, "a", 0700|DMDIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	long, err := tree.Add(dir, "long", 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := long.WriteAt([]byte("hello, world"), 0); err != nil {
+		t.Fatal(err)
+	}
+	short, err := tree.Add(root, "short", 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := short.WriteAt([]byte("xy"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Seal(); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("whole tree", func(t *testing.T) {
+		seen := make(map[storage.Key]bool)
+		stats, err := treeStore.Prefetch(root.pointer, func(k storage.Key, _ PrefetchStats) {
+			seen[k] = true
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.Nodes != 4 || stats.Blocks != 4 || stats.Bytes != 14 || stats.Errors != 0 {
+			t.Errorf("got %+v", stats)
+		}
+		if len(seen) != 8 {
+			t.Errorf("visited %d keys, want 8", len(seen))
+		}
+	})
+
+	t.Run("subtree", func(t *testing.T) {
+		stats, err := treeStore.Prefetch(dir.pointer, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.Nodes != 2 || stats.Blocks != 3 || stats.Bytes != 12 {
+			t.Errorf("got %+v", stats)
+		}
+	})
+
+	t.Run("missing block", func(t *testing.T) {
+		if err := repository.Delete(long.blocks[1].Ref().Key()); err != nil {
+			t.Fatal(err)
+		}
+		stats, err := treeStore.Prefetch(root.pointer, nil)
+		if !errors.Is(err, storage.ErrNotFound) {
+			t.Errorf("got %v, want %v", err, storage.ErrNotFound)
+		}
+		if stats.Nodes != 4 || stats.Blocks != 3 || stats.Errors != 1 {
+			t.Errorf("got %+v", stats)
+		}
+	})
+}
@@ -36,6 +36,8 @@ func (r *Revision) Key() storage.Pointer { return r.key }
 
 func (r *Revision) RootKey() storage.Pointer { return r.rootKey }
 
+func (r *Revision) Parent() storage.Pointer { return r.parent }
+
 func (r *Revision) Time() time.Time {
 	return time.Unix(r.when, 0)
 }
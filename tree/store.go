@@ -1,6 +1,7 @@
 package tree
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -27,19 +28,59 @@ type Store struct {
 	pointers     storage.Store
 	codec        Codec
 	baseDir      string // e.g., $HOME/lib/muscle.
+
+	// Bounds the memory taken by the nodes loaded by trees using this
+	// store, and their block values.
+	memory *memCache
+}
+
+// StoreOption values influence the behavior of NewStore.
+type StoreOption func(*Store)
+
+// WithMemoryBudget sets how many bytes of memory loaded nodes and decrypted
+// block values may take, DefaultMemoryBudget if not positive.
+func WithMemoryBudget(bytes int64) StoreOption {
+	return func(s *Store) {
+		if bytes > 0 {
+			s.memory = newMemCache(bytes)
+		}
+	}
 }
 
 func NewStore(
 	blockFactory *block.Factory,
 	pointers storage.Store,
 	baseDir string,
+	opts ...StoreOption,
 ) (*Store, error) {
-	return &Store{
+	s := &Store{
 		blockFactory: blockFactory,
 		pointers:     pointers,
 		codec:        newStandardCodec(),
 		baseDir:      baseDir,
-	}, nil
+		memory:       newMemCache(DefaultMemoryBudget),
+	}
+	for _, o := range opts {
+		o(s)
+	}
+	return s, nil
+}
+
+// MemoryStats reports on the memory taken by loaded nodes and block values.
+func (s *Store) MemoryStats() MemoryStats {
+	return s.memory.Stats()
+}
+
+// Shrink unloads the least recently used nodes of trees using this store,
+// other than roots and nodes that are dirty or referenced (see Node.Ref),
+// until loaded nodes and block values take no more memory than the budget
+// (see WithMemoryBudget). Block values are dropped as needed when read or
+// written, but nodes aren't, since the code walking the tree holds on to
+// nodes without referencing them. Therefore, call Shrink only while the
+// trees aren't in use, other than through references, e.g., between
+// requests. It replaces periodic calls to Node.Trim.
+func (s *Store) Shrink() {
+	s.memory.shrink()
 }
 
 func (s *Store) StoreNode(node *Node) error {
@@ -95,6 +136,8 @@ func (s *Store) SealNode(node *Node) error {
 	if err != nil {
 		return errw(err)
 	}
+	// Other hosts need metadata to make sense of the rest.
+	blk.Prioritize()
 	if err := blk.Truncate(0); err != nil {
 		return errw(err)
 	}
@@ -130,6 +173,8 @@ func (s *Store) StoreRevision(r *Revision) error {
 	if err != nil {
 		return errw(err)
 	}
+	// Other hosts need metadata to make sense of the rest.
+	blk.Prioritize()
 	if err := blk.Truncate(0); err != nil {
 		return errw(err)
 	}
@@ -151,6 +196,7 @@ func (s *Store) LoadNode(dst *Node) error {
 		return fmt.Errorf("tree.Store.LoadNode: %w", e)
 	}
 	dst.blockFactory = s.blockFactory
+	dst.cache = s.memory
 	blk, err := dst.metadataBlock()
 	if err != nil {
 		return errw(err)
@@ -236,6 +282,64 @@ func (s *Store) SetRemoteBasePointer(pointer storage.Pointer) error {
 	return s.pointers.Put(storage.Key(RemoteRootKeyPrefix+"base"), []byte(pointer.Hex()))
 }
 
+// UpdateRemoteBasePointer sets the remote base pointer to next, provided it
+// is still prev, e.g., the remote base a push started from. It fails with an
+// error wrapping storage.ErrConflict if the remote base moved, and with one
+// wrapping storage.ErrNotImplemented if the pointers store can't update items
+// conditionally.
+func (s *Store) UpdateRemoteBasePointer(prev, next storage.Pointer) error {
+	swapper, ok := s.pointers.(storage.Swapper)
+	if !ok {
+		return errors.Wrapf(storage.ErrNotImplemented, "%T.Swap", s.pointers)
+	}
+	key := storage.Key(RemoteRootKeyPrefix + "base")
+	// Compare with the value as stored, which may differ in white space.
+	content, err := s.pointers.Get(key)
+	current := storage.Null
+	if errors.Is(err, storage.ErrNotFound) {
+		content = nil
+	} else if err != nil {
+		return err
+	} else if current, err = storage.NewPointerFromHex(strings.TrimSpace(string(content))); err != nil {
+		return err
+	}
+	if !current.Equals(prev) {
+		return errors.Wrapf(storage.ErrConflict, "remote base is %v, not %v", current, prev)
+	}
+	return swapper.Swap(key, content, []byte(next.Hex()))
+}
+
+// RemoteRootPointers returns the revision pointers stored under the
+// remote.root. prefix, including the remote base pointer, by name (the part
+// after the prefix, e.g., "base"). It requires the pointers store to
+// implement storage.Lister.
+func (s *Store) RemoteRootPointers() (map[string]storage.Pointer, error) {
+	lister, ok := s.pointers.(storage.Lister)
+	if !ok {
+		return nil, fmt.Errorf("tree.Store.RemoteRootPointers: listing: %w", storage.ErrNotImplemented)
+	}
+	var keys []storage.Key
+	if err := lister.List(context.Background(), RemoteRootKeyPrefix, func(item storage.ListItem) error {
+		keys = append(keys, item.Key)
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("tree.Store.RemoteRootPointers: %w", err)
+	}
+	pointers := make(map[string]storage.Pointer)
+	for _, key := range keys {
+		content, err := s.pointers.Get(key)
+		if err != nil {
+			return nil, fmt.Errorf("tree.Store.RemoteRootPointers: %w", err)
+		}
+		p, err := storage.NewPointerFromHex(strings.TrimSpace(string(content)))
+		if err != nil {
+			return nil, fmt.Errorf("tree.Store.RemoteRootPointers: %q: %w", key, err)
+		}
+		pointers[strings.TrimPrefix(string(key), RemoteRootKeyPrefix)] = p
+	}
+	return pointers, nil
+}
+
 func (s *Store) LocalRootKey() (storage.Pointer, error) {
 	return localPointer(filepath.Join(s.baseDir, "root"))
 }
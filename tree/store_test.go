@@ -1,6 +1,7 @@
 package tree
 
 import (
+	"errors"
 	"math/rand"
 	"testing"
 
@@ -29,3 +30,36 @@ func newTestStore(t *testing.T) *Store {
 	}
 	return treeStore
 }
+
+func TestUpdateRemoteBasePointer(t *testing.T) {
+	pointers := &storage.InMemory{}
+	treeStore, err := NewStore(newTestBlockFactory(t), pointers, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Two hosts push after pulling the same (missing) remote base.
+	first, second := storage.RandomPointer(), storage.RandomPointer()
+	if err := treeStore.UpdateRemoteBasePointer(storage.Null, first); err != nil {
+		t.Fatal(err)
+	}
+	if err := treeStore.UpdateRemoteBasePointer(storage.Null, second); !errors.Is(err, storage.ErrConflict) {
+		t.Fatalf("got %v, want %v", err, storage.ErrConflict)
+	}
+	if got, err := treeStore.RemoteBasePointer(); err != nil {
+		t.Fatal(err)
+	} else if !got.Equals(first) {
+		t.Fatalf("got %v, want %v", got, first)
+	}
+	// Pointers stored with trailing white space, e.g., by hand, still match.
+	if err := pointers.Put(storage.Key(RemoteRootKeyPrefix+"base"), []byte(first.Hex()+"\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := treeStore.UpdateRemoteBasePointer(first, second); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := treeStore.RemoteBasePointer(); err != nil {
+		t.Fatal(err)
+	} else if !got.Equals(second) {
+		t.Errorf("got %v, want %v", got, second)
+	}
+}
@@ -2,7 +2,6 @@ package tree
 
 import (
 	"fmt"
-	"runtime"
 	"strings"
 	"time"
 
@@ -18,7 +17,8 @@ type Tree struct {
 
 	revision  storage.Pointer
 	root      *Node
-	blockSize uint32 // For new nodes.
+	blockSize uint32         // For new nodes.
+	chunking  chunkingScheme // For new files.
 
 	readOnly bool
 
@@ -42,6 +42,7 @@ func NewTree(store *Store, opts ...TreeOption) (*Tree, error) {
 	if t.root == nil {
 		parent := &Node{
 			blockFactory: store.blockFactory,
+			cache:        store.memory,
 			flags:        loaded,
 		}
 		root, err := t.Add(parent, "root", 0700|DMDIR)
@@ -53,8 +54,6 @@ func NewTree(store *Store, opts ...TreeOption) (*Tree, error) {
 		// which was only introduced to re-use the logic in tree.Add.
 		t.root.parent = nil
 	}
-	// TODO when does it exit?
-	go t.trimPeriodically()
 	return t, nil
 }
 
@@ -62,23 +61,13 @@ func (tree *Tree) Attach() *Node {
 	return tree.root
 }
 
-func (tree *Tree) trimPeriodically() {
-	for {
-		time.Sleep(time.Minute)
-		// This, I think, is the only protection against loading large files temporarily.
-		// The problem with large files is that they take up a lot of memory and changes the
-		// GC target too much. This is the only way to free up that memory.
-		tree.root.Trim()
-		runtime.GC()
-	}
-}
-
 func (tree *Tree) Root() (storage.Pointer, *Node) { return tree.revision, tree.root }
 
 func (tree *Tree) Add(node *Node, name string, perm uint32) (*Node, error) {
 	child := &Node{
 		flags:        loaded | dirty,
 		blockFactory: node.blockFactory,
+		cache:        node.cache,
 		bsize:        uint32(tree.blockSize),
 		parent:       node,
 		info: NodeInfo{
@@ -86,6 +75,9 @@ func (tree *Tree) Add(node *Node, name string, perm uint32) (*Node, error) {
 			Mode: perm,
 		},
 	}
+	if perm&DMDIR == 0 {
+		child.chunking = tree.chunking
+	}
 	child.info.ID = uint64(time.Now().UnixNano())
 	child.info.Version = 1
 	child.touchNow()
@@ -65,5 +65,10 @@ func (tree *Tree) grow(parent *Node, load func(*Node) error) error {
 			return nil
 		})
 	}
-	return g.Wait()
+	err := g.Wait()
+	parent.cache.touchNode(parent)
+	for _, child := range parent.children {
+		child.cache.touchNode(child)
+	}
+	return err
 }
@@ -20,6 +20,22 @@ func WithMutable(blockSize uint32) TreeOption {
 	}
 }
 
+// WithChunking specifies how the content of new files should be split
+// into blocks: "fixed" (the default) for blocks of exactly the block size
+// given to WithMutable, or "fastcdc" for content-defined blocks no larger
+// than the block size. Existing files keep the scheme they were written
+// with.
+func WithChunking(name string) TreeOption {
+	return func(t *Tree) error {
+		scheme, err := parseChunking(name)
+		if err != nil {
+			return err
+		}
+		t.chunking = scheme
+		return nil
+	}
+}
+
 // WithRevision specifies that the tree's root node should be the
 // revision's root node.
 func WithRevision(p storage.Pointer) TreeOption {